@@ -0,0 +1,159 @@
+// auth holds the API keys allowed to use the server, and what each may do.
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync/atomic"
+)
+
+// Scope is a kind of access granted to a key.
+type Scope string
+
+const (
+	// ScopeRead allows reading images' metadata and listings, and events.
+	ScopeRead Scope = "read"
+	// ScopeUpload allows uploading, replacing, editing, and copying images.
+	ScopeUpload Scope = "upload"
+	// ScopeDelete allows deleting images.
+	ScopeDelete Scope = "delete"
+	// ScopeAdmin allows everything, including managing the trash.
+	ScopeAdmin Scope = "admin"
+)
+
+// minKeyLength is the shortest key accepted, in bytes.
+const minKeyLength = 16
+
+// Key is an API key and the access it grants.
+type Key struct {
+	// Name identifies the key in logs. It isn't secret.
+	Name   string  `json:"name"`
+	Key    string  `json:"key"`
+	Scopes []Scope `json:"scopes"`
+	// Guilds, if set, restricts the key to images belonging to these guilds.
+	Guilds []int `json:"guilds,omitempty"`
+}
+
+// Allows returns true if the key has scope, or is an admin key.
+func (k *Key) Allows(scope Scope) bool {
+	return slices.Contains(k.Scopes, scope) || slices.Contains(k.Scopes, ScopeAdmin)
+}
+
+// Restricted returns true if the key is limited to certain guilds.
+func (k *Key) Restricted() bool {
+	return len(k.Guilds) > 0
+}
+
+// AllowsGuild returns true if the key may access the guild's images.
+// Restricted keys never have access to images without a guild.
+func (k *Key) AllowsGuild(guild int) bool {
+	return !k.Restricted() || (guild != 0 && slices.Contains(k.Guilds, guild))
+}
+
+// Parse reads a JSON array of keys, checking that each is usable.
+func Parse(data []byte) ([]Key, error) {
+	var keys []Key
+	if err := json.Unmarshal(data, &keys); err != nil {
+		return nil, fmt.Errorf("invalid API keys: %w", err)
+	}
+	seen := make(map[string]bool)
+	for i, key := range keys {
+		if key.Name == "" {
+			return nil, fmt.Errorf("API key %d has no name", i+1)
+		}
+		if len(key.Key) < minKeyLength {
+			return nil, fmt.Errorf("API key %s must be at least %d characters", key.Name, minKeyLength)
+		}
+		if seen[key.Key] {
+			return nil, fmt.Errorf("API key %s duplicates another key", key.Name)
+		}
+		seen[key.Key] = true
+		if len(key.Scopes) == 0 {
+			return nil, fmt.Errorf("API key %s has no scopes", key.Name)
+		}
+		for _, scope := range key.Scopes {
+			switch scope {
+			case ScopeRead, ScopeUpload, ScopeDelete, ScopeAdmin:
+			default:
+				return nil, fmt.Errorf("API key %s has unknown scope %q", key.Name, scope)
+			}
+		}
+		for _, guild := range key.Guilds {
+			if guild <= 0 {
+				return nil, fmt.Errorf("API key %s has invalid guild %d", key.Name, guild)
+			}
+		}
+	}
+	return keys, nil
+}
+
+// Keyring holds the keys loaded from a file and the environment. It's safe
+// for concurrent use, including reloading.
+type Keyring struct {
+	path string
+	env  string
+	keys atomic.Pointer[map[[sha256.Size]byte]*Key]
+}
+
+// Load reads the keys in the file at path, if it isn't empty, and those in
+// env, the JSON value of an environment variable.
+func Load(path, env string) (*Keyring, error) {
+	if path == "" && env == "" {
+		return nil, errors.New("no API keys given")
+	}
+	k := &Keyring{path: path, env: env}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload reads the key file again. If it's invalid, the current keys are
+// kept.
+func (k *Keyring) Reload() error {
+	var keys []Key
+	if k.path != "" {
+		data, err := os.ReadFile(k.path)
+		if err != nil {
+			return err
+		}
+		if keys, err = Parse(data); err != nil {
+			return fmt.Errorf("%s: %w", k.path, err)
+		}
+	}
+	if k.env != "" {
+		envKeys, err := Parse([]byte(k.env))
+		if err != nil {
+			return fmt.Errorf("environment: %w", err)
+		}
+		keys = append(keys, envKeys...)
+	}
+
+	// Keys are looked up by hash, so that finding one doesn't depend on how
+	// much of it matches
+	byHash := make(map[[sha256.Size]byte]*Key, len(keys))
+	for i := range keys {
+		hash := sha256.Sum256([]byte(keys[i].Key))
+		if _, ok := byHash[hash]; ok {
+			return fmt.Errorf("API key %s duplicates another key", keys[i].Name)
+		}
+		byHash[hash] = &keys[i]
+	}
+	k.keys.Store(&byHash)
+	return nil
+}
+
+// Lookup returns the key matching secret.
+func (k *Keyring) Lookup(secret string) (*Key, bool) {
+	key, ok := (*k.keys.Load())[sha256.Sum256([]byte(secret))]
+	return key, ok
+}
+
+// Len returns the number of keys.
+func (k *Keyring) Len() int {
+	return len(*k.keys.Load())
+}
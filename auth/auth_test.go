@@ -0,0 +1,121 @@
+package auth
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const botKey = `{"name": "bot", "key": "0123456789abcdef", "scopes": ["upload", "read"], "guilds": [1, 2]}`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		err  string
+	}{
+		{"valid", "[" + botKey + "]", ""},
+		{"empty", "[]", ""},
+		{"not JSON", "bot:key", "invalid API keys"},
+		{"no name", `[{"key": "0123456789abcdef", "scopes": ["read"]}]`, "no name"},
+		{"short key", `[{"name": "a", "key": "short", "scopes": ["read"]}]`, "at least"},
+		{"no scopes", `[{"name": "a", "key": "0123456789abcdef"}]`, "no scopes"},
+		{"unknown scope", `[{"name": "a", "key": "0123456789abcdef", "scopes": ["write"]}]`, "unknown scope"},
+		{"invalid guild", `[{"name": "a", "key": "0123456789abcdef", "scopes": ["read"], "guilds": [0]}]`, "invalid guild"},
+		{"duplicate", "[" + botKey + "," + botKey + "]", "duplicates"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.data))
+			if tt.err == "" && err != nil {
+				t.Errorf("Expected no error, got %v", err)
+			}
+			if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+				t.Errorf("Expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	keys, err := Parse([]byte("[" + botKey + `, {"name": "admin", "key": "fedcba9876543210", "scopes": ["admin"]}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot, admin := keys[0], keys[1]
+
+	if !bot.Allows(ScopeUpload) || bot.Allows(ScopeDelete) || bot.Allows(ScopeAdmin) {
+		t.Errorf("Unexpected scopes for bot: %v", bot.Scopes)
+	}
+	if !admin.Allows(ScopeDelete) || !admin.Allows(ScopeRead) {
+		t.Error("Expected admin to allow every scope")
+	}
+
+	if !bot.Restricted() || !bot.AllowsGuild(2) || bot.AllowsGuild(3) || bot.AllowsGuild(0) {
+		t.Errorf("Unexpected guild restrictions for bot: %v", bot.Guilds)
+	}
+	if admin.Restricted() || !admin.AllowsGuild(0) || !admin.AllowsGuild(3) {
+		t.Error("Expected admin to allow every guild")
+	}
+}
+
+func TestKeyring(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := os.WriteFile(path, []byte("["+botKey+"]"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := Load(path, `[{"name": "env", "key": "fedcba9876543210", "scopes": ["delete"]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Len() != 2 {
+		t.Errorf("Expected 2 keys, got %d", k.Len())
+	}
+	if key, ok := k.Lookup("0123456789abcdef"); !ok || key.Name != "bot" {
+		t.Errorf("Expected bot key, got %+v", key)
+	}
+	if key, ok := k.Lookup("fedcba9876543210"); !ok || key.Name != "env" {
+		t.Errorf("Expected env key, got %+v", key)
+	}
+	if _, ok := k.Lookup("0123456789abcdeF"); ok {
+		t.Error("Expected no match for an unknown key")
+	}
+
+	t.Run("reload", func(t *testing.T) {
+		os.WriteFile(path, []byte(`[{"name": "new", "key": "aaaaaaaaaaaaaaaa", "scopes": ["read"]}]`), 0600)
+		if err := k.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := k.Lookup("0123456789abcdef"); ok {
+			t.Error("Expected the removed key to be gone")
+		}
+		if _, ok := k.Lookup("aaaaaaaaaaaaaaaa"); !ok {
+			t.Error("Expected the new key to be loaded")
+		}
+	})
+
+	t.Run("invalid reload keeps keys", func(t *testing.T) {
+		os.WriteFile(path, []byte("not json"), 0600)
+		if err := k.Reload(); err == nil {
+			t.Fatal("Expected an error")
+		}
+		if _, ok := k.Lookup("aaaaaaaaaaaaaaaa"); !ok {
+			t.Error("Expected the previous keys to be kept")
+		}
+	})
+
+	t.Run("no keys given", func(t *testing.T) {
+		if _, err := Load("", ""); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+
+	t.Run("duplicate across sources", func(t *testing.T) {
+		os.WriteFile(path, []byte("["+botKey+"]"), 0600)
+		if _, err := Load(path, "["+botKey+"]"); err == nil {
+			t.Error("Expected an error")
+		}
+	})
+}
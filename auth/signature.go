@@ -0,0 +1,104 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MaxClockSkew is how far a signed request's timestamp may be from the
+// server's clock.
+const MaxClockSkew = 5 * time.Minute
+
+// Errors returned by Verify.
+var (
+	ErrBadTimestamp = errors.New("timestamp is missing or outside the allowed window")
+	ErrBadSignature = errors.New("signature does not match")
+	ErrReplayed     = errors.New("request has already been made")
+)
+
+// SignRequest returns the signature of a request: "sha256=" followed by the
+// hex HMAC-SHA256 of the method, request URI, timestamp, and body, each
+// followed by a newline except the body.
+func SignRequest(secret []byte, method, uri, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp + "\n"))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// CheckTimestamp parses a signed request's timestamp, in Unix seconds, and
+// checks that it's within MaxClockSkew of now. It's cheap, so it can be used
+// to reject stale requests before reading their bodies.
+func CheckTimestamp(timestamp string, now time.Time) (time.Time, error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, ErrBadTimestamp
+	}
+	sent := time.Unix(seconds, 0)
+	if sent.Before(now.Add(-MaxClockSkew)) || sent.After(now.Add(MaxClockSkew)) {
+		return time.Time{}, ErrBadTimestamp
+	}
+	return sent, nil
+}
+
+// replaySweepInterval is how often expired signatures are forgotten.
+const replaySweepInterval = time.Minute
+
+// Verifier checks signed requests, rejecting any made twice.
+type Verifier struct {
+	secret []byte
+
+	mu   sync.Mutex
+	seen map[string]time.Time
+	// swept is when expired signatures were last forgotten.
+	swept time.Time
+}
+
+// NewVerifier returns a verifier for requests signed with secret, which must
+// be as long as an API key.
+func NewVerifier(secret string) (*Verifier, error) {
+	if len(secret) < minKeyLength {
+		return nil, fmt.Errorf("signing secret must be at least %d characters", minKeyLength)
+	}
+	return &Verifier{secret: []byte(secret), seen: make(map[string]time.Time)}, nil
+}
+
+// Verify checks a request's signature and its timestamp, in Unix seconds,
+// against now. Each signature is accepted once; since timestamps outside the
+// window are rejected, signatures only need remembering that long.
+func (v *Verifier) Verify(method, uri, timestamp, signature string, body []byte, now time.Time) error {
+	sent, err := CheckTimestamp(timestamp, now)
+	if err != nil {
+		return err
+	}
+
+	want := SignRequest(v.secret, method, uri, timestamp, body)
+	if !hmac.Equal([]byte(strings.ToLower(signature)), []byte(want)) {
+		return ErrBadSignature
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	// Sweeping scans every signature, so it's done at most once per interval
+	if now.Sub(v.swept) >= replaySweepInterval {
+		for sig, expires := range v.seen {
+			if now.After(expires) {
+				delete(v.seen, sig)
+			}
+		}
+		v.swept = now
+	}
+	if expires, ok := v.seen[want]; ok && !now.After(expires) {
+		return ErrReplayed
+	}
+	// Remember it until its timestamp leaves the window
+	v.seen[want] = sent.Add(MaxClockSkew)
+	return nil
+}
@@ -0,0 +1,129 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSignRequest(t *testing.T) {
+	// Computed with:
+	// printf 'POST\n/image/upload\n1700000000\n{}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=e55a07a6faffbf7a584719620809c2a808e5ff77f55297cefe5acdd0648d7b17"
+	got := SignRequest([]byte("secret"), "POST", "/image/upload", "1700000000", []byte("{}"))
+	if got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+const testSecret = "0123456789abcdef"
+
+func mustVerifier(t *testing.T, secret string) *Verifier {
+	t.Helper()
+	v, err := NewVerifier(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestNewVerifier(t *testing.T) {
+	if _, err := NewVerifier("short"); err == nil {
+		t.Error("Expected error for a short secret")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	body := []byte(`{"charid": "507f1f77bcf86cd799439011"}`)
+	sign := func(ts time.Time) (string, string) {
+		timestamp := strconv.FormatInt(ts.Unix(), 10)
+		return timestamp, SignRequest([]byte(testSecret), "POST", "/image/upload", timestamp, body)
+	}
+
+	t.Run("valid once", func(t *testing.T) {
+		v := mustVerifier(t, testSecret)
+		timestamp, sig := sign(now)
+		if err := v.Verify("POST", "/image/upload", timestamp, sig, body, now); err != nil {
+			t.Fatalf("Expected valid signature, got %v", err)
+		}
+		if err := v.Verify("POST", "/image/upload", timestamp, sig, body, now.Add(time.Second)); !errors.Is(err, ErrReplayed) {
+			t.Errorf("Expected ErrReplayed, got %v", err)
+		}
+	})
+
+	t.Run("clock skew", func(t *testing.T) {
+		v := mustVerifier(t, testSecret)
+		timestamp, sig := sign(now.Add(-MaxClockSkew + time.Second))
+		if err := v.Verify("POST", "/image/upload", timestamp, sig, body, now); err != nil {
+			t.Errorf("Expected a timestamp within the window to pass, got %v", err)
+		}
+		for _, ts := range []time.Time{now.Add(-MaxClockSkew - time.Second), now.Add(MaxClockSkew + time.Second)} {
+			timestamp, sig := sign(ts)
+			if err := v.Verify("POST", "/image/upload", timestamp, sig, body, now); !errors.Is(err, ErrBadTimestamp) {
+				t.Errorf("Expected ErrBadTimestamp for %v, got %v", ts, err)
+			}
+		}
+		if err := v.Verify("POST", "/image/upload", "yesterday", sig, body, now); !errors.Is(err, ErrBadTimestamp) {
+			t.Errorf("Expected ErrBadTimestamp for an invalid timestamp, got %v", err)
+		}
+	})
+
+	t.Run("tampering", func(t *testing.T) {
+		v := mustVerifier(t, testSecret)
+		timestamp, sig := sign(now)
+		tests := []struct {
+			name         string
+			method, uri  string
+			body         []byte
+			verifySecret string
+		}{
+			{"method", "DELETE", "/image/upload", body, testSecret},
+			{"uri", "POST", "/image/upload?async=true", body, testSecret},
+			{"body", "POST", "/image/upload", []byte("{}"), testSecret},
+			{"secret", "POST", "/image/upload", body, "another secret, long enough"},
+		}
+		for _, tt := range tests {
+			v := v
+			if tt.verifySecret != testSecret {
+				v = mustVerifier(t, tt.verifySecret)
+			}
+			if err := v.Verify(tt.method, tt.uri, timestamp, sig, tt.body, now); !errors.Is(err, ErrBadSignature) {
+				t.Errorf("%s: expected ErrBadSignature, got %v", tt.name, err)
+			}
+		}
+	})
+
+	t.Run("forgets expired signatures", func(t *testing.T) {
+		v := mustVerifier(t, testSecret)
+		timestamp, sig := sign(now)
+		v.Verify("POST", "/image/upload", timestamp, sig, body, now)
+		other, otherSig := sign(now.Add(2 * MaxClockSkew))
+		v.Verify("POST", "/image/upload", other, otherSig, body, now.Add(2*MaxClockSkew))
+		if len(v.seen) != 1 {
+			t.Errorf("Expected 1 remembered signature, got %d", len(v.seen))
+		}
+	})
+
+	t.Run("sweeps at most once per interval", func(t *testing.T) {
+		v := mustVerifier(t, testSecret)
+		timestamp, sig := sign(now)
+		v.Verify("POST", "/image/upload", timestamp, sig, body, now)
+		// Expired, but swept too recently to be forgotten yet
+		v.swept = now.Add(MaxClockSkew + time.Second)
+		later := now.Add(MaxClockSkew + 2*time.Second)
+		other, otherSig := sign(later)
+		v.Verify("POST", "/image/upload", other, otherSig, body, later)
+		if len(v.seen) != 2 {
+			t.Errorf("Expected 2 remembered signatures, got %d", len(v.seen))
+		}
+
+		last := later.Add(replaySweepInterval)
+		third, thirdSig := sign(last)
+		v.Verify("POST", "/image/upload", third, thirdSig, body, last)
+		if len(v.seen) != 2 {
+			t.Errorf("Expected the expired signature to be swept, got %d remembered", len(v.seen))
+		}
+	})
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// ErrExpired is returned by URLSigner.Verify for a URL past its expiry.
+var ErrExpired = errors.New("URL has expired")
+
+// URLSigner signs and verifies expiring URLs.
+type URLSigner struct {
+	secret []byte
+}
+
+// NewURLSigner returns a signer using secret, which must be as long as an API
+// key.
+func NewURLSigner(secret string) (*URLSigner, error) {
+	if len(secret) < minKeyLength {
+		return nil, fmt.Errorf("URL secret must be at least %d characters", minKeyLength)
+	}
+	return &URLSigner{secret: []byte(secret)}, nil
+}
+
+// Sign returns the signature for a URL path that expires at the given Unix
+// time, for its sig query parameter.
+func (s *URLSigner) Sign(path string, expires int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks a URL path's exp and sig query parameters against now.
+func (s *URLSigner) Verify(path, exp, sig string, now time.Time) error {
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return ErrBadSignature
+	}
+	if !hmac.Equal([]byte(sig), []byte(s.Sign(path, expires))) {
+		return ErrBadSignature
+	}
+	if now.Unix() >= expires {
+		return ErrExpired
+	}
+	return nil
+}
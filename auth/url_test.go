@@ -0,0 +1,50 @@
+package auth
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestURLSigner(t *testing.T) {
+	if _, err := NewURLSigner("short"); err == nil {
+		t.Error("Expected error for a short secret")
+	}
+	s, err := NewURLSigner(testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1700000000, 0)
+	path := "/signed/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp"
+	expires := now.Add(time.Hour).Unix()
+	exp := strconv.FormatInt(expires, 10)
+	sig := s.Sign(path, expires)
+
+	other, _ := NewURLSigner("another secret, long enough")
+	tests := []struct {
+		name   string
+		signer *URLSigner
+		path   string
+		exp    string
+		sig    string
+		now    time.Time
+		want   error
+	}{
+		{"valid", s, path, exp, sig, now, nil},
+		{"expired", s, path, exp, sig, now.Add(time.Hour), ErrExpired},
+		{"extended expiry", s, path, strconv.FormatInt(expires+3600, 10), sig, now, ErrBadSignature},
+		{"invalid expiry", s, path, "tomorrow", sig, now, ErrBadSignature},
+		{"other image", s, "/signed/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp", exp, sig, now, ErrBadSignature},
+		{"other secret", other, path, exp, sig, now, ErrBadSignature},
+		{"missing signature", s, path, exp, "", now, ErrBadSignature},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.signer.Verify(tt.path, tt.exp, tt.sig, tt.now); !errors.Is(err, tt.want) {
+				t.Errorf("Expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
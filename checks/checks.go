@@ -6,6 +6,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"go.mongodb.org/mongo-driver/bson/primitive"
@@ -71,3 +72,9 @@ func AbsPath(base, path string) (string, error) {
 	}
 	return absPath, nil
 }
+
+// IsValidDiscordID returns true if the string represents a valid Discord snowflake.
+func IsValidDiscordID(id string) bool {
+	n, err := strconv.ParseInt(id, 10, 64)
+	return err == nil && n > 0
+}
@@ -170,6 +170,32 @@ func TestIsValidObjectId(t *testing.T) {
 	}
 }
 
+func TestIsValidDiscordID(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		expected bool
+	}{
+		{"invalid hex", "613d3e4bba8a6a8dc", false},
+		{"valid numeric", "1234567890123456789", true},
+		{"valid small", "12345", true},
+		{"invalid zero", "0", false},
+		{"invalid negative", "-12345", false},
+		{"invalid empty", "", false},
+		{"invalid overflow", "99999999999999999999", false},
+		{"invalid path", "../12345", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := IsValidDiscordID(tt.id)
+			if result != tt.expected {
+				t.Errorf("IsValidDiscordID(%q) = %v, expected %v", tt.id, result, tt.expected)
+			}
+		})
+	}
+}
+
 func TestAbsPath(t *testing.T) {
 	// Create a temporary base directory
 	tmpBase, err := os.MkdirTemp("", "test-base-*")
@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"faceclaimer/checks"
+	"faceclaimer/storage"
+)
+
+var (
+	migrateFrom       string
+	migrateTo         string
+	migrateOwners     string
+	migrateBaseURL    string
+	migrateNewBaseURL string
+	migrateURLMap     string
+	migrateFromMeta   string
+	migrateToMeta     string
+)
+
+// migrateCmd copies images between directories and/or layouts.
+var migrateCmd = &cobra.Command{
+	Use:   "migrate --from DIR[:LAYOUT] --to DIR[:LAYOUT]",
+	Short: "Copy images to a new directory or storage layout.",
+	Long: `Copy every image from one images directory and layout to another,
+verifying each copy. Layouts are flat (the default), hierarchical, or sharded.
+
+Source images are left untouched, so the server can keep running against the
+old location while the migration runs. Images already present at the
+destination are skipped, so an interrupted migration can be resumed by running
+it again, and a final pass after stopping the server picks up any images
+uploaded in the meantime.
+
+Each image's metadata is copied from --from-meta-dir to --to-meta-dir, which
+must be outside the images directories.
+
+Migrating to the hierarchical layout from one that doesn't record guilds and
+users requires --owners, a CSV file of charid,guild,user rows.
+
+When finished, a tab-separated mapping of old URLs to new URLs is written so
+that stored character documents can be updated.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if migrateBaseURL != "" && !checks.IsValidURL(migrateBaseURL) {
+			return errors.New("base-url must be a valid URL (e.g., https://example.com)")
+		}
+		if migrateNewBaseURL != "" && !checks.IsValidURL(migrateNewBaseURL) {
+			return errors.New("new-base-url must be a valid URL (e.g., https://example.com)")
+		}
+		return nil
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		from, err := storage.ParseLocation(migrateFrom)
+		if err != nil {
+			return fmt.Errorf("invalid --from: %w", err)
+		}
+		if !checks.DirExists(from.Dir) {
+			return fmt.Errorf("source directory does not exist: %s", from.Dir)
+		}
+		to, err := storage.ParseLocation(migrateTo)
+		if err != nil {
+			return fmt.Errorf("invalid --to: %w", err)
+		}
+		from.MetaDir, to.MetaDir = migrateFromMeta, migrateToMeta
+		for _, loc := range []storage.Location{from, to} {
+			if loc.MetaDir != "" && (within(loc.Dir, loc.MetaDir) || within(loc.MetaDir, loc.Dir)) {
+				return fmt.Errorf("metadata directory %s must be outside %s", loc.MetaDir, loc.Dir)
+			}
+		}
+
+		opts := storage.MigrateOptions{Progress: migrateProgress()}
+		if to.Layout.UsesOwners() && !from.Layout.UsesOwners() {
+			if migrateOwners == "" {
+				return fmt.Errorf("--owners is required to migrate from the %s layout to the %s layout", from.Layout, to.Layout)
+			}
+			if opts.Owners, err = readOwners(migrateOwners); err != nil {
+				return err
+			}
+		}
+
+		slog.Info("Starting migration", "from", from, "to", to)
+		result, err := storage.Migrate(from, to, opts)
+		if err != nil {
+			return err
+		}
+		slog.Info("Migration finished", "total", result.Total, "copied", result.Copied, "skipped", result.Skipped, "failed", result.Failed)
+
+		if err := writeURLMap(result.Moves, from.Layout, to.Layout); err != nil {
+			return err
+		}
+		if result.Failed > 0 {
+			return fmt.Errorf("%d images failed to migrate; re-run to retry", result.Failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	migrateCmd.Flags().StringVar(&migrateFrom, "from", "", "Source images directory and layout, as DIR[:LAYOUT]")
+	migrateCmd.Flags().StringVar(&migrateTo, "to", "", "Destination images directory and layout, as DIR[:LAYOUT]")
+	migrateCmd.Flags().StringVar(&migrateFromMeta, "from-meta-dir", "", "Source metadata directory (no metadata is copied if empty)")
+	migrateCmd.Flags().StringVar(&migrateToMeta, "to-meta-dir", "", "Destination metadata directory (no metadata is copied if empty)")
+	migrateCmd.Flags().StringVar(&migrateOwners, "owners", "", "CSV file of charid,guild,user rows, for migrating to the hierarchical layout")
+	migrateCmd.Flags().StringVar(&migrateBaseURL, "base-url", "", "Base URL of the source images, used in the URL map")
+	migrateCmd.Flags().StringVar(&migrateNewBaseURL, "new-base-url", "", "Base URL of the migrated images (default: --base-url)")
+	migrateCmd.Flags().StringVar(&migrateURLMap, "url-map", "-", "File to write the old-to-new URL map to, or - for stdout")
+	migrateCmd.MarkFlagRequired("from")
+	migrateCmd.MarkFlagRequired("to")
+	rootCmd.AddCommand(migrateCmd)
+}
+
+// migrateProgress returns a progress callback that logs at most every few
+// seconds, plus once at the end.
+func migrateProgress() func(storage.MigrateResult) {
+	var last time.Time
+	return func(r storage.MigrateResult) {
+		if time.Since(last) < 5*time.Second && r.Done() < r.Total {
+			return
+		}
+		last = time.Now()
+		slog.Info("Migration progress", "done", r.Done(), "total", r.Total, "failed", r.Failed)
+	}
+}
+
+// readOwners loads a CSV file of charid,guild,user rows. A header row is
+// permitted.
+func readOwners(path string) (map[string]storage.Owner, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = 3
+	owners := make(map[string]storage.Owner)
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s: %w", path, err)
+		}
+		if line == 1 && record[0] == "charid" {
+			continue
+		}
+		charID := strings.TrimSpace(record[0])
+		guild, guildErr := strconv.Atoi(strings.TrimSpace(record[1]))
+		user, userErr := strconv.Atoi(strings.TrimSpace(record[2]))
+		if !checks.IsValidObjectId(charID) || guildErr != nil || userErr != nil || guild <= 0 || user <= 0 {
+			return nil, fmt.Errorf("%s line %d: expected charid,guild,user", path, line)
+		}
+		owners[charID] = storage.Owner{Guild: guild, User: user}
+	}
+	return owners, nil
+}
+
+// writeURLMap writes a tab-separated line of old URL and new URL for each
+// moved image. Without base URLs, paths relative to the images directory are
+// written instead.
+func writeURLMap(moves []storage.Move, from, to storage.Layout) error {
+	out := os.Stdout
+	if migrateURLMap != "-" {
+		f, err := os.Create(migrateURLMap)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	newBaseURL := migrateNewBaseURL
+	if newBaseURL == "" {
+		newBaseURL = migrateBaseURL
+	}
+	for _, move := range moves {
+		oldURL := imageURL(migrateBaseURL, move.From.Parts(from))
+		newURL := imageURL(newBaseURL, move.To.Parts(to))
+		if _, err := fmt.Fprintf(out, "%s\t%s\n", oldURL, newURL); err != nil {
+			return err
+		}
+	}
+	if out != os.Stdout {
+		slog.Info("Wrote URL map", "path", migrateURLMap, "entries", len(moves))
+	}
+	return nil
+}
+
+// imageURL joins the base URL and path parts, omitting an empty base URL.
+func imageURL(baseURL string, parts []string) string {
+	path := strings.Join(parts, "/")
+	if baseURL == "" {
+		return path
+	}
+	return strings.TrimSuffix(baseURL, "/") + "/" + path
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"faceclaimer/storage"
+)
+
+func TestReadOwners(t *testing.T) {
+	tests := []struct {
+		name      string
+		contents  string
+		expected  map[string]storage.Owner
+		wantError bool
+	}{
+		{
+			name:     "with header",
+			contents: "charid,guild,user\n507f1f77bcf86cd799439011,123,456\n",
+			expected: map[string]storage.Owner{"507f1f77bcf86cd799439011": {Guild: 123, User: 456}},
+		},
+		{
+			name:     "without header",
+			contents: "507f1f77bcf86cd799439011, 123, 456\n",
+			expected: map[string]storage.Owner{"507f1f77bcf86cd799439011": {Guild: 123, User: 456}},
+		},
+		{
+			name:      "invalid character ID",
+			contents:  "not-an-id,123,456\n",
+			wantError: true,
+		},
+		{
+			name:      "invalid guild",
+			contents:  "507f1f77bcf86cd799439011,abc,456\n",
+			wantError: true,
+		},
+		{
+			name:      "wrong field count",
+			contents:  "507f1f77bcf86cd799439011,123\n",
+			wantError: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "owners.csv")
+			if err := os.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+				t.Fatalf("Failed to write owners file: %v", err)
+			}
+
+			owners, err := readOwners(path)
+			if tt.wantError {
+				if err == nil {
+					t.Errorf("Expected error, got %v", owners)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected no error, got: %v", err)
+			}
+			for charID, owner := range tt.expected {
+				if owners[charID] != owner {
+					t.Errorf("Expected owner %+v for %s, got %+v", owner, charID, owners[charID])
+				}
+			}
+		})
+	}
+}
+
+func TestImageURL(t *testing.T) {
+	parts := []string{"507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp"}
+
+	if got := imageURL("https://example.com/", parts); got != "https://example.com/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp" {
+		t.Errorf("Unexpected URL: %s", got)
+	}
+	if got := imageURL("", parts); got != "507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp" {
+		t.Errorf("Unexpected relative path: %s", got)
+	}
+}
@@ -0,0 +1,57 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"faceclaimer/checks"
+	"faceclaimer/storage"
+)
+
+// moveMetaCmd moves metadata that older versions kept in the images directory
+// into the metadata directory.
+var moveMetaCmd = &cobra.Command{
+	Use:   "move-meta",
+	Short: "Move image metadata out of the images directory.",
+	Long: `Move the metadata that older versions kept beside each image, or in hidden
+.meta directories, from the images directory into --meta-dir.
+
+This only needs to be run once, after upgrading. Until it has been, the server
+reports images without their source URL or owners, and the files remain
+publicly served. Metadata already present in --meta-dir is kept, and the old
+copy deleted.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if !checks.DirExists(imagesDir) {
+			return fmt.Errorf("images-dir does not exist: %s", imagesDir)
+		}
+		if metaDir == "" {
+			return errors.New("meta-dir is required")
+		}
+
+		absPath, err := filepath.Abs(imagesDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve absolute path for images-dir: %w", err)
+		}
+		imagesDir = absPath
+
+		return resolveMetaDir()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		moved, err := storage.MoveLegacyMeta(storageDirs())
+		if err != nil {
+			return fmt.Errorf("failed to move metadata: %w", err)
+		}
+		slog.Info("Moved metadata", "imagesDir", imagesDir, "metaDir", metaDir, "files", moved)
+		return nil
+	},
+}
+
+func init() {
+	moveMetaCmd.Flags().StringVar(&imagesDir, "images-dir", "images", "Directory images are stored in")
+	moveMetaCmd.Flags().StringVar(&metaDir, "meta-dir", "meta", "Directory to move image metadata to")
+	rootCmd.AddCommand(moveMetaCmd)
+}
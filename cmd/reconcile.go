@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"faceclaimer/checks"
+	"faceclaimer/mongostore"
+	"faceclaimer/storage"
+)
+
+var (
+	reconcileCollection string
+	reconcileDelete     bool
+	reconcileMinAge     time.Duration
+)
+
+// Reasons an image is reported as orphaned.
+const (
+	orphanCharacter    = "missing-character"
+	orphanUnreferenced = "unreferenced"
+)
+
+// orphan is a stored image that no character document accounts for.
+type orphan struct {
+	Image  storage.Image
+	Reason string
+}
+
+// reconcileCmd finds, and optionally deletes, images belonging to characters
+// that no longer exist.
+var reconcileCmd = &cobra.Command{
+	Use:   "reconcile --mongo-uri URI",
+	Short: "Find images orphaned by deleted characters.",
+	Long: `Compare the images directory against the bot's character collection and
+report orphaned images: those whose character document no longer exists, and
+those not referenced by their character's document.
+
+A document references an image if it contains the image's URL or filename
+anywhere, or the image's ID as an ObjectID.
+
+Nothing is deleted unless --delete is given. Images uploaded, moved, or
+edited within --min-age are never reported, as the bot may not have recorded
+them yet.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if mongoURI == "" {
+			return errors.New("mongo-uri is required")
+		}
+		if !checks.DirExists(imagesDir) {
+			return fmt.Errorf("images-dir does not exist: %s", imagesDir)
+		}
+		if _, err := storage.ParseLayout(layout); err != nil {
+			return err
+		}
+		if reconcileMinAge < 0 {
+			return errors.New("min-age must not be negative")
+		}
+
+		absPath, err := filepath.Abs(imagesDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve absolute path for images-dir: %w", err)
+		}
+		imagesDir = absPath
+
+		return resolveMetaDir()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		// List images before reading characters, so that any image listed has
+		// had the chance to be recorded in its character's document
+		images, err := storage.Layout(layout).Images(imagesDir)
+		if err != nil {
+			return err
+		}
+
+		store, err := mongostore.Connect(mongoURI, mongoDB)
+		if err != nil {
+			return err
+		}
+		defer store.Close()
+
+		chars, err := store.Characters(reconcileCollection)
+		if err != nil {
+			return err
+		}
+		if len(chars) == 0 {
+			return fmt.Errorf("collection %s has no characters; refusing to treat every image as orphaned", reconcileCollection)
+		}
+
+		orphans := findOrphans(storageDirs(), images, chars, time.Now().Add(-reconcileMinAge))
+		for _, o := range orphans {
+			rel, _ := filepath.Rel(imagesDir, o.Image.Path)
+			fmt.Fprintf(os.Stdout, "%s\t%s\n", o.Reason, rel)
+		}
+		slog.Info("Reconciled images", "images", len(images), "characters", len(chars), "orphaned", len(orphans))
+
+		if !reconcileDelete {
+			if len(orphans) > 0 {
+				slog.Info("Dry run; re-run with --delete to delete orphaned images")
+			}
+			return nil
+		}
+
+		var failed int
+		for _, o := range orphans {
+			if err := storage.RemoveImage(storageDirs(), o.Image); err != nil {
+				slog.Error("Failed to delete image", "path", o.Image.Path, "error", err)
+				failed++
+				continue
+			}
+			if err := store.RecordDeleted(storage.Filter{CharID: o.Image.CharID, ImageID: o.Image.ID}); err != nil {
+				slog.Warn("Failed to record deletion", "path", o.Image.Path, "error", err)
+			}
+		}
+		slog.Info("Deleted orphaned images", "deleted", len(orphans)-failed, "failed", failed)
+		if failed > 0 {
+			return fmt.Errorf("%d images failed to delete", failed)
+		}
+		return nil
+	},
+}
+
+func init() {
+	reconcileCmd.Flags().StringVar(&imagesDir, "images-dir", "images", "Directory to store images")
+	reconcileCmd.Flags().StringVar(&metaDir, "meta-dir", "meta", metaDirUsage)
+	reconcileCmd.Flags().StringVar(&layout, "layout", string(storage.Flat), "Storage layout: flat, hierarchical, or sharded")
+	reconcileCmd.Flags().StringVar(&mongoURI, "mongo-uri", "", "MongoDB connection URI")
+	reconcileCmd.Flags().StringVar(&mongoDB, "mongo-db", "faceclaimer", "MongoDB database holding the character collection")
+	reconcileCmd.Flags().StringVar(&reconcileCollection, "collection", "characters", "Collection of character documents")
+	reconcileCmd.Flags().BoolVar(&reconcileDelete, "delete", false, "Delete orphaned images instead of only reporting them")
+	reconcileCmd.Flags().DurationVar(&reconcileMinAge, "min-age", 24*time.Hour, "Ignore images uploaded, moved, or edited more recently than this")
+	rootCmd.AddCommand(reconcileCmd)
+}
+
+// findOrphans returns the images in d, unchanged since before cutoff, whose
+// character doesn't exist or doesn't reference them.
+func findOrphans(d storage.Dirs, images []storage.Image, chars mongostore.Characters, cutoff time.Time) []orphan {
+	var orphans []orphan
+	for _, img := range images {
+		if !img.Changed(d).Before(cutoff) {
+			continue
+		}
+		refs, ok := chars[img.CharID]
+		switch {
+		case !ok:
+			orphans = append(orphans, orphan{Image: img, Reason: orphanCharacter})
+		case !refs[img.ID]:
+			orphans = append(orphans, orphan{Image: img, Reason: orphanUnreferenced})
+		}
+	}
+	return orphans
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"faceclaimer/mongostore"
+	"faceclaimer/storage"
+)
+
+func TestFindOrphans(t *testing.T) {
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	image := func(charID string, created time.Time) storage.Image {
+		return storage.Image{CharID: charID, ID: primitive.NewObjectIDFromTimestamp(created).Hex()}
+	}
+
+	kept := image("507f1f77bcf86cd799439011", old)
+	unreferenced := image("507f1f77bcf86cd799439011", old)
+	missing := image("507f1f77bcf86cd799439012", old)
+	recent := image("507f1f77bcf86cd799439012", now)
+
+	chars := mongostore.Characters{
+		"507f1f77bcf86cd799439011": {kept.ID: true},
+	}
+	orphans := findOrphans(storage.Dirs{}, []storage.Image{kept, unreferenced, missing, recent}, chars, now.Add(-24*time.Hour))
+
+	expected := []orphan{
+		{Image: unreferenced, Reason: orphanUnreferenced},
+		{Image: missing, Reason: orphanCharacter},
+	}
+	if len(orphans) != len(expected) {
+		t.Fatalf("Expected %d orphans, got %d: %+v", len(expected), len(orphans), orphans)
+	}
+	for i := range expected {
+		if orphans[i] != expected[i] {
+			t.Errorf("Orphan %d = %+v, expected %+v", i, orphans[i], expected[i])
+		}
+	}
+}
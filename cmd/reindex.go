@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+
+	"faceclaimer/checks"
+	"faceclaimer/index"
+	"faceclaimer/storage"
+)
+
+// reindexCmd rebuilds the image index from the images directory.
+var reindexCmd = &cobra.Command{
+	Use:   "reindex --index PATH",
+	Short: "Rebuild the image index from disk.",
+	Long: `Rebuild the image index by scanning the images directory.
+
+The index is normally kept up to date by the server, but can drift if images
+are added or removed by hand. The server must be stopped first, as only one
+process can use the index at a time.`,
+	PreRunE: func(cmd *cobra.Command, args []string) error {
+		if indexPath == "" {
+			return errors.New("index is required")
+		}
+		if !checks.DirExists(imagesDir) {
+			return fmt.Errorf("images-dir does not exist: %s", imagesDir)
+		}
+		if _, err := storage.ParseLayout(layout); err != nil {
+			return err
+		}
+
+		absPath, err := filepath.Abs(imagesDir)
+		if err != nil {
+			return fmt.Errorf("failed to resolve absolute path for images-dir: %w", err)
+		}
+		imagesDir = absPath
+
+		return resolveMetaDir()
+	},
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ix, err := index.Open(indexPath)
+		if err != nil {
+			return err
+		}
+		defer ix.Close()
+
+		return rebuildIndex(ix)
+	},
+}
+
+func init() {
+	reindexCmd.Flags().StringVar(&imagesDir, "images-dir", "images", "Directory to store images")
+	reindexCmd.Flags().StringVar(&metaDir, "meta-dir", "meta", metaDirUsage)
+	reindexCmd.Flags().StringVar(&layout, "layout", string(storage.Flat), "Storage layout: flat, hierarchical, or sharded")
+	reindexCmd.Flags().StringVar(&indexPath, "index", "", "Path to the image index database")
+	rootCmd.AddCommand(reindexCmd)
+}
+
+// openIndex opens the index for the server, building it first if it's empty.
+func openIndex() (*index.Index, error) {
+	ix, err := index.Open(indexPath)
+	if err != nil {
+		return nil, err
+	}
+	empty, err := ix.Empty()
+	if err == nil && empty {
+		err = rebuildIndex(ix)
+	}
+	if err != nil {
+		ix.Close()
+		return nil, err
+	}
+	return ix, nil
+}
+
+// rebuildIndex replaces the index's contents with the images on disk.
+func rebuildIndex(ix *index.Index) error {
+	slog.Info("Rebuilding index", "index", indexPath, "imagesDir", imagesDir, "metaDir", metaDir, "layout", layout)
+	count, err := ix.Rebuild(storageDirs(), storage.Layout(layout))
+	if err != nil {
+		return fmt.Errorf("failed to rebuild index: %w", err)
+	}
+	slog.Info("Rebuilt index", "images", count)
+	return nil
+}
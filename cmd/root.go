@@ -4,26 +4,77 @@ Copyright © 2025 NAME HERE <EMAIL ADDRESS>
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/lmittmann/tint"
 	"github.com/spf13/cobra"
 	"golang.org/x/term"
 
+	"faceclaimer/auth"
 	"faceclaimer/checks"
+	"faceclaimer/mongostore"
 	"faceclaimer/routes"
+	"faceclaimer/storage"
+	"faceclaimer/webhook"
 )
 
+// apiKeysEnv is the environment variable API keys may be given in, as a JSON
+// array in the same format as the --api-keys file.
+const apiKeysEnv = "FACECLAIMER_API_KEYS"
+
+// webhookSecretEnv is the environment variable the webhook secret is read
+// from if --webhook-secret isn't given, keeping it out of the process list.
+const webhookSecretEnv = "FACECLAIMER_WEBHOOK_SECRET"
+
+// signingSecretEnv is the environment variable the request signing secret
+// is read from if --signing-secret isn't given.
+const signingSecretEnv = "FACECLAIMER_SIGNING_SECRET"
+
+// urlSecretEnv is the environment variable the secret for signing image URLs
+// is read from if --url-secret isn't given.
+const urlSecretEnv = "FACECLAIMER_URL_SECRET"
+
 var (
 	port      int
 	imagesDir string
+	metaDir   string
 	baseURL   string
 	quality   int
+	layout    string
+	indexPath string
+	mongoURI  string
+	mongoDB   string
+
+	trashRetention time.Duration
+	revisions      int
+	jobWorkers     int
+	idempotencyTTL time.Duration
+
+	webhookURL    string
+	webhookSecret string
+
+	apiKeysPath   string
+	signingSecret string
+
+	urlSecret string
+	apiURL    string
+
+	tlsCert  string
+	tlsKey   string
+	clientCA string
+
+	watchCollection string
+	watchToken      string
+	watchGrace      time.Duration
 )
 
 // rootCmd represents the base command when called without any subcommands
@@ -32,12 +83,15 @@ var rootCmd = &cobra.Command{
 	Short: "API for managing character profile images.",
 	Long: `A web API for uploading and deleting character images uploaded to Discord.
 
-Images are converted to WebP before being saved to local storage, inside a
-sub-directory of guildId/userId/charId/imageId.webp, with imageId being a
-BSON ObjectId.
+Images are converted to WebP before being saved to local storage, as
+charId/imageId.webp, with imageId being a BSON ObjectId. The hierarchical
+layout instead saves them as guildId/userId/charId/imageId.webp, which allows
+deleting every image belonging to a guild or user.
 
-*THIS API TAKES NO AUTHENTICATION!* It is recommended to run it in a jail
-without an internet connection.`,
+*THIS API TAKES NO AUTHENTICATION* unless API keys are given with --api-keys
+or $FACECLAIMER_API_KEYS, or a request signing secret with --signing-secret
+or $FACECLAIMER_SIGNING_SECRET. It is recommended to run it in a jail without an
+internet connection.`,
 	PersistentPreRun: func(cmd *cobra.Command, args []string) {
 		initLogger()
 	},
@@ -51,6 +105,50 @@ without an internet connection.`,
 		if quality < 1 || quality > 100 {
 			return errors.New("quality must be between 1 and 100")
 		}
+		if _, err := storage.ParseLayout(layout); err != nil {
+			return err
+		}
+		if revisions < 0 {
+			return errors.New("revisions must not be negative")
+		}
+		if jobWorkers < 0 {
+			return errors.New("job-workers must not be negative")
+		}
+		if idempotencyTTL < 0 {
+			return errors.New("idempotency-ttl must not be negative")
+		}
+		if trashRetention < 0 {
+			return errors.New("trash-retention must not be negative")
+		}
+		if webhookSecret == "" {
+			webhookSecret = os.Getenv(webhookSecretEnv)
+		}
+		if webhookURL != "" {
+			if !checks.IsValidURL(webhookURL) {
+				return errors.New("webhook-url must be a valid URL")
+			}
+			if webhookSecret == "" {
+				return fmt.Errorf("webhook-url requires webhook-secret or %s", webhookSecretEnv)
+			}
+		}
+		if signingSecret == "" {
+			signingSecret = os.Getenv(signingSecretEnv)
+		}
+		if urlSecret == "" {
+			urlSecret = os.Getenv(urlSecretEnv)
+		}
+		if urlSecret != "" && !checks.IsValidURL(apiURL) {
+			return errors.New("url-secret requires api-url to be a valid URL")
+		}
+		if (tlsCert == "") != (tlsKey == "") {
+			return errors.New("tls-cert and tls-key must be given together")
+		}
+		if clientCA != "" && tlsCert == "" {
+			return errors.New("client-ca requires tls-cert and tls-key")
+		}
+		if watchCollection != "" && mongoURI == "" {
+			return errors.New("watch-collection requires mongo-uri")
+		}
 
 		// Convert imagesDir to absolute path for consistency and reliability
 		absPath, err := filepath.Abs(imagesDir)
@@ -59,11 +157,96 @@ without an internet connection.`,
 		}
 		imagesDir = absPath
 
-		return nil
+		return resolveMetaDir()
 	},
-	Run: func(cmd *cobra.Command, args []string) {
-		slog.Info("Starting images-processor", "imagesDir", imagesDir, "baseURL", baseURL, "quality", quality, "port", port)
-		routes.Run(baseURL, imagesDir, port, quality)
+	RunE: func(cmd *cobra.Command, args []string) error {
+		slog.Info("Starting images-processor", "imagesDir", imagesDir, "metaDir", metaDir, "baseURL", baseURL, "quality", quality, "layout", layout, "port", port, "tls", tlsCert != "", "clientCA", clientCA != "")
+		cfg := &routes.Config{
+			ImagesDir:      imagesDir,
+			MetaDir:        metaDir,
+			BaseURL:        baseURL,
+			Quality:        quality,
+			Layout:         storage.Layout(layout),
+			TrashRetention: trashRetention,
+			Revisions:      revisions,
+			JobWorkers:     jobWorkers,
+			IdempotencyTTL: idempotencyTTL,
+			TLSCert:        tlsCert,
+			TLSKey:         tlsKey,
+			ClientCA:       clientCA,
+		}
+
+		if indexPath != "" {
+			ix, err := openIndex()
+			if err != nil {
+				return err
+			}
+			defer ix.Close()
+			cfg.Index = ix
+			cfg.Recorders = append(cfg.Recorders, ix)
+		}
+
+		if webhookSecret != "" {
+			notifier := webhook.New(webhookURL, webhookSecret)
+			defer notifier.Close()
+			cfg.Webhooks = notifier
+			if webhookURL != "" {
+				cfg.Recorders = append(cfg.Recorders, notifier)
+				slog.Info("Sending webhooks", "url", webhookURL)
+			}
+		}
+
+		if apiKeysPath != "" || os.Getenv(apiKeysEnv) != "" {
+			keys, err := auth.Load(apiKeysPath, os.Getenv(apiKeysEnv))
+			if err != nil {
+				return err
+			}
+			cfg.Keys = keys
+			slog.Info("Requiring API keys", "keys", keys.Len())
+			go reloadKeysOnHangup(keys)
+		}
+
+		if signingSecret != "" {
+			verifier, err := auth.NewVerifier(signingSecret)
+			if err != nil {
+				return err
+			}
+			cfg.Signatures = verifier
+			slog.Info("Accepting signed requests")
+		}
+
+		if urlSecret != "" {
+			signer, err := auth.NewURLSigner(urlSecret)
+			if err != nil {
+				return err
+			}
+			cfg.URLSigner = signer
+			cfg.APIURL = apiURL
+			slog.Info("Serving signed image URLs", "apiURL", apiURL)
+		}
+
+		if mongoURI != "" {
+			store, err := mongostore.Connect(mongoURI, mongoDB)
+			if err != nil {
+				return err
+			}
+			defer store.Close()
+			cfg.Recorders = append(cfg.Recorders, store)
+			slog.Info("Recording images in MongoDB", "database", mongoDB, "collection", mongostore.Collection)
+
+			if watchCollection != "" {
+				ctx, cancel := context.WithCancel(context.Background())
+				defer cancel()
+				watcher := store.NewWatcher(mongostore.WatchOptions{
+					Collection: watchCollection,
+					TokenPath:  watchToken,
+					Grace:      watchGrace,
+				}, cfg)
+				go watcher.Run(ctx)
+			}
+		}
+
+		return routes.Run(cfg, port)
 	},
 }
 
@@ -78,12 +261,87 @@ func Execute() {
 func init() {
 	// Define command-line flags
 	rootCmd.Flags().IntVar(&port, "port", 8080, "Port to run the server on")
+	rootCmd.Flags().StringVar(&tlsCert, "tls-cert", "", "Certificate file to serve HTTPS with, reloaded when changed (plain HTTP if empty; requires tls-key)")
+	rootCmd.Flags().StringVar(&tlsKey, "tls-key", "", "Private key file for tls-cert")
+	rootCmd.Flags().StringVar(&clientCA, "client-ca", "", "CA file that client certificates must be signed by, reloaded when changed (not required if empty; requires tls-cert)")
 	rootCmd.Flags().StringVar(&imagesDir, "images-dir", "images", "Directory to store images")
+	rootCmd.Flags().StringVar(&metaDir, "meta-dir", "meta", metaDirUsage)
 	rootCmd.Flags().StringVar(&baseURL, "base-url", "", "Base URL for constructing image URLs (e.g., https://example.com)")
 	rootCmd.Flags().IntVar(&quality, "quality", 90, "WebP quality (1-100)")
+	rootCmd.Flags().StringVar(&layout, "layout", string(storage.Flat), "Storage layout: flat (charId/imageId.webp), hierarchical (guildId/userId/charId/imageId.webp), or sharded (shard/charId/imageId.webp)")
+	rootCmd.Flags().StringVar(&indexPath, "index", "", "Path to the image index database (disabled if empty)")
+	rootCmd.Flags().DurationVar(&trashRetention, "trash-retention", 0, "How long deleted images are kept in the trash (0 disables the trash and deletes permanently)")
+	rootCmd.Flags().IntVar(&revisions, "revisions", 0, "Number of previous versions kept when an image is replaced or edited")
+	rootCmd.Flags().IntVar(&jobWorkers, "job-workers", 2, "Number of asynchronous uploads processed concurrently (0 disables them)")
+	rootCmd.Flags().DurationVar(&idempotencyTTL, "idempotency-ttl", 24*time.Hour, "How long upload responses are kept for retries with the same Idempotency-Key (0 disables them)")
+	rootCmd.Flags().StringVar(&apiKeysPath, "api-keys", "", "JSON file of API keys to require, reloaded on SIGHUP (authentication is disabled if empty and $"+apiKeysEnv+" is unset)")
+	rootCmd.Flags().StringVar(&signingSecret, "signing-secret", "", "Shared secret for HMAC-signed requests, accepted in place of an API key (disabled if empty; defaults to $"+signingSecretEnv+")")
+	rootCmd.Flags().StringVar(&urlSecret, "url-secret", "", "Secret for signing expiring image URLs (disabled if empty; defaults to $"+urlSecretEnv+"; requires api-url)")
+	rootCmd.Flags().StringVar(&apiURL, "api-url", "", "This server's public URL, which signed image URLs point to")
+	rootCmd.Flags().StringVar(&webhookURL, "webhook-url", "", "URL to send signed events to when images change (disabled if empty; requires a webhook secret)")
+	rootCmd.Flags().StringVar(&webhookSecret, "webhook-secret", "", "Secret for signing webhooks and upload callbacks (callbacks are disabled if empty; defaults to $"+webhookSecretEnv+")")
+	rootCmd.Flags().StringVar(&mongoURI, "mongo-uri", "", "MongoDB connection URI for recording images (disabled if empty)")
+	rootCmd.Flags().StringVar(&mongoDB, "mongo-db", "faceclaimer", "MongoDB database to record images in")
+	rootCmd.Flags().StringVar(&watchCollection, "watch-collection", "", "Character collection to watch for deletions (disabled if empty; requires mongo-uri)")
+	rootCmd.Flags().StringVar(&watchToken, "watch-token", "faceclaimer.resume", "File to save the watcher's resume token to")
+	rootCmd.Flags().DurationVar(&watchGrace, "watch-grace", 10*time.Minute, "How old an unreferenced image must be before the watcher deletes it")
 	rootCmd.MarkFlagRequired("base-url")
 }
 
+// reloadKeysOnHangup reloads the API keys whenever the process receives
+// SIGHUP. If the key file is invalid, the current keys are kept.
+func reloadKeysOnHangup(keys *auth.Keyring) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		if err := keys.Reload(); err != nil {
+			slog.Error("Failed to reload API keys; keeping the current keys", "error", err)
+			continue
+		}
+		slog.Info("Reloaded API keys", "keys", keys.Len())
+	}
+}
+
+// metaDirUsage is the help text for --meta-dir, shared by the commands that
+// read or write image metadata.
+const metaDirUsage = "Directory to store image metadata in, outside images-dir (no metadata is kept if empty)"
+
+// resolveMetaDir converts metaDir to an absolute path, checking that it
+// doesn't overlap imagesDir, which is served publicly. imagesDir must already
+// be absolute.
+func resolveMetaDir() error {
+	if metaDir == "" {
+		return nil
+	}
+	absPath, err := filepath.Abs(metaDir)
+	if err != nil {
+		return fmt.Errorf("failed to resolve absolute path for meta-dir: %w", err)
+	}
+	if within(imagesDir, absPath) || within(absPath, imagesDir) {
+		return errors.New("meta-dir must be outside images-dir")
+	}
+	metaDir = absPath
+	return nil
+}
+
+// within reports whether path is dir or inside it. Relative paths are
+// resolved against the working directory.
+func within(dir, path string) bool {
+	absDir, dirErr := filepath.Abs(dir)
+	absPath, pathErr := filepath.Abs(path)
+	if dirErr != nil || pathErr != nil {
+		return false
+	}
+	rel, err := filepath.Rel(absDir, absPath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// storageDirs returns the directories images and their metadata are stored
+// in.
+func storageDirs() storage.Dirs {
+	return storage.Dirs{Images: imagesDir, Meta: metaDir}
+}
+
 // initLogger configures slog.
 func initLogger() {
 	// Detect if stderr is a terminal
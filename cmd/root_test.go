@@ -294,6 +294,46 @@ func TestPreRunE_AbsolutePathResolution(t *testing.T) {
 	}
 }
 
+func TestPreRunE_MetaDirValidation(t *testing.T) {
+	tmpDir := t.TempDir()
+	defer func() { metaDir = "meta" }()
+
+	tests := []struct {
+		name      string
+		metaDir   string
+		wantError bool
+	}{
+		{name: "separate directory", metaDir: filepath.Join(t.TempDir(), "meta")},
+		{name: "disabled", metaDir: ""},
+		{name: "inside images-dir", metaDir: filepath.Join(tmpDir, ".meta"), wantError: true},
+		{name: "same as images-dir", metaDir: tmpDir, wantError: true},
+		{name: "containing images-dir", metaDir: filepath.Dir(tmpDir), wantError: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseURL = "https://example.com"
+			imagesDir = tmpDir
+			metaDir = tt.metaDir
+			quality = 90
+
+			err := rootCmd.PreRunE(rootCmd, []string{})
+			if tt.wantError {
+				if err == nil || !strings.Contains(err.Error(), "meta-dir must be outside images-dir") {
+					t.Errorf("Expected meta-dir error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			}
+			if metaDir != tt.metaDir {
+				t.Errorf("Expected metaDir %q, got %q", tt.metaDir, metaDir)
+			}
+		})
+	}
+}
+
 func TestPreRunE_AllValidationsCombined(t *testing.T) {
 	// Create temporary directory
 	tmpDir, err := os.MkdirTemp("", "test-images-*")
@@ -366,3 +406,149 @@ func TestPreRunE_AllValidationsCombined(t *testing.T) {
 	}
 }
 
+func TestPreRunE_LayoutValidation(t *testing.T) {
+	tests := []struct {
+		name      string
+		layout    string
+		wantError bool
+	}{
+		{"flat", "flat", false},
+		{"hierarchical", "hierarchical", false},
+		{"unknown layout", "nested", true},
+		{"empty layout", "", true},
+	}
+
+	tmpDir, err := os.MkdirTemp("", "test-images-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	defer func() { layout = "flat" }()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Reset flags
+			baseURL = "https://example.com"
+			imagesDir = tmpDir
+			quality = 90
+			layout = tt.layout
+
+			err := rootCmd.PreRunE(rootCmd, []string{})
+
+			if tt.wantError {
+				if err == nil {
+					t.Error("Expected error, got nil")
+				} else if !strings.Contains(err.Error(), "unknown layout") {
+					t.Errorf("Expected 'unknown layout' error, got %q", err.Error())
+				}
+			} else if err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			}
+		})
+	}
+}
+
+func TestPreRunE_WatchRequiresMongo(t *testing.T) {
+	tmpDir := t.TempDir()
+	defer func() { watchCollection, mongoURI = "", "" }()
+
+	baseURL = "https://example.com"
+	imagesDir = tmpDir
+	quality = 90
+	layout = "flat"
+	watchCollection = "characters"
+
+	mongoURI = ""
+	if err := rootCmd.PreRunE(rootCmd, []string{}); err == nil || !strings.Contains(err.Error(), "requires mongo-uri") {
+		t.Errorf("Expected 'requires mongo-uri' error, got %v", err)
+	}
+
+	mongoURI = "mongodb://localhost:27017"
+	if err := rootCmd.PreRunE(rootCmd, []string{}); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+}
+
+func TestPreRunE_WebhookRequiresSecret(t *testing.T) {
+	tmpDir := t.TempDir()
+	defer func() { webhookURL, webhookSecret = "", "" }()
+	t.Setenv(webhookSecretEnv, "")
+
+	baseURL = "https://example.com"
+	imagesDir = tmpDir
+	quality = 90
+	layout = "flat"
+
+	webhookURL = "https://bot.example.com/hooks"
+	if err := rootCmd.PreRunE(rootCmd, []string{}); err == nil || !strings.Contains(err.Error(), "requires webhook-secret") {
+		t.Errorf("Expected 'requires webhook-secret' error, got %v", err)
+	}
+
+	t.Setenv(webhookSecretEnv, "secret")
+	if err := rootCmd.PreRunE(rootCmd, []string{}); err != nil {
+		t.Errorf("Expected secret from environment, got: %v", err)
+	}
+	if webhookSecret != "secret" {
+		t.Errorf("Expected webhook secret from environment, got %q", webhookSecret)
+	}
+
+	webhookURL = "not a url"
+	if err := rootCmd.PreRunE(rootCmd, []string{}); err == nil {
+		t.Error("Expected invalid webhook-url error")
+	}
+}
+
+func TestPreRunE_URLSecretRequiresAPIURL(t *testing.T) {
+	tmpDir := t.TempDir()
+	defer func() { urlSecret, apiURL = "", "" }()
+	t.Setenv(urlSecretEnv, "url-secret-00000000")
+
+	baseURL = "https://example.com"
+	imagesDir = tmpDir
+	quality = 90
+	layout = "flat"
+
+	if err := rootCmd.PreRunE(rootCmd, []string{}); err == nil || !strings.Contains(err.Error(), "requires api-url") {
+		t.Errorf("Expected 'requires api-url' error, got %v", err)
+	}
+
+	apiURL = "https://api.example.com"
+	if err := rootCmd.PreRunE(rootCmd, []string{}); err != nil {
+		t.Errorf("Expected no error, got: %v", err)
+	}
+	if urlSecret != "url-secret-00000000" {
+		t.Errorf("Expected URL secret from environment, got %q", urlSecret)
+	}
+}
+
+func TestPreRunE_TLS(t *testing.T) {
+	tmpDir := t.TempDir()
+	defer func() { tlsCert, tlsKey, clientCA = "", "", "" }()
+
+	baseURL = "https://example.com"
+	imagesDir = tmpDir
+	quality = 90
+	layout = "flat"
+
+	tests := []struct {
+		name                  string
+		cert, key, ca, errMsg string
+	}{
+		{"cert without key", "cert.pem", "", "", "must be given together"},
+		{"key without cert", "", "key.pem", "", "must be given together"},
+		{"client CA without cert", "", "", "ca.pem", "requires tls-cert"},
+		{"HTTPS", "cert.pem", "key.pem", "", ""},
+		{"mutual TLS", "cert.pem", "key.pem", "ca.pem", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tlsCert, tlsKey, clientCA = tt.cert, tt.key, tt.ca
+			err := rootCmd.PreRunE(rootCmd, []string{})
+			if tt.errMsg == "" && err != nil {
+				t.Errorf("Expected no error, got: %v", err)
+			} else if tt.errMsg != "" && (err == nil || !strings.Contains(err.Error(), tt.errMsg)) {
+				t.Errorf("Expected error containing %q, got %v", tt.errMsg, err)
+			}
+		})
+	}
+}
@@ -15,42 +15,80 @@ import (
 	"faceclaimer/checks"
 )
 
+// Info describes an image saved by SaveWebP.
+type Info struct {
+	// SourceFormat is the format of the original image, e.g. "png".
+	SourceFormat string
+	SourceWidth  int
+	SourceHeight int
+	Width        int
+	Height       int
+	// Size is the size of the saved WebP file in bytes.
+	Size     int64
+	Quality  int
+	Lossless bool
+	// Hash is the perceptual hash of the image. See PerceptualHash.
+	Hash string
+}
+
 // imageFromBytes converts the bytes data to an Image.
-func imageFromBytes(data []byte) (image.Image, error) {
+func imageFromBytes(data []byte) (image.Image, string, error) {
 	reader := bytes.NewReader(data)
 	image, format, err := image.Decode(reader)
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode image: %w", err)
+		return nil, "", fmt.Errorf("failed to decode image: %w", err)
 	}
 	slog.Info("Read image data", "format", format)
-	return image, nil
+	return image, format, nil
+}
+
+// ReadConfig returns the dimensions and format of the image at path without
+// decoding the entire image.
+func ReadConfig(path string) (image.Config, string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return image.Config{}, "", err
+	}
+	defer f.Close()
+
+	config, format, err := image.DecodeConfig(f)
+	if err != nil {
+		return image.Config{}, "", fmt.Errorf("failed to read image config: %w", err)
+	}
+	return config, format, nil
 }
 
 // SaveWebP converts image data to WebP format and saves it to dest with the specified quality (recommended: 90).
-func SaveWebP(data []byte, dest string, quality int) (err error) {
+// If dest already exists, the error satisfies errors.Is(err, os.ErrExist).
+func SaveWebP(data []byte, dest string, quality int) (info Info, err error) {
 	if checks.PathExists(dest) {
-		return fmt.Errorf("%s already exists", dest)
+		return Info{}, fmt.Errorf("%s: %w", dest, os.ErrExist)
 	}
 
 	// Create the directory structure if it doesn't exist
 	dir := filepath.Dir(dest)
 	if err := os.MkdirAll(dir, 0755); err != nil {
-		return fmt.Errorf("unable to create directory %s: %w", dir, err)
+		return Info{}, fmt.Errorf("unable to create directory %s: %w", dir, err)
 	}
 
-	outputFile, err := os.Create(dest)
+	// Create exclusively, in case another upload claimed dest since the check
+	outputFile, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
 	if err != nil {
-		return fmt.Errorf("unable to create %s: %w", dest, err)
+		return Info{}, fmt.Errorf("unable to create %s: %w", dest, err)
 	}
 	defer func() {
 		if closeErr := outputFile.Close(); closeErr != nil && err == nil {
 			err = fmt.Errorf("failed to close %s: %w", dest, closeErr)
 		}
+		// Don't leave a partial image behind to block the name
+		if err != nil {
+			os.Remove(dest)
+		}
 	}()
 
-	image, err := imageFromBytes(data)
+	image, format, err := imageFromBytes(data)
 	if err != nil {
-		return err
+		return Info{}, err
 	}
 
 	slog.Info("Converting image to WebP")
@@ -63,9 +101,59 @@ func SaveWebP(data []byte, dest string, quality int) (err error) {
 
 	err = webp.Encode(outputFile, image, options)
 	if err != nil {
-		return err
+		return Info{}, err
+	}
+
+	stat, err := outputFile.Stat()
+	if err != nil {
+		return Info{}, err
 	}
 
 	slog.Info("Saved WebP image", "dest", dest)
-	return nil
+	return newInfo(image, format, stat.Size(), options), nil
+}
+
+// ReplaceWebP converts image data to WebP format and saves it to dest,
+// atomically replacing any existing file, so readers see either the old image
+// or the new one. If beforeReplace isn't nil, it's called once the new image
+// has been encoded, just before it replaces dest; if either fails, dest is
+// left unchanged.
+func ReplaceWebP(data []byte, dest string, quality int, beforeReplace func() error) (Info, error) {
+	image, format, err := imageFromBytes(data)
+	if err != nil {
+		return Info{}, err
+	}
+
+	slog.Info("Converting image to WebP")
+	options := webp.Options{
+		Quality:  quality,
+		Lossless: false,
+		Method:   0,
+		Exact:    false,
+	}
+	size, err := writeAtomic(dest, func(f *os.File) error {
+		return webp.Encode(f, image, options)
+	}, beforeReplace)
+	if err != nil {
+		return Info{}, err
+	}
+
+	slog.Info("Replaced WebP image", "dest", dest)
+	return newInfo(image, format, size, options), nil
+}
+
+// newInfo describes an image encoded from a source of the given format.
+func newInfo(img image.Image, format string, size int64, options webp.Options) Info {
+	bounds := img.Bounds()
+	return Info{
+		SourceFormat: format,
+		SourceWidth:  bounds.Dx(),
+		SourceHeight: bounds.Dy(),
+		Width:        bounds.Dx(),
+		Height:       bounds.Dy(),
+		Size:         size,
+		Quality:      options.Quality,
+		Lossless:     options.Lossless,
+		Hash:         PerceptualHash(img),
+	}
 }
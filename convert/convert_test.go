@@ -0,0 +1,44 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSaveWebP(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 4, 2))); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+
+	t.Run("saves image", func(t *testing.T) {
+		dest := filepath.Join(dir, "char", "image.webp")
+		info, err := SaveWebP(buf.Bytes(), dest, 90)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Width != 4 || info.Height != 2 || info.SourceFormat != "png" {
+			t.Errorf("Unexpected info: %+v", info)
+		}
+
+		if _, err := SaveWebP(buf.Bytes(), dest, 90); !errors.Is(err, os.ErrExist) {
+			t.Errorf("Expected os.ErrExist saving over an image, got %v", err)
+		}
+	})
+
+	t.Run("invalid data leaves nothing behind", func(t *testing.T) {
+		dest := filepath.Join(dir, "char", "invalid.webp")
+		if _, err := SaveWebP([]byte("not an image"), dest, 90); err == nil {
+			t.Fatal("Expected an error for invalid data")
+		}
+		if _, err := os.Stat(dest); !os.IsNotExist(err) {
+			t.Errorf("Expected no file at %s, got %v", dest, err)
+		}
+	})
+}
@@ -0,0 +1,167 @@
+package convert
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+
+	"github.com/gen2brain/webp"
+)
+
+// Flip mirrors an image along an axis.
+type Flip string
+
+const (
+	FlipNone       Flip = ""
+	FlipHorizontal Flip = "horizontal"
+	FlipVertical   Flip = "vertical"
+)
+
+// ParseFlip returns the Flip named by s.
+func ParseFlip(s string) (Flip, error) {
+	switch f := Flip(s); f {
+	case FlipNone, FlipHorizontal, FlipVertical:
+		return f, nil
+	}
+	return "", fmt.Errorf("unknown flip %q (expected horizontal or vertical)", s)
+}
+
+// Transform rotates img clockwise by degrees, which must be a multiple of 90,
+// then flips it.
+func Transform(img image.Image, degrees int, flip Flip) image.Image {
+	b := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	w, h := b.Dx(), b.Dy()
+	turns := ((degrees/90)%4 + 4) % 4
+	dw, dh := w, h
+	if turns%2 == 1 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch turns {
+			case 0:
+				dx, dy = x, y
+			case 1:
+				dx, dy = h-1-y, x
+			case 2:
+				dx, dy = w-1-x, h-1-y
+			case 3:
+				dx, dy = y, w-1-x
+			}
+			switch flip {
+			case FlipHorizontal:
+				dx = dw - 1 - dx
+			case FlipVertical:
+				dy = dh - 1 - dy
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// EditWebP applies edit to the WebP image at path and re-encodes it in place
+// with the given quality, or losslessly if the image was stored losslessly.
+// The file is replaced atomically, so readers see either the old image or the
+// new one. If beforeReplace isn't nil, it's called once the edited image has
+// been encoded, just before it replaces the file; if either fails, the file is
+// left unchanged. The returned Info has no source fields.
+func EditWebP(path string, quality int, edit func(image.Image) image.Image, beforeReplace func() error) (Info, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Info{}, err
+	}
+	img, err := webp.Decode(bytes.NewReader(data))
+	if err != nil {
+		return Info{}, fmt.Errorf("failed to decode %s: %w", path, err)
+	}
+	img = edit(img)
+
+	options := webp.Options{
+		Quality:  quality,
+		Lossless: isLossless(data),
+		Method:   0,
+		Exact:    false,
+	}
+	size, err := writeAtomic(path, func(f *os.File) error {
+		return webp.Encode(f, img, options)
+	}, beforeReplace)
+	if err != nil {
+		return Info{}, err
+	}
+
+	bounds := img.Bounds()
+	return Info{
+		Width:    bounds.Dx(),
+		Height:   bounds.Dy(),
+		Size:     size,
+		Quality:  quality,
+		Lossless: options.Lossless,
+		Hash:     PerceptualHash(img),
+	}, nil
+}
+
+// writeAtomic writes dest through a temporary file in the same directory,
+// renaming it into place once it's complete, and returns the size written.
+// If beforeRename isn't nil, it's called just before the rename, which only
+// happens if it succeeds.
+func writeAtomic(dest string, write func(f *os.File) error, beforeRename func() error) (int64, error) {
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".partial")
+	f, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp)
+
+	err = write(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	var size int64
+	if err == nil {
+		var stat os.FileInfo
+		if stat, err = f.Stat(); err == nil {
+			size = stat.Size()
+		}
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && beforeRename != nil {
+		err = beforeRename()
+	}
+	if err != nil {
+		return 0, err
+	}
+	return size, os.Rename(tmp, dest)
+}
+
+// isLossless returns true if the WebP data holds a lossless (VP8L) bitstream.
+func isLossless(data []byte) bool {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return false
+	}
+	for pos := 12; pos+8 <= len(data); {
+		fourCC := string(data[pos : pos+4])
+		size := int(binary.LittleEndian.Uint32(data[pos+4 : pos+8]))
+		switch fourCC {
+		case "VP8L":
+			return true
+		case "VP8 ":
+			return false
+		}
+		// Chunks are padded to an even size
+		pos += 8 + size + size%2
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+package convert
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gen2brain/webp"
+)
+
+var (
+	red  = color.NRGBA{255, 0, 0, 255}
+	blue = color.NRGBA{0, 0, 255, 255}
+)
+
+func TestTransform(t *testing.T) {
+	// A 2x1 image: red on the left, blue on the right
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, red)
+	src.Set(1, 0, blue)
+
+	tests := []struct {
+		name    string
+		degrees int
+		flip    Flip
+		width   int
+		height  int
+		first   color.NRGBA // pixel at (0, 0)
+	}{
+		{"none", 0, FlipNone, 2, 1, red},
+		{"90", 90, FlipNone, 1, 2, red},
+		{"180", 180, FlipNone, 2, 1, blue},
+		{"270", 270, FlipNone, 1, 2, blue},
+		{"horizontal", 0, FlipHorizontal, 2, 1, blue},
+		{"vertical", 0, FlipVertical, 2, 1, red},
+		{"90 then vertical", 90, FlipVertical, 1, 2, blue},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Transform(src, tt.degrees, tt.flip)
+			if b := got.Bounds(); b.Dx() != tt.width || b.Dy() != tt.height {
+				t.Fatalf("Got %dx%d, expected %dx%d", b.Dx(), b.Dy(), tt.width, tt.height)
+			}
+			if c := color.NRGBAModel.Convert(got.At(0, 0)); c != tt.first {
+				t.Errorf("Pixel (0, 0) = %v, expected %v", c, tt.first)
+			}
+		})
+	}
+}
+
+func TestParseFlip(t *testing.T) {
+	for _, s := range []string{"", "horizontal", "vertical"} {
+		if _, err := ParseFlip(s); err != nil {
+			t.Errorf("ParseFlip(%q) failed: %v", s, err)
+		}
+	}
+	if _, err := ParseFlip("diagonal"); err == nil {
+		t.Error("Expected error for unknown flip")
+	}
+}
+
+func TestEditWebP(t *testing.T) {
+	for _, lossless := range []bool{false, true} {
+		name := "lossy"
+		if lossless {
+			name = "lossless"
+		}
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "image.webp")
+			var buf bytes.Buffer
+			if err := webp.Encode(&buf, gradient(32, 16, false), webp.Options{Quality: 90, Lossless: lossless}); err != nil {
+				t.Fatal(err)
+			}
+			if got := isLossless(buf.Bytes()); got != lossless {
+				t.Fatalf("isLossless() = %v, expected %v", got, lossless)
+			}
+			if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			info, err := EditWebP(path, 80, func(img image.Image) image.Image {
+				return Transform(img, 90, FlipNone)
+			}, nil)
+			if err != nil {
+				t.Fatalf("EditWebP failed: %v", err)
+			}
+			if info.Width != 16 || info.Height != 32 || info.Lossless != lossless || info.Quality != 80 {
+				t.Errorf("Unexpected info: %+v", info)
+			}
+
+			config, _, err := ReadConfig(path)
+			if err != nil {
+				t.Fatalf("ReadConfig failed: %v", err)
+			}
+			if config.Width != 16 || config.Height != 32 {
+				t.Errorf("Saved image is %dx%d, expected 16x32", config.Width, config.Height)
+			}
+			if stat, _ := os.Stat(path); stat.Size() != info.Size {
+				t.Errorf("Info size %d doesn't match file size %d", info.Size, stat.Size())
+			}
+			if entries, _ := os.ReadDir(filepath.Dir(path)); len(entries) != 1 {
+				t.Errorf("Expected temporary file to be removed, found %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestEditWebPBeforeReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.webp")
+	var buf bytes.Buffer
+	if err := webp.Encode(&buf, gradient(32, 16, false), webp.Options{Quality: 90}); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rotate := func(img image.Image) image.Image { return Transform(img, 90, FlipNone) }
+
+	// A failing hook leaves the image alone
+	if _, err := EditWebP(path, 80, rotate, func() error { return errors.New("no") }); err == nil {
+		t.Error("Expected the hook's error")
+	}
+	if data, _ := os.ReadFile(path); !bytes.Equal(data, buf.Bytes()) {
+		t.Error("Expected image to be unchanged")
+	}
+
+	// The hook isn't called if the image can't be decoded
+	if err := os.WriteFile(path, []byte("not a webp"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	called := false
+	if _, err := EditWebP(path, 80, rotate, func() error { called = true; return nil }); err == nil {
+		t.Error("Expected decode error")
+	}
+	if called {
+		t.Error("Expected hook not to be called")
+	}
+}
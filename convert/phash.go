@@ -0,0 +1,56 @@
+package convert
+
+import (
+	"fmt"
+	"image"
+)
+
+// PerceptualHash returns a 64-bit difference hash (dHash) of img, formatted
+// as 16 hex digits. Visually similar images produce hashes with a small
+// Hamming distance, regardless of size or encoding.
+func PerceptualHash(img image.Image) string {
+	// Shrink to 9x8 grayscale; each bit records whether a pixel is brighter
+	// than its right-hand neighbor.
+	const width, height = 9, 8
+	var gray [height][width]float64
+
+	bounds := img.Bounds()
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := max(bounds.Min.Y+(y+1)*bounds.Dy()/height, y0+1)
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := max(bounds.Min.X+(x+1)*bounds.Dx()/width, x0+1)
+			gray[y][x] = averageLuma(img, x0, y0, x1, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < height; y++ {
+		for x := 0; x < width-1; x++ {
+			hash <<= 1
+			if gray[y][x] > gray[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%016x", hash)
+}
+
+// averageLuma returns the mean luminance of the rectangle [x0,x1)x[y0,y1).
+// Large rectangles are sampled rather than read in full.
+func averageLuma(img image.Image, x0, y0, x1, y1 int) float64 {
+	stepX := max((x1-x0)/16, 1)
+	stepY := max((y1-y0)/16, 1)
+
+	var sum float64
+	var n int
+	for y := y0; y < y1; y += stepY {
+		for x := x0; x < x1; x += stepX {
+			r, g, b, _ := img.At(x, y).RGBA()
+			sum += 0.299*float64(r) + 0.587*float64(g) + 0.114*float64(b)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
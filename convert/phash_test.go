@@ -0,0 +1,71 @@
+package convert
+
+import (
+	"image"
+	"image/color"
+	"math/bits"
+	"strconv"
+	"testing"
+)
+
+// gradient returns an image whose brightness falls from left to right, or
+// rises if reverse is set.
+func gradient(width, height int, reverse bool) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		v := uint8(255 - x*255/width)
+		if reverse {
+			v = 255 - v
+		}
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{v, v, v, 255})
+		}
+	}
+	return img
+}
+
+func distance(t *testing.T, a, b string) int {
+	t.Helper()
+	x, err := strconv.ParseUint(a, 16, 64)
+	if err != nil {
+		t.Fatalf("Invalid hash %q: %v", a, err)
+	}
+	y, err := strconv.ParseUint(b, 16, 64)
+	if err != nil {
+		t.Fatalf("Invalid hash %q: %v", b, err)
+	}
+	return bits.OnesCount64(x ^ y)
+}
+
+func TestPerceptualHash(t *testing.T) {
+	t.Run("format", func(t *testing.T) {
+		hash := PerceptualHash(gradient(64, 64, false))
+		if len(hash) != 16 {
+			t.Errorf("Expected 16 hex digits, got %q", hash)
+		}
+	})
+
+	t.Run("scale invariant", func(t *testing.T) {
+		small := PerceptualHash(gradient(64, 64, false))
+		large := PerceptualHash(gradient(640, 480, false))
+		if d := distance(t, small, large); d > 4 {
+			t.Errorf("Expected similar hashes, got distance %d (%s, %s)", d, small, large)
+		}
+	})
+
+	t.Run("different images", func(t *testing.T) {
+		a := PerceptualHash(gradient(64, 64, false))
+		b := PerceptualHash(gradient(64, 64, true))
+		if d := distance(t, a, b); d < 32 {
+			t.Errorf("Expected dissimilar hashes, got distance %d (%s, %s)", d, a, b)
+		}
+	})
+
+	t.Run("tiny image", func(t *testing.T) {
+		// Smaller than the hash grid; must not panic or divide by zero
+		hash := PerceptualHash(gradient(2, 2, false))
+		if len(hash) != 16 {
+			t.Errorf("Expected 16 hex digits, got %q", hash)
+		}
+	})
+}
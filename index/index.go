@@ -0,0 +1,208 @@
+// index maintains an embedded database of stored images, so that questions
+// about what is stored can be answered without scanning the images directory.
+package index
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"faceclaimer/storage"
+)
+
+// imagesBucket holds each image's metadata, keyed by charId/imageId.
+var imagesBucket = []byte("images")
+
+// Index records the metadata of every stored image.
+type Index struct {
+	db *bolt.DB
+}
+
+// Stats summarizes a set of stored images.
+type Stats struct {
+	Images int   `json:"images"`
+	Bytes  int64 `json:"bytes"`
+}
+
+// Open opens the index at path, creating it if needed. Only one process may
+// have the index open at a time.
+func Open(path string) (*Index, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("index %s is in use by another process", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(imagesBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &Index{db: db}, nil
+}
+
+// Close closes the index.
+func (ix *Index) Close() error {
+	return ix.db.Close()
+}
+
+// Empty returns true if the index holds no images.
+func (ix *Index) Empty() (bool, error) {
+	empty := true
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		k, _ := tx.Bucket(imagesBucket).Cursor().First()
+		empty = k == nil
+		return nil
+	})
+	return empty, err
+}
+
+// RecordSaved records a newly saved image.
+func (ix *Index) RecordSaved(meta storage.Meta, url string) error {
+	return ix.Put(meta)
+}
+
+// RecordDeleted removes the records of deleted images.
+func (ix *Index) RecordDeleted(f storage.Filter) error {
+	_, err := ix.DeleteWhere(f)
+	return err
+}
+
+// Put records an image, replacing any existing record.
+func (ix *Index) Put(meta storage.Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).Put(key(meta.CharID, meta.ID), data)
+	})
+}
+
+// Delete removes an image's record.
+func (ix *Index) Delete(charID, imageID string) error {
+	return ix.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(imagesBucket).Delete(key(charID, imageID))
+	})
+}
+
+// DeleteWhere removes every record matching the filter, returning the number
+// removed.
+func (ix *Index) DeleteWhere(f storage.Filter) (int, error) {
+	var deleted int
+	err := ix.db.Update(func(tx *bolt.Tx) error {
+		var keys [][]byte
+		err := scan(tx, f, func(k []byte, _ storage.Meta) {
+			// Keys are only valid until the bucket is modified
+			keys = append(keys, bytes.Clone(k))
+		})
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket(imagesBucket)
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		deleted = len(keys)
+		return nil
+	})
+	return deleted, err
+}
+
+// Find returns every record matching the filter, ordered by character and
+// image ID.
+func (ix *Index) Find(f storage.Filter) ([]storage.Meta, error) {
+	var metas []storage.Meta
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		return scan(tx, f, func(_ []byte, meta storage.Meta) {
+			metas = append(metas, meta)
+		})
+	})
+	return metas, err
+}
+
+// Stats returns the number and total size of the images matching the filter.
+func (ix *Index) Stats(f storage.Filter) (Stats, error) {
+	var stats Stats
+	err := ix.db.View(func(tx *bolt.Tx) error {
+		return scan(tx, f, func(_ []byte, meta storage.Meta) {
+			stats.Images++
+			stats.Bytes += meta.Size
+		})
+	})
+	return stats, err
+}
+
+// Rebuild replaces the index's contents with the images currently stored in
+// d.Images, returning the number indexed. Images whose metadata can't be read
+// are logged and skipped.
+func (ix *Index) Rebuild(d storage.Dirs, layout storage.Layout) (int, error) {
+	images, err := layout.Images(d.Images)
+	if err != nil {
+		return 0, err
+	}
+
+	var indexed int
+	err = ix.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.DeleteBucket(imagesBucket); err != nil {
+			return err
+		}
+		b, err := tx.CreateBucket(imagesBucket)
+		if err != nil {
+			return err
+		}
+		for _, img := range images {
+			meta, err := d.LoadMeta(img)
+			if err != nil {
+				slog.Warn("Failed to index image", "path", img.Path, "error", err)
+				continue
+			}
+			data, err := json.Marshal(meta)
+			if err != nil {
+				return err
+			}
+			if err := b.Put(key(meta.CharID, meta.ID), data); err != nil {
+				return err
+			}
+			indexed++
+		}
+		return nil
+	})
+	return indexed, err
+}
+
+// scan calls fn for every record matching the filter. A character filter
+// only visits that character's records.
+func scan(tx *bolt.Tx, f storage.Filter, fn func(k []byte, meta storage.Meta)) error {
+	c := tx.Bucket(imagesBucket).Cursor()
+	var prefix []byte
+	if f.CharID != "" {
+		prefix = []byte(f.CharID + "/" + f.ImageID)
+	}
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var meta storage.Meta
+		if err := json.Unmarshal(v, &meta); err != nil {
+			return fmt.Errorf("corrupt index entry %s: %w", k, err)
+		}
+		if f.Matches(meta) {
+			fn(k, meta)
+		}
+	}
+	return nil
+}
+
+// key returns the database key for an image.
+func key(charID, imageID string) []byte {
+	return []byte(charID + "/" + imageID)
+}
@@ -0,0 +1,145 @@
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"faceclaimer/storage"
+)
+
+// openTestIndex opens a fresh index in a temporary directory.
+func openTestIndex(t *testing.T) *Index {
+	t.Helper()
+	ix, err := Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	t.Cleanup(func() { ix.Close() })
+	return ix
+}
+
+func TestIndex(t *testing.T) {
+	ix := openTestIndex(t)
+
+	empty, err := ix.Empty()
+	if err != nil || !empty {
+		t.Fatalf("Expected new index to be empty, got %v (%v)", empty, err)
+	}
+
+	metas := []storage.Meta{
+		{ID: "68f5ce16713c155df96639bc", CharID: "507f1f77bcf86cd799439011", Guild: 1, User: 10, Size: 100},
+		{ID: "68f5ce16713c155df96639bd", CharID: "507f1f77bcf86cd799439011", Guild: 1, User: 10, Size: 200},
+		{ID: "68f5ce16713c155df96639be", CharID: "507f1f77bcf86cd799439012", Guild: 1, User: 20, Size: 400},
+		{ID: "68f5ce16713c155df96639bf", CharID: "507f1f77bcf86cd799439013", Guild: 2, User: 10, Size: 800},
+	}
+	for _, meta := range metas {
+		if err := ix.Put(meta); err != nil {
+			t.Fatalf("Put failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		name     string
+		filter   storage.Filter
+		expected Stats
+	}{
+		{"everything", storage.Filter{}, Stats{Images: 4, Bytes: 1500}},
+		{"character", storage.Filter{CharID: "507f1f77bcf86cd799439011"}, Stats{Images: 2, Bytes: 300}},
+		{"guild", storage.Filter{Guild: 1}, Stats{Images: 3, Bytes: 700}},
+		{"user", storage.Filter{User: 10}, Stats{Images: 3, Bytes: 1100}},
+		{"guild and user", storage.Filter{Guild: 2, User: 10}, Stats{Images: 1, Bytes: 800}},
+		{"no match", storage.Filter{Guild: 3}, Stats{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stats, err := ix.Stats(tt.filter)
+			if err != nil {
+				t.Fatalf("Stats failed: %v", err)
+			}
+			if stats != tt.expected {
+				t.Errorf("Stats(%+v) = %+v, expected %+v", tt.filter, stats, tt.expected)
+			}
+		})
+	}
+
+	found, err := ix.Find(storage.Filter{CharID: "507f1f77bcf86cd799439011"})
+	if err != nil {
+		t.Fatalf("Find failed: %v", err)
+	}
+	if len(found) != 2 || found[0].ID != metas[0].ID {
+		t.Errorf("Unexpected Find result: %+v", found)
+	}
+
+	if err := ix.Delete("507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	deleted, err := ix.DeleteWhere(storage.Filter{User: 10})
+	if err != nil {
+		t.Fatalf("DeleteWhere failed: %v", err)
+	}
+	if deleted != 2 {
+		t.Errorf("Expected 2 records deleted, got %d", deleted)
+	}
+
+	stats, _ := ix.Stats(storage.Filter{})
+	if stats != (Stats{Images: 1, Bytes: 400}) {
+		t.Errorf("Unexpected stats after deletion: %+v", stats)
+	}
+}
+
+func TestOpenInUse(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "index.db")
+	ix, err := Open(path)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer ix.Close()
+
+	_, err = Open(path)
+	if err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("Expected 'in use' error, got %v", err)
+	}
+}
+
+func TestRebuild(t *testing.T) {
+	d := storage.Dirs{Images: t.TempDir(), Meta: t.TempDir()}
+	imagesDir := d.Images
+	imagePath := filepath.Join(imagesDir, "123", "456", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	if err := os.MkdirAll(filepath.Dir(imagePath), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	if err := os.WriteFile(imagePath, []byte("not decoded"), 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	meta := storage.Meta{ID: "68f5ce16713c155df96639bc", CharID: "507f1f77bcf86cd799439011", Guild: 123, User: 456, Size: 11}
+	if err := d.WriteMeta(imagePath, meta); err != nil {
+		t.Fatalf("WriteMeta failed: %v", err)
+	}
+
+	// An unreadable image without metadata is skipped
+	badPath := filepath.Join(imagesDir, "123", "456", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bd.webp")
+	if err := os.WriteFile(badPath, []byte("garbage"), 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+
+	ix := openTestIndex(t)
+	stale := storage.Meta{ID: "68f5ce16713c155df96639ff", CharID: "507f1f77bcf86cd7994390ff"}
+	if err := ix.Put(stale); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+
+	count, err := ix.Rebuild(d, storage.Hierarchical)
+	if err != nil {
+		t.Fatalf("Rebuild failed: %v", err)
+	}
+	if count != 1 {
+		t.Errorf("Expected 1 image indexed, got %d", count)
+	}
+
+	found, _ := ix.Find(storage.Filter{})
+	if len(found) != 1 || found[0] != meta {
+		t.Errorf("Expected only the stored image after rebuild, got %+v", found)
+	}
+}
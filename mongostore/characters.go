@@ -0,0 +1,75 @@
+package mongostore
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// imageRef matches an image filename within a URL or path.
+var imageRef = regexp.MustCompile(`([0-9a-f]{24})\.webp`)
+
+// Characters maps each character ID in the bot's character collection to the
+// IDs of the images its document references.
+type Characters map[string]map[string]bool
+
+// Characters reads every document in the named collection of the store's
+// database. A document references an image if any of its strings contains the
+// image's filename, as image URLs do, or any of its ObjectID values (other than
+// its own ID) is the image's ID. Documents whose ID isn't an ObjectID are
+// ignored.
+func (s *Store) Characters(collection string) (Characters, error) {
+	ctx := context.Background()
+	cursor, err := s.images.Database().Collection(collection).Find(ctx, bson.M{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", collection, err)
+	}
+	defer cursor.Close(ctx)
+
+	chars := make(Characters)
+	for cursor.Next(ctx) {
+		var doc bson.M
+		if err := cursor.Decode(&doc); err != nil {
+			return nil, fmt.Errorf("failed to decode %s document: %w", collection, err)
+		}
+		id, ok := doc["_id"].(primitive.ObjectID)
+		if !ok {
+			continue
+		}
+		delete(doc, "_id")
+		refs := make(map[string]bool)
+		collectRefs(doc, refs)
+		chars[id.Hex()] = refs
+	}
+	if err := cursor.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", collection, err)
+	}
+	return chars, nil
+}
+
+// collectRefs adds every image ID referenced within v to refs.
+func collectRefs(v any, refs map[string]bool) {
+	switch v := v.(type) {
+	case string:
+		for _, m := range imageRef.FindAllStringSubmatch(v, -1) {
+			refs[m[1]] = true
+		}
+	case primitive.ObjectID:
+		refs[v.Hex()] = true
+	case bson.M:
+		for _, item := range v {
+			collectRefs(item, refs)
+		}
+	case bson.D:
+		for _, item := range v {
+			collectRefs(item.Value, refs)
+		}
+	case bson.A:
+		for _, item := range v {
+			collectRefs(item, refs)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+// mongostore records stored images in a MongoDB collection, so that image
+// ownership can be queried alongside the bot's own data.
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"faceclaimer/storage"
+)
+
+// Collection is the name of the collection images are recorded in.
+const Collection = "images"
+
+// timeout bounds each database operation.
+const timeout = 10 * time.Second
+
+// imageDoc is the document recorded for each image. The document ID is the
+// image's ObjectID.
+type imageDoc struct {
+	ID       primitive.ObjectID `bson:"_id"`
+	CharID   primitive.ObjectID `bson:"charid"`
+	Guild    int                `bson:"guild,omitempty"`
+	User     int                `bson:"user,omitempty"`
+	URL      string             `bson:"url"`
+	Size     int64              `bson:"size"`
+	Hash     string             `bson:"phash,omitempty"`
+	Uploaded time.Time          `bson:"uploaded"`
+}
+
+// Store records images in MongoDB.
+type Store struct {
+	client *mongo.Client
+	images *mongo.Collection
+}
+
+// Connect connects to the MongoDB server at uri and prepares the images
+// collection in the named database.
+func Connect(uri, database string) (*Store, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, options.Client().ApplyURI(uri))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to MongoDB: %w", err)
+	}
+	if err := client.Ping(ctx, nil); err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("failed to reach MongoDB: %w", err)
+	}
+
+	images := client.Database(database).Collection(Collection)
+	_, err = images.Indexes().CreateMany(ctx, []mongo.IndexModel{
+		{Keys: bson.D{{Key: "charid", Value: 1}}},
+		{Keys: bson.D{{Key: "guild", Value: 1}, {Key: "user", Value: 1}}},
+		{Keys: bson.D{{Key: "user", Value: 1}}},
+	})
+	if err != nil {
+		client.Disconnect(ctx)
+		return nil, fmt.Errorf("failed to create indexes: %w", err)
+	}
+
+	return &Store{client: client, images: images}, nil
+}
+
+// Close disconnects from MongoDB.
+func (s *Store) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.client.Disconnect(ctx)
+}
+
+// RecordSaved upserts the document for a newly saved image.
+func (s *Store) RecordSaved(meta storage.Meta, url string) error {
+	doc, err := newImageDoc(meta, url)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	// Only replace the character's own document. If another character's
+	// image has the ID, the upsert fails on the duplicate _id rather than
+	// taking over its record.
+	_, err = s.images.ReplaceOne(ctx, bson.M{"_id": doc.ID, "charid": doc.CharID}, doc, options.Replace().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return fmt.Errorf("image %s is recorded for another character: %w", meta.ID, err)
+	}
+	return err
+}
+
+// RecordDeleted deletes the documents of every image matching the filter.
+func (s *Store) RecordDeleted(f storage.Filter) error {
+	query, err := filterQuery(f)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	_, err = s.images.DeleteMany(ctx, query)
+	return err
+}
+
+// newImageDoc converts image metadata into its document.
+func newImageDoc(meta storage.Meta, url string) (imageDoc, error) {
+	id, err := primitive.ObjectIDFromHex(meta.ID)
+	if err != nil {
+		return imageDoc{}, fmt.Errorf("invalid image ID %s: %w", meta.ID, err)
+	}
+	charID, err := primitive.ObjectIDFromHex(meta.CharID)
+	if err != nil {
+		return imageDoc{}, fmt.Errorf("invalid character ID %s: %w", meta.CharID, err)
+	}
+	return imageDoc{
+		ID:       id,
+		CharID:   charID,
+		Guild:    meta.Guild,
+		User:     meta.User,
+		URL:      url,
+		Size:     meta.Size,
+		Hash:     meta.Hash,
+		Uploaded: meta.Uploaded,
+	}, nil
+}
+
+// filterQuery converts a filter into a MongoDB query.
+func filterQuery(f storage.Filter) (bson.M, error) {
+	query := bson.M{}
+	if f.ImageID != "" {
+		id, err := primitive.ObjectIDFromHex(f.ImageID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid image ID %s: %w", f.ImageID, err)
+		}
+		query["_id"] = id
+	}
+	if f.CharID != "" {
+		charID, err := primitive.ObjectIDFromHex(f.CharID)
+		if err != nil {
+			return nil, fmt.Errorf("invalid character ID %s: %w", f.CharID, err)
+		}
+		query["charid"] = charID
+	}
+	if f.Guild != 0 {
+		query["guild"] = f.Guild
+	}
+	if f.User != 0 {
+		query["user"] = f.User
+	}
+	if len(query) == 0 {
+		return nil, errors.New("refusing to match every image")
+	}
+	return query, nil
+}
@@ -0,0 +1,189 @@
+package mongostore
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"faceclaimer/storage"
+)
+
+// testStore connects to the MongoDB server named by FACECLAIMER_TEST_MONGO_URI,
+// using a throwaway database. The test is skipped if it isn't set.
+func testStore(t *testing.T) *Store {
+	t.Helper()
+	uri := os.Getenv("FACECLAIMER_TEST_MONGO_URI")
+	if uri == "" {
+		t.Skip("FACECLAIMER_TEST_MONGO_URI not set; skipping MongoDB test")
+	}
+
+	database := "faceclaimer_test_" + primitive.NewObjectID().Hex()
+	s, err := Connect(uri, database)
+	if err != nil {
+		t.Fatalf("Connect failed: %v", err)
+	}
+	t.Cleanup(func() {
+		s.client.Database(database).Drop(context.Background())
+		s.Close()
+	})
+	return s
+}
+
+func TestFilterQuery(t *testing.T) {
+	charID := "507f1f77bcf86cd799439011"
+	oid, _ := primitive.ObjectIDFromHex(charID)
+
+	query, err := filterQuery(storage.Filter{CharID: charID, Guild: 123})
+	if err != nil {
+		t.Fatalf("filterQuery failed: %v", err)
+	}
+	if query["charid"] != oid || query["guild"] != 123 || len(query) != 2 {
+		t.Errorf("Unexpected query: %v", query)
+	}
+
+	if _, err := filterQuery(storage.Filter{}); err == nil {
+		t.Error("Expected error for an empty filter")
+	}
+	if _, err := filterQuery(storage.Filter{CharID: "nope"}); err == nil {
+		t.Error("Expected error for an invalid character ID")
+	}
+}
+
+func TestNewImageDoc(t *testing.T) {
+	meta := storage.Meta{
+		ID:     "68f5ce16713c155df96639bc",
+		CharID: "507f1f77bcf86cd799439011",
+		Guild:  123,
+		User:   456,
+		Size:   512,
+		Hash:   "0123456789abcdef",
+	}
+	doc, err := newImageDoc(meta, "https://example.com/a.webp")
+	if err != nil {
+		t.Fatalf("newImageDoc failed: %v", err)
+	}
+	if doc.ID.Hex() != meta.ID || doc.CharID.Hex() != meta.CharID || doc.URL != "https://example.com/a.webp" {
+		t.Errorf("Unexpected document: %+v", doc)
+	}
+
+	meta.ID = "invalid"
+	if _, err := newImageDoc(meta, ""); err == nil {
+		t.Error("Expected error for an invalid image ID")
+	}
+}
+
+func TestStore(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	metas := []storage.Meta{
+		{ID: "68f5ce16713c155df96639bc", CharID: "507f1f77bcf86cd799439011", Guild: 1, User: 10, Uploaded: time.Now().UTC()},
+		{ID: "68f5ce16713c155df96639bd", CharID: "507f1f77bcf86cd799439011", Guild: 1, User: 10, Uploaded: time.Now().UTC()},
+		{ID: "68f5ce16713c155df96639be", CharID: "507f1f77bcf86cd799439012", Guild: 2, User: 20, Uploaded: time.Now().UTC()},
+	}
+	for _, meta := range metas {
+		if err := s.RecordSaved(meta, "https://example.com/"+meta.ID+".webp"); err != nil {
+			t.Fatalf("RecordSaved failed: %v", err)
+		}
+	}
+	// Saving again replaces rather than duplicates
+	if err := s.RecordSaved(metas[0], "https://example.com/replaced.webp"); err != nil {
+		t.Fatalf("RecordSaved failed: %v", err)
+	}
+
+	// Another character can't take over the record
+	taken := metas[1]
+	taken.CharID = "507f1f77bcf86cd799439013"
+	if err := s.RecordSaved(taken, "https://example.com/taken.webp"); err == nil {
+		t.Error("Expected error recording an ID used by another character")
+	}
+
+	count := func() int64 {
+		t.Helper()
+		n, err := s.images.CountDocuments(ctx, bson.M{})
+		if err != nil {
+			t.Fatalf("CountDocuments failed: %v", err)
+		}
+		return n
+	}
+	if n := count(); n != 3 {
+		t.Errorf("Expected 3 documents, got %d", n)
+	}
+
+	var doc imageDoc
+	oid, _ := primitive.ObjectIDFromHex(metas[0].ID)
+	if err := s.images.FindOne(ctx, bson.M{"_id": oid}).Decode(&doc); err != nil {
+		t.Fatalf("FindOne failed: %v", err)
+	}
+	if doc.URL != "https://example.com/replaced.webp" || doc.Guild != 1 || doc.User != 10 {
+		t.Errorf("Unexpected document: %+v", doc)
+	}
+
+	if err := s.RecordDeleted(storage.Filter{CharID: metas[0].CharID, ImageID: metas[0].ID}); err != nil {
+		t.Fatalf("RecordDeleted failed: %v", err)
+	}
+	if n := count(); n != 2 {
+		t.Errorf("Expected 2 documents after single delete, got %d", n)
+	}
+
+	if err := s.RecordDeleted(storage.Filter{Guild: 2}); err != nil {
+		t.Fatalf("RecordDeleted failed: %v", err)
+	}
+	if n := count(); n != 1 {
+		t.Errorf("Expected 1 document after guild delete, got %d", n)
+	}
+}
+
+func TestCollectRefs(t *testing.T) {
+	oid, _ := primitive.ObjectIDFromHex("68f5ce16713c155df96639be")
+	doc := bson.M{
+		"name":   "Ada",
+		"avatar": "https://example.com/images/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp",
+		"profile": bson.M{
+			"gallery": bson.A{
+				"https://example.com/images/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp",
+				bson.D{{Key: "image", Value: oid}},
+			},
+		},
+	}
+
+	refs := make(map[string]bool)
+	collectRefs(doc, refs)
+
+	expected := []string{"68f5ce16713c155df96639bc", "68f5ce16713c155df96639bd", "68f5ce16713c155df96639be"}
+	if len(refs) != len(expected) {
+		t.Errorf("Expected %d references, got %v", len(expected), refs)
+	}
+	for _, id := range expected {
+		if !refs[id] {
+			t.Errorf("Expected reference to %s", id)
+		}
+	}
+}
+
+func TestCharacters(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	charID, _ := primitive.ObjectIDFromHex("507f1f77bcf86cd799439011")
+	chars := s.images.Database().Collection("characters")
+	_, err := chars.InsertMany(ctx, []any{
+		bson.M{"_id": charID, "avatar": "https://example.com/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp"},
+		bson.M{"_id": "not-an-objectid"},
+	})
+	if err != nil {
+		t.Fatalf("InsertMany failed: %v", err)
+	}
+
+	got, err := s.Characters("characters")
+	if err != nil {
+		t.Fatalf("Characters failed: %v", err)
+	}
+	if len(got) != 1 || !got[charID.Hex()]["68f5ce16713c155df96639bc"] {
+		t.Errorf("Unexpected characters: %v", got)
+	}
+}
@@ -0,0 +1,274 @@
+package mongostore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"faceclaimer/storage"
+)
+
+// errHistoryLost is the server error code for a resume token that has fallen
+// off the oplog.
+const errHistoryLost = 286
+
+// retryDelay is how long to wait before reopening a failed change stream.
+const retryDelay = 5 * time.Second
+
+// Cleaner deletes stored images on behalf of a Watcher.
+type Cleaner interface {
+	// CharImages returns every image belonging to a character.
+	CharImages(charID string) ([]storage.Image, error)
+	// DeleteCharacter deletes all of a character's images.
+	DeleteCharacter(charID string) error
+	// DeleteImage deletes a single image.
+	DeleteImage(charID, imageID string) error
+	// Dirs returns where images and their metadata are stored.
+	Dirs() storage.Dirs
+}
+
+// WatchOptions configures a Watcher.
+type WatchOptions struct {
+	// Collection is the bot's collection of character documents.
+	Collection string
+	// TokenPath is the file the change stream's resume token is saved to.
+	TokenPath string
+	// Grace is how long ago an unreferenced image must have last changed, as
+	// by storage.Image.Changed, before it's deleted, as the bot may not have
+	// saved a new upload to its character yet.
+	Grace time.Duration
+}
+
+// Watcher deletes images in response to changes in the bot's character
+// collection: all of a character's images when its document is deleted, and
+// individual images when an update or replacement removes its references to
+// them. References are found as described for Store.Characters.
+//
+// Removed references are found by comparing the document with its state
+// before the change, so the collection must have pre-images enabled for
+// them to be acted on.
+type Watcher struct {
+	store   *Store
+	opts    WatchOptions
+	cleaner Cleaner
+
+	// warnPreImages logs, once, that pre-images are missing
+	warnPreImages sync.Once
+}
+
+// changeEvent holds the parts of a change stream event the watcher uses.
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	DocumentKey   struct {
+		ID any `bson:"_id"`
+	} `bson:"documentKey"`
+	FullDocument bson.M `bson:"fullDocument"`
+	// FullDocumentBeforeChange is nil unless the collection has pre-images
+	// enabled.
+	FullDocumentBeforeChange bson.M `bson:"fullDocumentBeforeChange"`
+}
+
+// NewWatcher returns a watcher that deletes images using cleaner.
+func (s *Store) NewWatcher(opts WatchOptions, cleaner Cleaner) *Watcher {
+	return &Watcher{store: s, opts: opts, cleaner: cleaner}
+}
+
+// Run watches the character collection until ctx is cancelled, reopening the
+// change stream whenever it fails.
+func (w *Watcher) Run(ctx context.Context) {
+	slog.Info("Watching characters", "collection", w.opts.Collection, "resumeToken", w.opts.TokenPath)
+	for {
+		err := w.watch(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Error("Character watcher failed; retrying", "error", err, "delay", retryDelay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retryDelay):
+		}
+	}
+}
+
+// watch opens the change stream, resuming after the saved token if there is
+// one, and handles events until the stream fails or ctx is cancelled.
+func (w *Watcher) watch(ctx context.Context) error {
+	stream, err := w.open(ctx)
+	if err != nil {
+		return err
+	}
+	defer stream.Close(context.Background())
+
+	for stream.Next(ctx) {
+		var event changeEvent
+		if err := stream.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode change event: %w", err)
+		}
+		w.handle(event)
+		if err := w.saveToken(stream.ResumeToken()); err != nil {
+			slog.Warn("Failed to save resume token", "path", w.opts.TokenPath, "error", err)
+		}
+	}
+	if historyLost(stream.Err()) {
+		w.discardToken()
+	}
+	return stream.Err()
+}
+
+// open opens the change stream. If the saved resume token has expired, the
+// stream starts from now instead, leaving any missed deletions to the
+// reconcile subcommand.
+func (w *Watcher) open(ctx context.Context) (*mongo.ChangeStream, error) {
+	coll := w.store.images.Database().Collection(w.opts.Collection)
+	pipeline := mongo.Pipeline{{{Key: "$match", Value: bson.M{
+		// Inserts can't remove references
+		"operationType": bson.M{"$in": bson.A{"update", "replace", "delete"}},
+	}}}}
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetFullDocumentBeforeChange(options.WhenAvailable)
+
+	token, err := w.loadToken()
+	if err != nil {
+		return nil, err
+	}
+	if token != nil {
+		opts.SetResumeAfter(token)
+	}
+
+	stream, err := coll.Watch(ctx, pipeline, opts)
+	if token != nil && historyLost(err) {
+		w.discardToken()
+		stream, err = coll.Watch(ctx, pipeline, opts.SetResumeAfter(nil))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %w", w.opts.Collection, err)
+	}
+	return stream, nil
+}
+
+// handle applies a single change event. Failures are logged, as the event
+// can't be retried.
+func (w *Watcher) handle(event changeEvent) {
+	id, ok := event.DocumentKey.ID.(primitive.ObjectID)
+	if !ok {
+		return
+	}
+	charID := id.Hex()
+
+	if event.OperationType == "delete" {
+		err := w.cleaner.DeleteCharacter(charID)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			slog.Error("Failed to delete character images", "charId", charID, "error", err)
+		default:
+			slog.Info("Deleted images of deleted character", "charId", charID)
+		}
+		return
+	}
+
+	// The document was deleted again before it could be looked up
+	if event.FullDocument == nil {
+		return
+	}
+	if event.FullDocumentBeforeChange == nil {
+		w.warnPreImages.Do(func() {
+			slog.Warn("Character collection has no pre-images, so removed images can't be detected; enable changeStreamPreAndPostImages on it, or run reconcile", "collection", w.opts.Collection)
+		})
+		return
+	}
+	before := documentRefs(event.FullDocumentBeforeChange)
+	after := documentRefs(event.FullDocument)
+
+	images, err := w.cleaner.CharImages(charID)
+	if err != nil {
+		slog.Error("Failed to list character images", "charId", charID, "error", err)
+		return
+	}
+	cutoff := time.Now().Add(-w.opts.Grace)
+	for _, img := range images {
+		if !before[img.ID] || after[img.ID] || !img.Changed(w.cleaner.Dirs()).Before(cutoff) {
+			continue
+		}
+		err := w.cleaner.DeleteImage(charID, img.ID)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+		case err != nil:
+			slog.Error("Failed to delete unreferenced image", "charId", charID, "imageId", img.ID, "error", err)
+		default:
+			slog.Info("Deleted unreferenced image", "charId", charID, "imageId", img.ID)
+		}
+	}
+}
+
+// documentRefs returns the images a character document references.
+func documentRefs(doc bson.M) map[string]bool {
+	refs := make(map[string]bool)
+	for k, v := range doc {
+		// The character's own ID isn't an image reference
+		if k != "_id" {
+			collectRefs(v, refs)
+		}
+	}
+	return refs
+}
+
+// historyLost returns true if err reports that the change stream can't resume
+// because its resume token has fallen off the oplog.
+func historyLost(err error) bool {
+	var serverErr mongo.ServerError
+	return errors.As(err, &serverErr) && serverErr.HasErrorCode(errHistoryLost)
+}
+
+// discardToken deletes an expired resume token, so that the change stream
+// starts from now.
+func (w *Watcher) discardToken() {
+	slog.Warn("Resume token has expired; changes may have been missed, run reconcile to catch up", "path", w.opts.TokenPath)
+	if err := os.Remove(w.opts.TokenPath); err != nil && !os.IsNotExist(err) {
+		slog.Warn("Failed to delete resume token", "path", w.opts.TokenPath, "error", err)
+	}
+}
+
+// loadToken reads the saved resume token, returning nil if there isn't one.
+func (w *Watcher) loadToken() (bson.Raw, error) {
+	data, err := os.ReadFile(w.opts.TokenPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	token := bson.Raw(data)
+	if err := token.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid resume token %s: %w", w.opts.TokenPath, err)
+	}
+	return token, nil
+}
+
+// saveToken atomically replaces the saved resume token.
+func (w *Watcher) saveToken(token bson.Raw) error {
+	if token == nil {
+		return nil
+	}
+	tmp := filepath.Join(filepath.Dir(w.opts.TokenPath), "."+filepath.Base(w.opts.TokenPath)+".partial")
+	if err := os.WriteFile(tmp, token, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, w.opts.TokenPath); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package mongostore
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"faceclaimer/storage"
+)
+
+// fakeCleaner records deletions instead of performing them.
+type fakeCleaner struct {
+	mu         sync.Mutex
+	images     map[string][]storage.Image
+	characters []string
+	deleted    []string
+}
+
+func (f *fakeCleaner) CharImages(charID string) ([]storage.Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.images[charID], nil
+}
+
+func (f *fakeCleaner) DeleteCharacter(charID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if _, ok := f.images[charID]; !ok {
+		return fmt.Errorf("character %s: %w", charID, os.ErrNotExist)
+	}
+	f.characters = append(f.characters, charID)
+	return nil
+}
+
+func (f *fakeCleaner) DeleteImage(charID, imageID string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.deleted = append(f.deleted, imageID)
+	return nil
+}
+
+func (f *fakeCleaner) Dirs() storage.Dirs {
+	return storage.Dirs{}
+}
+
+func (f *fakeCleaner) snapshot() ([]string, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.characters), slices.Clone(f.deleted)
+}
+
+func TestWatcherHandle(t *testing.T) {
+	charID := primitive.NewObjectID()
+	old := time.Now().Add(-time.Hour)
+	kept := storage.Image{CharID: charID.Hex(), ID: primitive.NewObjectIDFromTimestamp(old).Hex()}
+	removed := storage.Image{CharID: charID.Hex(), ID: primitive.NewObjectIDFromTimestamp(old).Hex()}
+	recent := storage.Image{CharID: charID.Hex(), ID: primitive.NewObjectID().Hex()}
+	// Moved here recently, keeping its old ID
+	moved := storage.Image{CharID: charID.Hex(), ID: primitive.NewObjectIDFromTimestamp(old).Hex(), Path: filepath.Join(t.TempDir(), "moved.webp")}
+	if err := os.WriteFile(moved.Path, []byte("webp"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Never referenced, e.g. not yet saved to the character by the bot
+	unsaved := storage.Image{CharID: charID.Hex(), ID: primitive.NewObjectIDFromTimestamp(old).Hex()}
+
+	cleaner := &fakeCleaner{images: map[string][]storage.Image{
+		charID.Hex(): {kept, removed, recent, moved, unsaved},
+	}}
+	w := (&Store{}).NewWatcher(WatchOptions{Grace: 10 * time.Minute}, cleaner)
+
+	url := func(img storage.Image) string {
+		return "https://example.com/" + img.CharID + "/" + img.ID + ".webp"
+	}
+	update := func(before, after bson.M) changeEvent {
+		var event changeEvent
+		event.OperationType = "update"
+		event.DocumentKey.ID = charID
+		event.FullDocumentBeforeChange = before
+		event.FullDocument = after
+		return event
+	}
+
+	t.Run("unrelated update keeps images", func(t *testing.T) {
+		doc := bson.M{"_id": charID, "images": bson.A{url(kept), url(removed)}}
+		w.handle(update(doc, bson.M{"_id": charID, "images": doc["images"], "name": "Renamed"}))
+
+		if _, deleted := cleaner.snapshot(); len(deleted) != 0 {
+			t.Errorf("Expected no deletions, got %v", deleted)
+		}
+	})
+
+	t.Run("update deletes removed images", func(t *testing.T) {
+		before := bson.M{"_id": charID, "images": bson.A{url(kept), url(removed), url(recent), url(moved)}}
+		after := bson.M{"_id": charID, "images": bson.A{url(kept)}}
+		w.handle(update(before, after))
+
+		_, deleted := cleaner.snapshot()
+		if !slices.Equal(deleted, []string{removed.ID}) {
+			t.Errorf("Expected only %s to be deleted, got %v", removed.ID, deleted)
+		}
+	})
+
+	t.Run("update without pre-image is ignored", func(t *testing.T) {
+		w.handle(update(nil, bson.M{"_id": charID}))
+
+		if _, deleted := cleaner.snapshot(); len(deleted) != 1 {
+			t.Errorf("Expected no further deletions, got %v", deleted)
+		}
+	})
+
+	t.Run("update without document is ignored", func(t *testing.T) {
+		w.handle(update(bson.M{"_id": charID, "images": bson.A{url(kept)}}, nil))
+
+		if _, deleted := cleaner.snapshot(); len(deleted) != 1 {
+			t.Errorf("Expected no further deletions, got %v", deleted)
+		}
+	})
+
+	t.Run("delete deletes character", func(t *testing.T) {
+		var event changeEvent
+		event.OperationType = "delete"
+		event.DocumentKey.ID = charID
+		w.handle(event)
+
+		// A character without images is not an error
+		event.DocumentKey.ID = primitive.NewObjectID()
+		w.handle(event)
+
+		if characters, _ := cleaner.snapshot(); !slices.Equal(characters, []string{charID.Hex()}) {
+			t.Errorf("Expected %s to be deleted, got %v", charID.Hex(), characters)
+		}
+	})
+}
+
+func TestResumeToken(t *testing.T) {
+	w := (&Store{}).NewWatcher(WatchOptions{TokenPath: filepath.Join(t.TempDir(), "resume")}, nil)
+
+	token, err := w.loadToken()
+	if err != nil || token != nil {
+		t.Fatalf("Expected no token, got %v, %v", token, err)
+	}
+
+	saved, _ := bson.Marshal(bson.M{"_data": "8263F5CE16000000012B"})
+	if err := w.saveToken(saved); err != nil {
+		t.Fatalf("saveToken failed: %v", err)
+	}
+	token, err = w.loadToken()
+	if err != nil {
+		t.Fatalf("loadToken failed: %v", err)
+	}
+	if !slices.Equal(token, bson.Raw(saved)) {
+		t.Errorf("Loaded token %v, expected %v", token, bson.Raw(saved))
+	}
+
+	os.WriteFile(w.opts.TokenPath, []byte("garbage"), 0644)
+	if _, err := w.loadToken(); err == nil {
+		t.Error("Expected error for an invalid token")
+	}
+}
+
+// TestWatcher requires a replica set, as change streams aren't available on a
+// standalone server.
+func TestWatcher(t *testing.T) {
+	s := testStore(t)
+	ctx := context.Background()
+
+	charID := primitive.NewObjectID()
+	orphanID := primitive.NewObjectIDFromTimestamp(time.Now().Add(-time.Hour))
+	cleaner := &fakeCleaner{images: map[string][]storage.Image{
+		charID.Hex(): {{CharID: charID.Hex(), ID: orphanID.Hex()}},
+	}}
+
+	characters := s.images.Database().Collection("characters")
+	if _, err := characters.InsertOne(ctx, bson.M{"_id": charID, "images": bson.A{orphanID.Hex() + ".webp"}}); err != nil {
+		t.Fatalf("InsertOne failed: %v", err)
+	}
+	// Removed references are only detected with pre-images
+	err := s.images.Database().RunCommand(ctx, bson.D{
+		{Key: "collMod", Value: "characters"},
+		{Key: "changeStreamPreAndPostImages", Value: bson.M{"enabled": true}},
+	}).Err()
+	if err != nil {
+		t.Skipf("Pre-images aren't supported: %v", err)
+	}
+
+	tokenPath := filepath.Join(t.TempDir(), "resume")
+	w := s.NewWatcher(WatchOptions{Collection: "characters", TokenPath: tokenPath}, cleaner)
+	watchCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		w.Run(watchCtx)
+		close(done)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Keep making changes until the watcher, which starts asynchronously,
+	// has seen them
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		// Restore the reference before removing it again, in case the
+		// watcher missed the last removal
+		characters.UpdateOne(ctx, bson.M{"_id": charID}, bson.M{"$set": bson.M{"images": bson.A{orphanID.Hex() + ".webp"}}})
+		characters.UpdateOne(ctx, bson.M{"_id": charID}, bson.M{"$set": bson.M{"images": bson.A{}}})
+		if _, deleted := cleaner.snapshot(); len(deleted) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the unreferenced image to be deleted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := characters.DeleteOne(ctx, bson.M{"_id": charID}); err != nil {
+		t.Fatalf("DeleteOne failed: %v", err)
+	}
+	for {
+		if deleted, _ := cleaner.snapshot(); len(deleted) > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the character to be deleted")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	if _, err := os.Stat(tokenPath); err != nil {
+		t.Errorf("Expected resume token to be saved: %v", err)
+	}
+}
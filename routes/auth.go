@@ -0,0 +1,213 @@
+package routes
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/auth"
+	"faceclaimer/storage"
+)
+
+// apiKeyHeader is an alternative to the Authorization header for giving the
+// API key.
+const apiKeyHeader = "X-API-Key"
+
+// apiKeyContext is the gin context key holding the request's API key.
+const apiKeyContext = "apiKey"
+
+// Headers carrying a request's signature, as an alternative to an API key.
+const (
+	signatureHeader = "X-Signature"
+	timestampHeader = "X-Timestamp"
+)
+
+// signedKey is the key a request is treated as having when it's signed with
+// the shared secret. It may do anything.
+var signedKey = &auth.Key{Name: "signed", Scopes: []auth.Scope{auth.ScopeAdmin}}
+
+// authenticate checks the request's signature or API key, if either is
+// configured. Signed requests are accepted in place of a key. If only
+// signing is configured, mutating requests must be signed but reads needn't
+// be.
+func authenticate(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.Signatures != nil && c.GetHeader(signatureHeader) != "" {
+			verifySignature(c, cfg.Signatures)
+			return
+		}
+		if cfg.Keys == nil {
+			if cfg.Signatures != nil && isMutating(c.Request.Method) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Request must be signed"})
+				return
+			}
+			c.Next()
+			return
+		}
+		secret := c.GetHeader(apiKeyHeader)
+		if bearer, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer "); ok {
+			secret = bearer
+		}
+		if secret == "" {
+			c.Header("WWW-Authenticate", "Bearer")
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "API key required"})
+			return
+		}
+		key, ok := cfg.Keys.Lookup(secret)
+		if !ok {
+			slog.Warn("Invalid API key", "ip", c.ClientIP(), "path", c.Request.URL.Path)
+			c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key"})
+			return
+		}
+		c.Set(apiKeyContext, key)
+		c.Next()
+	}
+}
+
+// maxSignedBody is the largest body a signed request may have: an image and
+// its form fields.
+const maxSignedBody = maxImageSize + maxFieldSize*16
+
+// requireClientCert rejects requests made without a client certificate
+// signed by the client CA, when there is one. The TLS handshake has already
+// verified any certificate given.
+func requireClientCert(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if cfg.ClientCA != "" && (c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0) {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Client certificate required"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// verifySignature checks the request's X-Signature and X-Timestamp headers
+// against its method, URI, and body, which is buffered for the handler. The
+// timestamp and declared length are checked first, so that stale or
+// oversized requests are rejected without reading their bodies.
+func verifySignature(c *gin.Context, verifier *auth.Verifier) {
+	if _, err := auth.CheckTimestamp(c.GetHeader(timestampHeader), time.Now()); err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature: " + err.Error()})
+		return
+	}
+	if c.Request.ContentLength > maxSignedBody {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": errTooLarge.Error()})
+		return
+	}
+
+	body, err := readLimited(c.Request.Body, maxSignedBody)
+	if errors.Is(err, errTooLarge) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	err = verifier.Verify(c.Request.Method, c.Request.URL.RequestURI(), c.GetHeader(timestampHeader), c.GetHeader(signatureHeader), body, time.Now())
+	if err != nil {
+		slog.Warn("Invalid request signature", "ip", c.ClientIP(), "path", c.Request.URL.Path, "error", err)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid signature: " + err.Error()})
+		return
+	}
+	c.Set(apiKeyContext, signedKey)
+	c.Next()
+}
+
+// isMutating returns true if method may change stored images.
+func isMutating(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return false
+	}
+	return true
+}
+
+// require rejects requests whose API key lacks scope.
+func require(scope auth.Scope) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if key := apiKey(c); key != nil && !key.Allows(scope) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks the " + string(scope) + " scope"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// apiKey returns the request's API key, or nil if keys aren't configured.
+func apiKey(c *gin.Context) *auth.Key {
+	if key, ok := c.Get(apiKeyContext); ok {
+		return key.(*auth.Key)
+	}
+	return nil
+}
+
+// allowGuild checks that the request's API key may access the guild's
+// images. If not, the request is aborted and false is returned.
+func allowGuild(c *gin.Context, guild int) bool {
+	if key := apiKey(c); key != nil && !key.AllowsGuild(guild) {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is not allowed for this guild"})
+		return false
+	}
+	return true
+}
+
+// allowAllGuilds checks that the request's API key isn't restricted to
+// certain guilds, for requests that span them. If it is, the request is
+// aborted and false is returned.
+func allowAllGuilds(c *gin.Context) bool {
+	if key := apiKey(c); key != nil && key.Restricted() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is restricted to certain guilds"})
+		return false
+	}
+	return true
+}
+
+// allowImage checks that the request's API key may access an image.
+func allowImage(c *gin.Context, cfg *Config, img storage.Image) bool {
+	if key := apiKey(c); key == nil || !key.Restricted() {
+		return true
+	}
+	guild, _ := imageOwner(cfg, img)
+	return allowGuild(c, guild)
+}
+
+// allowCharacter checks that the request's API key may access every one of a
+// character's images.
+func allowCharacter(c *gin.Context, cfg *Config, charID string) bool {
+	if key := apiKey(c); key == nil || !key.Restricted() {
+		return true
+	}
+	images, err := cfg.Layout.CharImages(cfg.ImagesDir, charID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	for _, img := range images {
+		if !allowImage(c, cfg, img) {
+			return false
+		}
+	}
+	return true
+}
+
+// imageOwner returns the guild and user an image belongs to, from its path if
+// the layout includes them, or else its metadata. They're zero if unknown.
+func imageOwner(cfg *Config, img storage.Image) (guild, user int) {
+	if img.Guild != 0 {
+		return img.Guild, img.User
+	}
+	meta, err := cfg.Dirs().ReadMeta(img.Path)
+	if err != nil {
+		return 0, 0
+	}
+	return meta.Guild, meta.User
+}
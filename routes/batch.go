@@ -0,0 +1,89 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/checks"
+)
+
+// maxBatchSize is the most images a single batch upload may hold.
+const maxBatchSize = 50
+
+// batchWorkers is the number of images in a batch processed concurrently.
+const batchWorkers = 4
+
+// BatchResult is the outcome of one image in a batch upload.
+type BatchResult struct {
+	Status int    `json:"status"`
+	URL    string `json:"url,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// handleBatchUpload downloads and saves several images concurrently. Each
+// image succeeds or fails independently, and the results are returned in
+// request order.
+func handleBatchUpload(c *gin.Context, cfg *Config) {
+	var requests []UploadRequest
+	if err := c.BindJSON(&requests); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(requests) == 0 || len(requests) > maxBatchSize {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Batch must hold 1 to %d images", maxBatchSize)})
+		return
+	}
+	slog.Info("Batch upload request", "images", len(requests))
+
+	key := apiKey(c)
+	results := make([]BatchResult, len(requests))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for range min(batchWorkers, len(requests)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				if key != nil && !key.AllowsGuild(requests[i].Guild) {
+					results[i] = BatchResult{Status: http.StatusForbidden, Error: "API key is not allowed for this guild"}
+					continue
+				}
+				results[i] = uploadOne(cfg, requests[i])
+			}
+		}()
+	}
+	for i := range requests {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	c.JSON(http.StatusOK, results)
+}
+
+// uploadOne downloads and saves the image for a single upload request.
+func uploadOne(cfg *Config, request UploadRequest) BatchResult {
+	if !checks.IsValidURL(request.ImageURL) {
+		return BatchResult{Status: http.StatusBadRequest, Error: "invalid image URL"}
+	}
+	imageData, err := fetchImage(request.ImageURL)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errDownloadFailed) {
+			status = http.StatusBadGateway
+		}
+		return BatchResult{Status: status, Error: err.Error()}
+	}
+
+	url, status, err := saveImage(cfg, request, imageData)
+	if err != nil {
+		slog.Warn("Batch image failed", "charId", request.CharID, "url", request.ImageURL, "error", err)
+		return BatchResult{Status: status, Error: err.Error()}
+	}
+	return BatchResult{Status: status, URL: url}
+}
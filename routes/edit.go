@@ -0,0 +1,196 @@
+package routes
+
+import (
+	"image"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/checks"
+	"faceclaimer/convert"
+	"faceclaimer/storage"
+)
+
+// editMu serializes edits, so that concurrent edits of the same image can't
+// overwrite each other's changes. Edits are rare enough that serializing all
+// of them costs nothing.
+var editMu sync.Mutex
+
+// RotateRequest describes a rotation and/or flip of a stored image.
+type RotateRequest struct {
+	// Degrees is the clockwise rotation: 0, 90, 180, or 270.
+	Degrees int `json:"degrees"`
+	// Flip optionally mirrors the image after rotating it: "horizontal" or
+	// "vertical".
+	Flip string `json:"flip"`
+}
+
+// handleImageRotate rotates and/or flips a stored image in place. The image
+// param must be in the form imageId.webp.
+func handleImageRotate(c *gin.Context, cfg *Config) {
+	var request RotateRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Degrees%90 != 0 || request.Degrees < 0 || request.Degrees >= 360 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "degrees must be 0, 90, 180, or 270"})
+		return
+	}
+	flip, err := convert.ParseFlip(request.Flip)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if request.Degrees == 0 && flip == convert.FlipNone {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "degrees or flip is required"})
+		return
+	}
+
+	img, ok := lookupImage(c, cfg, ".webp")
+	if !ok {
+		return
+	}
+	slog.Info("Image rotate request", "charId", img.CharID, "imageId", img.ID, "degrees", request.Degrees, "flip", flip)
+
+	meta, err := editImage(cfg, img, func(src image.Image) image.Image {
+		return convert.Transform(src, request.Degrees, flip)
+	})
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, meta)
+}
+
+// handleImageReplace replaces a stored image with a newly downloaded one,
+// keeping its URL. The image param must be in the form imageId.webp. The
+// previous version is kept as a revision if revisions are enabled; keep=true
+// or keep=false overrides this.
+func handleImageReplace(c *gin.Context, cfg *Config) {
+	var request UploadRequest
+	if err := c.BindJSON(&request); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !checks.IsValidURL(request.ImageURL) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid image URL"})
+		return
+	}
+
+	img, ok := lookupImage(c, cfg, ".webp")
+	if !ok {
+		return
+	}
+	slog.Info("Image replace request", "user", request.User, "guild", request.Guild, "charId", img.CharID, "imageId", img.ID)
+	if request.Guild != 0 && !allowGuild(c, request.Guild) {
+		return
+	}
+	if request.CharID != "" && request.CharID != img.CharID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "charid does not match the image"})
+		return
+	}
+	if cfg.Layout.UsesOwners() && (request.Guild != 0 && request.Guild != img.Guild || request.User != 0 && request.User != img.User) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "guild and user do not match the image"})
+		return
+	}
+
+	imageData, ok := downloadImage(c, request.ImageURL)
+	if !ok {
+		return
+	}
+
+	limit := cfg.Revisions
+	switch c.Query("keep") {
+	case "true":
+		limit = max(limit, 1)
+	case "false":
+		limit = 0
+	}
+
+	if _, err := replaceImage(cfg, img, request, imageData, limit); err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, imageURL(cfg, img.Parts(cfg.Layout)))
+}
+
+// replaceImage replaces a stored image with new image data, keeping the
+// previous version as a revision unless limit is zero, then updates its
+// metadata and records.
+func replaceImage(cfg *Config, img storage.Image, r UploadRequest, data []byte, limit int) (storage.Meta, error) {
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	prev, err := cfg.Dirs().LoadMeta(img)
+	if err != nil {
+		slog.Warn("Failed to read image metadata", "path", img.Path, "error", err)
+		prev = storage.Meta{Guild: img.Guild, User: img.User, Uploaded: img.Created()}
+	}
+	// Keep the revision only once the new image is ready, so that a failed
+	// replacement leaves the history alone
+	info, err := convert.ReplaceWebP(data, img.Path, cfg.Quality, func() error {
+		return storage.KeepRevision(cfg.Dirs(), img.Path, limit)
+	})
+	if err != nil {
+		return storage.Meta{}, err
+	}
+
+	// The image stays where it is, so its owners can only change if the
+	// layout doesn't record them
+	r.CharID = img.CharID
+	if cfg.Layout.UsesOwners() || r.Guild == 0 && r.User == 0 {
+		r.Guild, r.User = prev.Guild, prev.User
+	}
+	meta := newMeta(r, img.Parts(cfg.Layout), info)
+	meta.Uploaded = prev.Uploaded
+	meta.Modified = time.Now().UTC()
+	if err := cfg.Dirs().WriteMeta(img.Path, meta); err != nil {
+		slog.Warn("Failed to write image metadata", "path", img.Path, "error", err)
+	}
+	recordSaved(cfg, meta, imageURL(cfg, img.Parts(cfg.Layout)))
+
+	return meta, nil
+}
+
+// editImage applies edit to a stored image in place, keeping the previous
+// version as a revision if revisions are enabled, then updates its metadata
+// and records.
+func editImage(cfg *Config, img storage.Image, edit func(image.Image) image.Image) (storage.Meta, error) {
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	meta, err := cfg.Dirs().LoadMeta(img)
+	if err != nil {
+		return storage.Meta{}, err
+	}
+	// As with replacements, keep the revision only once the edit is ready
+	info, err := convert.EditWebP(img.Path, cfg.Quality, edit, func() error {
+		return storage.KeepRevision(cfg.Dirs(), img.Path, cfg.Revisions)
+	})
+	if err != nil {
+		return storage.Meta{}, err
+	}
+
+	meta.Width = info.Width
+	meta.Height = info.Height
+	meta.Size = info.Size
+	meta.Quality = info.Quality
+	meta.Mode = storage.ModeLossy
+	if info.Lossless {
+		meta.Mode = storage.ModeLossless
+	}
+	meta.Hash = info.Hash
+	meta.Modified = time.Now().UTC()
+	if err := cfg.Dirs().WriteMeta(img.Path, meta); err != nil {
+		slog.Warn("Failed to write image metadata", "path", img.Path, "error", err)
+	}
+	recordSaved(cfg, meta, imageURL(cfg, img.Parts(cfg.Layout)))
+
+	return meta, nil
+}
@@ -0,0 +1,197 @@
+package routes
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-contrib/sse"
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/webhook"
+)
+
+// eventBufferSize is the number of recent events kept for clients resuming
+// with Last-Event-ID.
+const eventBufferSize = 1000
+
+// subscriberBuffer is the number of events a stream may fall behind by
+// before it's disconnected. The client can then resume with Last-Event-ID.
+const subscriberBuffer = 100
+
+// keepaliveInterval is how often an idle stream is sent a comment, so that
+// proxies don't time it out.
+const keepaliveInterval = 30 * time.Second
+
+// sequencedEvent is an event with its position in the stream. Sequence
+// numbers start at 1 each time the server starts.
+type sequencedEvent struct {
+	seq   uint64
+	event webhook.Event
+}
+
+// eventHub broadcasts storage changes to event streams, keeping a bounded
+// buffer of recent events.
+type eventHub struct {
+	mu     sync.Mutex
+	seq    uint64
+	buffer []sequencedEvent
+	subs   map[chan sequencedEvent]struct{}
+	closed bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{subs: make(map[chan sequencedEvent]struct{})}
+}
+
+// publish sends an event to every stream. Streams that have fallen too far
+// behind are disconnected.
+func (h *eventHub) publish(event webhook.Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return
+	}
+	h.seq++
+	e := sequencedEvent{seq: h.seq, event: event}
+	h.buffer = append(h.buffer, e)
+	if len(h.buffer) > eventBufferSize {
+		h.buffer = h.buffer[len(h.buffer)-eventBufferSize:]
+	}
+	for ch := range h.subs {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// subscribe starts receiving events, returning the buffered events after
+// lastSeq, if resuming. If lastSeq is ahead of the stream, it's from before
+// the server restarted, and every buffered event is returned. The channel is
+// closed if the subscriber falls behind or the hub closes; otherwise, cancel
+// must be called once done.
+func (h *eventHub) subscribe(lastSeq uint64, resume bool) (backlog []sequencedEvent, events <-chan sequencedEvent, cancel func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if resume {
+		if lastSeq > h.seq {
+			lastSeq = 0
+		}
+		for _, e := range h.buffer {
+			if e.seq > lastSeq {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	ch := make(chan sequencedEvent, subscriberBuffer)
+	if h.closed {
+		close(ch)
+		return backlog, ch, func() {}
+	}
+	h.subs[ch] = struct{}{}
+	return backlog, ch, func() {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if _, ok := h.subs[ch]; ok {
+			delete(h.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// close disconnects every stream, so that the server can shut down.
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for ch := range h.subs {
+		delete(h.subs, ch)
+		close(ch)
+	}
+}
+
+// eventFilter selects the events a stream receives.
+type eventFilter struct {
+	guild  int
+	charID string
+}
+
+func (f eventFilter) matches(event webhook.Event) bool {
+	return (f.guild == 0 || event.Guild == f.guild) &&
+		(f.charID == "" || event.CharID == f.charID)
+}
+
+// handleEvents streams storage changes as server-sent events, optionally
+// filtered by guild or character. Clients reconnecting with Last-Event-ID
+// receive the buffered events they missed.
+func handleEvents(c *gin.Context, cfg *Config) {
+	var filter eventFilter
+	if guild := c.Query("guild"); guild != "" {
+		var err error
+		if filter.guild, err = parseDiscordID("guild", guild); err != nil || filter.guild == 0 {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid guild ID"})
+			return
+		}
+	}
+	filter.charID = c.Query("charid")
+	if filter.guild == 0 && !allowAllGuilds(c) || filter.guild != 0 && !allowGuild(c, filter.guild) {
+		return
+	}
+
+	lastID := c.GetHeader("Last-Event-ID")
+	if lastID == "" {
+		lastID = c.Query("lastEventId")
+	}
+	var lastSeq uint64
+	resume := lastID != ""
+	if resume {
+		var err error
+		if lastSeq, err = strconv.ParseUint(lastID, 10, 64); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid Last-Event-ID"})
+			return
+		}
+	}
+
+	backlog, events, cancel := cfg.events.subscribe(lastSeq, resume)
+	defer cancel()
+	slog.Info("Event stream opened", "guild", filter.guild, "charId", filter.charID, "backlog", len(backlog))
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	send := func(e sequencedEvent) {
+		if filter.matches(e.event) {
+			c.Render(-1, sse.Event{Id: strconv.FormatUint(e.seq, 10), Event: e.event.Type, Data: e.event})
+		}
+	}
+	for _, e := range backlog {
+		send(e)
+	}
+	c.Writer.Flush()
+
+	keepalive := time.NewTicker(keepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			send(e)
+		case <-keepalive.C:
+			c.Writer.WriteString(": keepalive\n\n")
+		case <-c.Request.Context().Done():
+			return
+		}
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,240 @@
+package routes
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// idempotencyKeyHeader is the request header naming an idempotency key.
+const idempotencyKeyHeader = "Idempotency-Key"
+
+// idempotentReplayHeader marks a response replayed for a repeated key.
+const idempotentReplayHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKey is the longest idempotency key accepted.
+const maxIdempotencyKey = 255
+
+// idempotencyStore remembers the responses to requests made with an
+// idempotency key, so that retries get the original response.
+type idempotencyStore struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*idempotentEntry
+}
+
+// idempotentEntry is the response to a keyed request. Until done is closed,
+// the request is still being processed.
+type idempotentEntry struct {
+	hash    [sha256.Size]byte
+	done    chan struct{}
+	expires time.Time
+
+	status      int
+	contentType string
+	location    string
+	body        []byte
+}
+
+func newIdempotencyStore(ttl time.Duration) *idempotencyStore {
+	return &idempotencyStore{ttl: ttl, entries: make(map[string]*idempotentEntry)}
+}
+
+// claim returns the entry for key. If there isn't one, a new entry is
+// created and owner is true: the caller must process the request, then call
+// finish.
+func (s *idempotencyStore) claim(key string, hash [sha256.Size]byte) (entry *idempotentEntry, owner bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, e := range s.entries {
+		if !e.expires.IsZero() && now.After(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+	if entry, ok := s.entries[key]; ok {
+		return entry, false
+	}
+	entry = &idempotentEntry{hash: hash, done: make(chan struct{})}
+	s.entries[key] = entry
+	return entry, true
+}
+
+// finish completes an entry. Server errors aren't kept, so that the request
+// can be retried.
+func (s *idempotencyStore) finish(key string, entry *idempotentEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry.status >= http.StatusInternalServerError || entry.status == 0 {
+		delete(s.entries, key)
+	} else {
+		entry.expires = time.Now().Add(s.ttl)
+	}
+	close(entry.done)
+}
+
+// captureWriter records the body written to a response.
+type captureWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *captureWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *captureWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// requestHash identifies a request by its method, URI, content type, and
+// body. Multipart bodies are hashed by their parts, in any order, as clients
+// pick a new boundary for each attempt.
+func requestHash(r *http.Request, body []byte) [sha256.Size]byte {
+	mediaType, params, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	h := sha256.New()
+	io.WriteString(h, r.Method+" "+r.URL.RequestURI()+"\n"+mediaType+"\n")
+	hashed := false
+	if mediaType == "multipart/form-data" {
+		// A malformed body is hashed whole; the handler rejects it anyway
+		if parts, err := partHashes(body, params["boundary"]); err == nil {
+			for _, part := range parts {
+				h.Write(part)
+			}
+			hashed = true
+		}
+	}
+	if !hashed {
+		h.Write(body)
+	}
+	var hash [sha256.Size]byte
+	h.Sum(hash[:0])
+	return hash
+}
+
+// partHashes returns the hash of each part of a multipart body, covering its
+// headers and content, sorted.
+func partHashes(body []byte, boundary string) ([][]byte, error) {
+	if boundary == "" {
+		return nil, errors.New("no multipart boundary")
+	}
+	reader := multipart.NewReader(bytes.NewReader(body), boundary)
+	var hashes [][]byte
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		h := sha256.New()
+		for _, name := range slices.Sorted(maps.Keys(part.Header)) {
+			fmt.Fprintf(h, "%q: %q\n", name, part.Header[name])
+		}
+		if _, err := io.Copy(h, part); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h.Sum(nil))
+	}
+	slices.SortFunc(hashes, bytes.Compare)
+	return hashes, nil
+}
+
+// idempotent makes a handler safe to retry. Requests with an Idempotency-Key
+// header are processed once; repeats with the same key and request within the
+// TTL receive the original response, waiting for it if it's still in
+// progress. Reusing a key for a different request is an error.
+func idempotent(cfg *Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader(idempotencyKeyHeader)
+		if key == "" || cfg.idempotency == nil {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKey {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key is too long"})
+			return
+		}
+
+		// Hash the request, then hand the body on to the handler. Bodies
+		// are limited to the image size, so a longer body is only hashed up to
+		// the limit; the handler rejects it anyway.
+		prefix, err := io.ReadAll(io.LimitReader(c.Request.Body, maxImageSize+maxFieldSize*16))
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.Request.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(prefix), c.Request.Body), c.Request.Body}
+
+		hash := requestHash(c.Request, prefix)
+
+		// Keys are scoped to the endpoint and API key, so that clients can't
+		// see each other's responses
+		scoped := c.FullPath() + "\n" + key
+		if apiKey := apiKey(c); apiKey != nil {
+			scoped = apiKey.Name + "\n" + scoped
+		}
+		for {
+			entry, owner := cfg.idempotency.claim(scoped, hash)
+			if owner {
+				writer := &captureWriter{ResponseWriter: c.Writer}
+				c.Writer = writer
+				completed := false
+				defer func() {
+					// If the handler panicked, the response isn't kept
+					if completed {
+						entry.status = writer.Status()
+						entry.contentType = writer.Header().Get("Content-Type")
+						entry.location = writer.Header().Get("Location")
+						entry.body = writer.body.Bytes()
+					}
+					cfg.idempotency.finish(scoped, entry)
+				}()
+				c.Next()
+				completed = true
+				return
+			}
+
+			if entry.hash != hash {
+				c.AbortWithStatusJSON(http.StatusUnprocessableEntity, gin.H{"error": "Idempotency-Key was used for a different request"})
+				return
+			}
+			select {
+			case <-entry.done:
+			case <-c.Request.Context().Done():
+				c.Abort()
+				return
+			}
+			if entry.expires.IsZero() {
+				// The first request failed and was forgotten, so try again
+				continue
+			}
+
+			c.Header(idempotentReplayHeader, "true")
+			if entry.location != "" {
+				c.Header("Location", entry.location)
+			}
+			c.Data(entry.status, entry.contentType, entry.body)
+			c.Abort()
+			return
+		}
+	}
+}
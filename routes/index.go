@@ -0,0 +1,54 @@
+package routes
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/checks"
+	"faceclaimer/storage"
+)
+
+// handleStats reports the number and total size of stored images, optionally
+// filtered by guild, user, or character. It requires the index.
+func handleStats(c *gin.Context, cfg *Config) {
+	if cfg.Index == nil {
+		c.AbortWithStatusJSON(http.StatusNotImplemented, gin.H{"error": "Stats require the index to be enabled"})
+		return
+	}
+
+	var f storage.Filter
+	if guild := c.Query("guild"); guild != "" {
+		if !checks.IsValidDiscordID(guild) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid guild ID"})
+			return
+		}
+		f.Guild, _ = strconv.Atoi(guild)
+	}
+	if user := c.Query("user"); user != "" {
+		if !checks.IsValidDiscordID(user) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		f.User, _ = strconv.Atoi(user)
+	}
+	if charID := c.Query("charid"); charID != "" {
+		if !checks.IsValidObjectId(charID) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid character ID"})
+			return
+		}
+		f.CharID = charID
+	}
+
+	if f.Guild == 0 && !allowAllGuilds(c) || f.Guild != 0 && !allowGuild(c, f.Guild) {
+		return
+	}
+
+	stats, err := cfg.Index.Stats(f)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
@@ -0,0 +1,256 @@
+package routes
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"faceclaimer/webhook"
+)
+
+// maxQueuedJobs is the most uploads that may wait for a worker.
+const maxQueuedJobs = 1000
+
+// maxQueuedBytes is the most uploaded image data that may be held in memory
+// by queued and running jobs. Jobs that download their image don't count
+// towards it until they run, and only as many run as there are workers.
+const maxQueuedBytes = 1024 * 1024 * 1024
+
+// jobRetention is how long finished jobs can be polled for.
+const jobRetention = time.Hour
+
+// JobStatus is the state of an asynchronous upload.
+type JobStatus string
+
+const (
+	JobQueued      JobStatus = "queued"
+	JobDownloading JobStatus = "downloading"
+	JobEncoding    JobStatus = "encoding"
+	JobDone        JobStatus = "done"
+	JobFailed      JobStatus = "failed"
+)
+
+// Job describes an asynchronous upload.
+type Job struct {
+	ID     string    `json:"id"`
+	Status JobStatus `json:"status"`
+	// URL is the image URL, once the job is done.
+	URL string `json:"url,omitempty"`
+	// Error describes why the job failed.
+	Error   string    `json:"error,omitempty"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+
+	// guild is the guild the upload is for, so that access can be checked.
+	guild int
+}
+
+// finished returns true if the job is done or failed.
+func (j Job) finished() bool {
+	return j.Status == JobDone || j.Status == JobFailed
+}
+
+// errQueueFull reports that no more jobs can be queued.
+var errQueueFull = errors.New("too many uploads are queued")
+
+// jobQueue runs uploads in the background on a fixed number of workers.
+// Jobs are held in memory, so they're lost if the server restarts.
+type jobQueue struct {
+	cfg      *Config
+	pending  chan pendingJob
+	maxBytes int
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// queuedBytes is the size of the uploaded data held by unfinished jobs.
+	queuedBytes int
+}
+
+// pendingJob is a queued upload. If data is nil, the image is downloaded
+// from the request's URL.
+type pendingJob struct {
+	id      string
+	request UploadRequest
+	data    []byte
+}
+
+// newJobQueue starts a queue with the given number of workers.
+func newJobQueue(cfg *Config, workers int) *jobQueue {
+	q := &jobQueue{
+		cfg:      cfg,
+		pending:  make(chan pendingJob, maxQueuedJobs),
+		maxBytes: maxQueuedBytes,
+		jobs:     make(map[string]*Job),
+	}
+	for range workers {
+		go q.work()
+	}
+	return q
+}
+
+// add queues an upload and returns its job.
+func (q *jobQueue) add(request UploadRequest, data []byte) (Job, error) {
+	now := time.Now().UTC()
+	job := &Job{
+		ID:      primitive.NewObjectID().Hex(),
+		Status:  JobQueued,
+		Created: now,
+		Updated: now,
+		guild:   request.Guild,
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.prune(now)
+	if q.queuedBytes+len(data) > q.maxBytes {
+		return Job{}, errQueueFull
+	}
+	select {
+	case q.pending <- pendingJob{id: job.ID, request: request, data: data}:
+	default:
+		return Job{}, errQueueFull
+	}
+	q.queuedBytes += len(data)
+	q.jobs[job.ID] = job
+	return *job, nil
+}
+
+// get returns the job with the given ID.
+func (q *jobQueue) get(id string) (Job, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+	return *job, true
+}
+
+// update changes a job's status, along with its URL or error once finished.
+func (q *jobQueue) update(id string, status JobStatus, url string, err error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	job, ok := q.jobs[id]
+	if !ok {
+		return
+	}
+	job.Status = status
+	job.URL = url
+	if err != nil {
+		job.Error = err.Error()
+	}
+	job.Updated = time.Now().UTC()
+}
+
+// prune forgets jobs that finished more than jobRetention ago. The caller
+// must hold q.mu.
+func (q *jobQueue) prune(now time.Time) {
+	for id, job := range q.jobs {
+		if job.finished() && now.Sub(job.Updated) > jobRetention {
+			delete(q.jobs, id)
+		}
+	}
+}
+
+// work runs queued jobs until the process exits.
+func (q *jobQueue) work() {
+	for job := range q.pending {
+		q.run(job)
+		q.mu.Lock()
+		q.queuedBytes -= len(job.data)
+		q.mu.Unlock()
+	}
+}
+
+// run downloads, if necessary, and saves a job's image.
+func (q *jobQueue) run(job pendingJob) {
+	data := job.data
+	if data == nil {
+		q.update(job.id, JobDownloading, "", nil)
+		var err error
+		if data, err = fetchImage(job.request.ImageURL); err != nil {
+			slog.Warn("Upload job failed", "job", job.id, "url", job.request.ImageURL, "error", err)
+			q.fail(job, err)
+			return
+		}
+	}
+
+	q.update(job.id, JobEncoding, "", nil)
+	url, _, err := saveImage(q.cfg, job.request, data)
+	if err != nil {
+		slog.Warn("Upload job failed", "job", job.id, "charId", job.request.CharID, "error", err)
+		q.fail(job, err)
+		return
+	}
+	slog.Info("Upload job done", "job", job.id, "url", url)
+	q.update(job.id, JobDone, url, nil)
+}
+
+// fail marks a job failed, and tells its callback, if it has one.
+func (q *jobQueue) fail(job pendingJob, err error) {
+	q.update(job.id, JobFailed, "", err)
+	if job.request.CallbackURL != "" && q.cfg.Webhooks != nil {
+		event := webhook.NewEvent(webhook.UploadFailed)
+		event.Guild = job.request.Guild
+		event.User = job.request.User
+		event.CharID = job.request.CharID
+		event.Error = err.Error()
+		q.cfg.Webhooks.Send(job.request.CallbackURL, event)
+	}
+}
+
+// queueUpload starts an asynchronous upload and responds with its job. The
+// request is validated first, so only download and conversion errors are
+// reported through the job.
+func queueUpload(c *gin.Context, cfg *Config, request UploadRequest, imageData []byte) {
+	if cfg.jobs == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Asynchronous uploads are disabled"})
+		return
+	}
+	if err := checkCallback(cfg, request); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := prepImageNameParts(request, cfg.Layout); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := checkImageID(cfg, request); errors.Is(err, os.ErrExist) {
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Image already exists"})
+		return
+	} else if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	job, err := cfg.jobs.add(request, imageData)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+		return
+	}
+	c.Header("Location", "/jobs/"+job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleJobStatus reports the status of an asynchronous upload.
+func handleJobStatus(c *gin.Context, cfg *Config) {
+	var job Job
+	var ok bool
+	if cfg.jobs != nil {
+		job, ok = cfg.jobs.get(c.Param("id"))
+	}
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if !allowGuild(c, job.guild) {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
@@ -0,0 +1,113 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// multipartFileField is the form field holding an uploaded image.
+const multipartFileField = "image"
+
+// maxFieldSize is the largest non-file form field accepted, in bytes.
+const maxFieldSize = 1024
+
+// errTooLarge reports an upload exceeding maxImageSize.
+var errTooLarge = fmt.Errorf("image exceeds the %d byte limit", maxImageSize)
+
+// readMultipartUpload reads an upload request from a multipart/form-data
+// body, with charid, guild, user, imageid, and callback_url fields and the
+// image in the image field.
+// The body is streamed, so only the image itself is held in memory. If the
+// form is invalid, the request is aborted with an error and ok is false.
+func readMultipartUpload(c *gin.Context) (request UploadRequest, imageData []byte, ok bool) {
+	reader, err := c.Request.MultipartReader()
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return request, nil, false
+	}
+
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return request, nil, false
+		}
+
+		if part.FormName() == multipartFileField {
+			imageData, err = readLimited(part, maxImageSize)
+		} else {
+			err = readField(part.FormName(), part, &request)
+		}
+		part.Close()
+		if errors.Is(err, errTooLarge) {
+			c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+			return request, nil, false
+		}
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return request, nil, false
+		}
+	}
+	slog.Info("Image upload request", "user", request.User, "guild", request.Guild, "charId", request.CharID, "bytes", len(imageData))
+
+	if imageData == nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing image file"})
+		return request, nil, false
+	}
+	return request, imageData, true
+}
+
+// readField sets the upload request field named name from r. Unknown fields
+// are ignored.
+func readField(name string, r io.Reader, request *UploadRequest) error {
+	data, err := readLimited(r, maxFieldSize)
+	if err != nil {
+		return fmt.Errorf("field %s: %w", name, err)
+	}
+	value := string(data)
+
+	switch name {
+	case "charid":
+		request.CharID = value
+	case "imageid":
+		request.ImageID = value
+	case "callback_url":
+		request.CallbackURL = value
+	case "guild":
+		request.Guild, err = parseDiscordID(name, value)
+	case "user":
+		request.User, err = parseDiscordID(name, value)
+	}
+	return err
+}
+
+// parseDiscordID parses the value of the guild or user field name.
+func parseDiscordID(name, value string) (int, error) {
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a Discord ID", name)
+	}
+	return n, nil
+}
+
+// readLimited reads all of r, returning errTooLarge if it holds more than
+// limit bytes.
+func readLimited(r io.Reader, limit int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > limit {
+		return nil, errTooLarge
+	}
+	return data, nil
+}
@@ -0,0 +1,70 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/checks"
+)
+
+// handleRawUpload saves a new image for the character, taking the image bytes
+// as the request body. The guild, user, image ID, and callback URL are given
+// as query parameters.
+func handleRawUpload(c *gin.Context, cfg *Config) {
+	request := UploadRequest{
+		CharID:      c.Param("charID"),
+		ImageID:     c.Query("imageid"),
+		CallbackURL: c.Query("callback_url"),
+	}
+	for name, field := range map[string]*int{"guild": &request.Guild, "user": &request.User} {
+		value, ok := c.GetQuery(name)
+		if !ok {
+			continue
+		}
+		n, err := parseDiscordID(name, value)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		*field = n
+	}
+	slog.Info("Image upload request", "user", request.User, "guild", request.Guild, "charId", request.CharID, "contentType", c.ContentType())
+	if !allowGuild(c, request.Guild) {
+		return
+	}
+	// Reject a bad character ID before reading the body
+	if !checks.IsValidObjectId(request.CharID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s is not a valid character ID", request.CharID)})
+		return
+	}
+
+	if !strings.HasPrefix(c.ContentType(), "image/") {
+		c.AbortWithStatusJSON(http.StatusUnsupportedMediaType, gin.H{"error": "Content-Type must be an image type"})
+		return
+	}
+	if c.Request.ContentLength > maxImageSize {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": errTooLarge.Error()})
+		return
+	}
+
+	imageData, err := readLimited(c.Request.Body, maxImageSize)
+	if errors.Is(err, errTooLarge) {
+		c.AbortWithStatusJSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(imageData) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "missing image data"})
+		return
+	}
+
+	saveUpload(c, cfg, request, imageData)
+}
@@ -0,0 +1,46 @@
+package routes
+
+import (
+	"log/slog"
+
+	"faceclaimer/storage"
+	"faceclaimer/webhook"
+)
+
+// Recorder keeps a record of stored images, such as an index or database. It
+// is notified after images are saved and deleted.
+//
+// Records are kept up to date on a best-effort basis: the images directory
+// remains the source of truth, and recorder failures are logged rather than
+// failing the request.
+type Recorder interface {
+	// RecordSaved records a newly saved image and its public URL.
+	RecordSaved(meta storage.Meta, url string) error
+	// RecordDeleted removes the records of every image matching the filter.
+	RecordDeleted(f storage.Filter) error
+}
+
+// recordSaved notifies every recorder and event stream of a newly saved
+// image.
+func recordSaved(cfg *Config, meta storage.Meta, url string) {
+	for _, r := range cfg.Recorders {
+		if err := r.RecordSaved(meta, url); err != nil {
+			slog.Warn("Failed to record image", "charId", meta.CharID, "imageId", meta.ID, "error", err)
+		}
+	}
+	if cfg.events != nil {
+		cfg.events.publish(webhook.ImageEvent(meta, url))
+	}
+}
+
+// recordDeleted notifies every recorder and event stream of deleted images.
+func recordDeleted(cfg *Config, f storage.Filter) {
+	for _, r := range cfg.Recorders {
+		if err := r.RecordDeleted(f); err != nil {
+			slog.Warn("Failed to record image deletion", "filter", f, "error", err)
+		}
+	}
+	if cfg.events != nil {
+		cfg.events.publish(webhook.DeleteEvent(f))
+	}
+}
@@ -0,0 +1,106 @@
+package routes
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/storage"
+)
+
+// RevisionInfo describes a previous version of an image.
+type RevisionInfo struct {
+	Revision int          `json:"revision"`
+	URL      string       `json:"url"`
+	Meta     storage.Meta `json:"metadata"`
+}
+
+// handleRevisionList lists an image's previous revisions, most recent first.
+// The image param is the bare image ID.
+func handleRevisionList(c *gin.Context, cfg *Config) {
+	img, ok := lookupImage(c, cfg, "")
+	if !ok {
+		return
+	}
+
+	revisions, err := storage.Revisions(img.Path)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	infos := make([]RevisionInfo, 0, len(revisions))
+	for _, rev := range revisions {
+		revImg := img
+		revImg.Path = rev.Path
+		meta, err := cfg.Dirs().LoadMeta(revImg)
+		if err != nil {
+			// The revision may have been renumbered since it was listed
+			slog.Warn("Failed to read revision", "path", rev.Path, "error", err)
+			continue
+		}
+		parts := img.Parts(cfg.Layout)
+		parts[len(parts)-1] = filepath.Base(rev.Path)
+		infos = append(infos, RevisionInfo{Revision: rev.N, URL: imageURL(cfg, parts), Meta: meta})
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
+
+// handleRevisionRestore makes a previous revision of an image current again.
+// The current version is kept as the most recent revision. The image param
+// is the bare image ID.
+func handleRevisionRestore(c *gin.Context, cfg *Config) {
+	n, err := strconv.Atoi(c.Param("revision"))
+	if err != nil || n < 1 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid revision"})
+		return
+	}
+	img, ok := lookupImage(c, cfg, "")
+	if !ok {
+		return
+	}
+	slog.Info("Revision restore request", "charId", img.CharID, "imageId", img.ID, "revision", n)
+
+	meta, err := restoreRevision(cfg, img, n)
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Revision not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, meta)
+}
+
+// restoreRevision makes revision n of a stored image current, then updates
+// its metadata and records.
+func restoreRevision(cfg *Config, img storage.Image, n int) (storage.Meta, error) {
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	// Always keep the current version, so that a restore can be undone
+	if err := storage.RestoreRevision(cfg.Dirs(), img.Path, n, max(cfg.Revisions, 1)); err != nil {
+		return storage.Meta{}, err
+	}
+
+	meta, err := cfg.Dirs().LoadMeta(img)
+	if err != nil {
+		return storage.Meta{}, err
+	}
+	meta.Modified = time.Now().UTC()
+	if err := cfg.Dirs().WriteMeta(img.Path, meta); err != nil {
+		slog.Warn("Failed to write image metadata", "path", img.Path, "error", err)
+	}
+	recordSaved(cfg, meta, imageURL(cfg, img.Parts(cfg.Layout)))
+
+	return meta, nil
+}
@@ -2,6 +2,7 @@ package routes
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -16,14 +18,71 @@ import (
 	"github.com/gin-gonic/gin"
 	"go.mongodb.org/mongo-driver/bson/primitive"
 
+	"faceclaimer/auth"
 	"faceclaimer/checks"
 	"faceclaimer/convert"
+	"faceclaimer/index"
+	"faceclaimer/storage"
+	"faceclaimer/webhook"
 )
 
 type Config struct {
 	ImagesDir string
-	BaseURL   string
-	Quality   int
+	// MetaDir holds each image's metadata, mirroring ImagesDir. It must be
+	// outside ImagesDir so that it's never served. If empty, no metadata is
+	// kept.
+	MetaDir string
+	BaseURL string
+	Quality int
+	Layout  storage.Layout
+	// Index, if set, answers statistics queries. It should also be included
+	// in Recorders so that it's kept up to date.
+	Index *index.Index
+	// Recorders are notified as images are saved and deleted.
+	Recorders []Recorder
+	// TrashRetention is how long deleted images are kept in the trash before
+	// being purged. If zero, deletes are permanent.
+	TrashRetention time.Duration
+	// Revisions is the number of previous versions of each image kept when
+	// it's replaced or edited.
+	Revisions int
+	// JobWorkers is the number of asynchronous uploads processed
+	// concurrently. If zero, asynchronous uploads are disabled.
+	JobWorkers int
+	// Webhooks, if set, delivers upload callbacks. It should also be included
+	// in Recorders if it has a URL for every image change.
+	Webhooks *webhook.Notifier
+	// IdempotencyTTL is how long the responses to uploads with an
+	// Idempotency-Key are kept. If zero, the header is ignored.
+	IdempotencyTTL time.Duration
+	// Keys, if set, are the API keys allowed to make requests. If nil, no
+	// authentication is required.
+	Keys *auth.Keyring
+	// Signatures, if set, verifies requests signed with a shared secret,
+	// which are accepted in place of an API key. Mutating requests must be
+	// signed if Keys is nil.
+	Signatures *auth.Verifier
+	// URLSigner, if set, signs expiring image URLs, which are served to anyone
+	// holding one. If nil, signed URLs are disabled.
+	URLSigner *auth.URLSigner
+	// APIURL is this server's public URL, which signed URLs point to.
+	APIURL string
+	// TLSCert and TLSKey, if set, are the certificate and key files to serve
+	// HTTPS with. They're reloaded when changed.
+	TLSCert string
+	TLSKey  string
+	// ClientCA, if set, is the CA file client certificates must be signed by.
+	// Every request needs one, except for signed URLs. It requires TLSCert.
+	ClientCA string
+
+	jobs        *jobQueue
+	events      *eventHub
+	idempotency *idempotencyStore
+}
+
+// Dirs returns the directories images and their metadata are stored in.
+func (cfg *Config) Dirs() storage.Dirs {
+	return storage.Dirs{Images: cfg.ImagesDir, Meta: cfg.MetaDir}
 }
 
 type UploadRequest struct {
@@ -31,6 +90,21 @@ type UploadRequest struct {
 	User     int    `json:"user"`
 	CharID   string `json:"charid"`
 	ImageURL string `json:"image_url"`
+	// ImageID, if set, is the ID to save the image as, rather than a new one.
+	ImageID string `json:"imageid"`
+	// CallbackURL, if set, is sent an image.created event once the image is
+	// saved.
+	CallbackURL string `json:"callback_url"`
+}
+
+// ImageInfo describes a stored image.
+type ImageInfo struct {
+	ID      string    `json:"id"`
+	URL     string    `json:"url"`
+	Size    int64     `json:"size"`
+	Width   int       `json:"width"`
+	Height  int       `json:"height"`
+	Created time.Time `json:"created"`
 }
 
 // setupRouter sets up gin's route handlers.
@@ -42,74 +116,395 @@ func setupRouter(cfg *Config) *gin.Engine {
 		r = gin.Default()
 	}
 	r.SetTrustedProxies(nil)
-	r.POST("/image/upload", func(c *gin.Context) {
+	if cfg.JobWorkers > 0 && cfg.jobs == nil {
+		cfg.jobs = newJobQueue(cfg, cfg.JobWorkers)
+	}
+	if cfg.events == nil {
+		cfg.events = newEventHub()
+	}
+	if cfg.IdempotencyTTL > 0 && cfg.idempotency == nil {
+		cfg.idempotency = newIdempotencyStore(cfg.IdempotencyTTL)
+	}
+	// Signed URLs carry their own authorization, so are registered before
+	// authentication
+	r.GET("/signed/:charID/:image", func(c *gin.Context) {
+		handleSignedImage(c, cfg)
+	})
+	r.Use(requireClientCert(cfg), authenticate(cfg))
+	r.POST("/image/upload", require(auth.ScopeUpload), idempotent(cfg), func(c *gin.Context) {
 		handleImageUpload(c, cfg)
 	})
-	r.DELETE("/image/*imagePath", func(c *gin.Context) {
+	r.POST("/image/upload/batch", require(auth.ScopeUpload), idempotent(cfg), func(c *gin.Context) {
+		handleBatchUpload(c, cfg)
+	})
+	r.GET("/image/:charID/:image", require(auth.ScopeRead), func(c *gin.Context) {
+		handleImageMeta(c, cfg)
+	})
+	r.PUT("/image/:charID/:image", require(auth.ScopeUpload), func(c *gin.Context) {
+		handleImageReplace(c, cfg)
+	})
+	r.POST("/image/:charID/:image/rotate", require(auth.ScopeUpload), func(c *gin.Context) {
+		handleImageRotate(c, cfg)
+	})
+	r.POST("/image/:charID/:image/sign", require(auth.ScopeRead), func(c *gin.Context) {
+		handleImageSign(c, cfg)
+	})
+	r.POST("/image/:charID/:image/move", require(auth.ScopeUpload), func(c *gin.Context) {
+		handleImageMove(c, cfg)
+	})
+	r.POST("/image/:charID/:image/copy", require(auth.ScopeUpload), func(c *gin.Context) {
+		handleImageCopy(c, cfg)
+	})
+	r.GET("/image/:charID/:image/revisions", require(auth.ScopeRead), func(c *gin.Context) {
+		handleRevisionList(c, cfg)
+	})
+	r.POST("/image/:charID/:image/revisions/:revision/restore", require(auth.ScopeUpload), func(c *gin.Context) {
+		handleRevisionRestore(c, cfg)
+	})
+	r.DELETE("/image/*imagePath", require(auth.ScopeDelete), func(c *gin.Context) {
 		handleSingleDelete(c, cfg)
 	})
-	r.DELETE("/character/:charID", func(c *gin.Context) {
+	r.GET("/character/:charID", require(auth.ScopeRead), func(c *gin.Context) {
+		handleCharacterList(c, cfg)
+	})
+	r.PUT("/character/:charID/images", require(auth.ScopeUpload), idempotent(cfg), func(c *gin.Context) {
+		handleRawUpload(c, cfg)
+	})
+	r.POST("/character/:charID/copy", require(auth.ScopeUpload), func(c *gin.Context) {
+		handleCharacterCopy(c, cfg)
+	})
+	r.DELETE("/character/:charID", require(auth.ScopeDelete), func(c *gin.Context) {
 		handleCharacterDelete(c, cfg)
 	})
+	r.DELETE("/guild/:guildID", require(auth.ScopeDelete), func(c *gin.Context) {
+		handleGuildDelete(c, cfg)
+	})
+	r.DELETE("/user/:userID", require(auth.ScopeDelete), func(c *gin.Context) {
+		handleUserDelete(c, cfg)
+	})
+	r.GET("/stats", require(auth.ScopeRead), func(c *gin.Context) {
+		handleStats(c, cfg)
+	})
+	r.GET("/events", require(auth.ScopeRead), func(c *gin.Context) {
+		handleEvents(c, cfg)
+	})
+	r.GET("/jobs/:id", require(auth.ScopeRead), func(c *gin.Context) {
+		handleJobStatus(c, cfg)
+	})
+	r.GET("/trash", require(auth.ScopeAdmin), func(c *gin.Context) {
+		handleTrashList(c, cfg)
+	})
+	r.POST("/trash/:batch/restore", require(auth.ScopeAdmin), func(c *gin.Context) {
+		handleTrashRestore(c, cfg)
+	})
 
 	return r
 }
 
+// handleImageUpload saves a new image, either downloaded from the URL in a
+// JSON request, or uploaded directly as multipart/form-data. With
+// ?async=true, the image is saved in the background.
 func handleImageUpload(c *gin.Context, cfg *Config) {
 	var request UploadRequest
-	if err := c.BindJSON(&request); err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var imageData []byte
+	if c.ContentType() == "multipart/form-data" {
+		var ok bool
+		if request, imageData, ok = readMultipartUpload(c); !ok {
+			return
+		}
+	} else {
+		if err := c.BindJSON(&request); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		slog.Info("Image upload request", "user", request.User, "guild", request.Guild, "charId", request.CharID)
+
+		if !checks.IsValidURL(request.ImageURL) {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid image URL"})
+			return
+		}
+	}
+
+	if !allowGuild(c, request.Guild) {
 		return
 	}
-	slog.Info("Image upload request", "user", request.User, "guild", request.Guild, "charId", request.CharID)
 
-	if !checks.IsValidURL(request.ImageURL) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid image URL"})
+	if c.Query("async") == "true" {
+		queueUpload(c, cfg, request, imageData)
 		return
 	}
 
+	if imageData == nil {
+		var ok bool
+		if imageData, ok = downloadImage(c, request.ImageURL); !ok {
+			return
+		}
+	}
+
+	saveUpload(c, cfg, request, imageData)
+}
+
+// saveUpload converts and saves the image data for an upload request, and
+// responds with its URL.
+func saveUpload(c *gin.Context, cfg *Config, request UploadRequest, imageData []byte) {
+	url, status, err := saveImage(cfg, request, imageData)
+	if err != nil {
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(status, url)
+}
+
+// saveImage converts and saves the image data for an upload request,
+// returning its URL. The status is the HTTP status describing the outcome.
+func saveImage(cfg *Config, request UploadRequest, imageData []byte) (url string, status int, err error) {
+	// We need the image name and the save location separately so we can construct
+	// the URL to return to the user.
+	if err := checkCallback(cfg, request); err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	imageNameParts, err := prepImageNameParts(request, cfg.Layout)
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	saveLoc := filepath.Join(append([]string{cfg.ImagesDir}, imageNameParts...)...)
+	err = checkImageID(cfg, request)
+	var info convert.Info
+	if err == nil {
+		info, err = convert.SaveWebP(imageData, saveLoc, cfg.Quality)
+	}
+	if errors.Is(err, os.ErrExist) {
+		return "", http.StatusConflict, fmt.Errorf("image %s already exists", request.ImageID)
+	}
+	if err != nil {
+		return "", http.StatusInternalServerError, err
+	}
+
+	meta := newMeta(request, imageNameParts, info)
+	if err := cfg.Dirs().WriteMeta(saveLoc, meta); err != nil {
+		slog.Warn("Failed to write image metadata", "path", saveLoc, "error", err)
+	}
+
+	url = imageURL(cfg, imageNameParts)
+	recordSaved(cfg, meta, url)
+	if request.CallbackURL != "" {
+		cfg.Webhooks.Send(request.CallbackURL, webhook.ImageEvent(meta, url))
+	}
+
+	return url, http.StatusCreated, nil
+}
+
+// checkImageID returns an error satisfying errors.Is(err, os.ErrExist) if the
+// upload request names an image ID already in use by any character. IDs must
+// be unique, as some records, such as MongoDB's, are keyed by them alone.
+func checkImageID(cfg *Config, request UploadRequest) error {
+	if request.ImageID == "" {
+		return nil
+	}
+	_, found, err := cfg.Layout.FindImage(cfg.ImagesDir, request.CharID, request.ImageID)
+	if err == nil && !found {
+		found, err = imageIDExists(cfg, request.ImageID)
+	}
+	if err != nil {
+		return err
+	}
+	if found {
+		return fmt.Errorf("image %s: %w", request.ImageID, os.ErrExist)
+	}
+	return nil
+}
+
+// imageIDExists returns true if any character has an image with the ID. The
+// index answers this if there is one; otherwise every image is listed.
+func imageIDExists(cfg *Config, imageID string) (bool, error) {
+	if cfg.Index != nil {
+		metas, err := cfg.Index.Find(storage.Filter{ImageID: imageID})
+		return len(metas) > 0, err
+	}
+	images, err := cfg.Layout.Images(cfg.ImagesDir)
+	if err != nil {
+		return false, err
+	}
+	for _, img := range images {
+		if img.ID == imageID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// checkCallback validates an upload request's callback URL, if it has one.
+func checkCallback(cfg *Config, request UploadRequest) error {
+	if request.CallbackURL == "" {
+		return nil
+	}
+	if cfg.Webhooks == nil {
+		return errors.New("callbacks are disabled")
+	}
+	if !checks.IsValidURL(request.CallbackURL) {
+		return errors.New("invalid callback URL")
+	}
+	return nil
+}
+
+// maxImageSize is the largest image accepted, in bytes. Discord Nitro users
+// can upload up to 500MB, but anyone doing that with images is clearly insane,
+// and we're being generous with a 100MB limit.
+const maxImageSize = 100 * 1024 * 1024
+
+// errDownloadFailed reports that an image couldn't be fetched from its URL.
+var errDownloadFailed = errors.New("failed to download image")
+
+// downloadImage downloads the image at url. If the download fails, the
+// request is aborted with an error and ok is false.
+func downloadImage(c *gin.Context, url string) (data []byte, ok bool) {
+	imageData, err := fetchImage(url)
+	if errors.Is(err, errDownloadFailed) {
+		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return imageData, true
+}
+
+// fetchImage downloads the image at url. If it can't be fetched, the error is
+// errDownloadFailed.
+func fetchImage(url string) ([]byte, error) {
 	// Download the image from the remote w/ timeout and size limit
 	client := &http.Client{
 		Timeout: 30 * time.Second,
 	}
-	resp, err := client.Get(request.ImageURL)
-	if err != nil || resp.StatusCode != http.StatusOK {
-		c.AbortWithStatusJSON(http.StatusBadGateway, gin.H{"error": "failed to download image"})
-		return
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, errDownloadFailed
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errDownloadFailed
+	}
 
-	// Discord Nitro users can upload up to 500MB, but anyone doing that with
-	// images is clearly insane, and we're being generous with a 100MB limit.
-	limitedReader := io.LimitReader(resp.Body, 100*1024*1024)
+	limitedReader := io.LimitReader(resp.Body, maxImageSize)
 	imageData, err := io.ReadAll(limitedReader)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return nil, err
+	}
+	slog.Info("Downloaded image data", "url", url)
+
+	return imageData, nil
+}
+
+// imageURL returns the public URL for an image's path components. The web URL
+// doesn't include the images directory. That way, we can place the images at
+// root, e.g. https://example.com/guildId/userId/charId/imageId.webp
+func imageURL(cfg *Config, parts []string) string {
+	webRoot := strings.Trim(cfg.BaseURL, "/")
+	return strings.Join([]string{webRoot, strings.Join(parts, "/")}, "/")
+}
+
+// handleCharacterList lists all of a character's images.
+func handleCharacterList(c *gin.Context, cfg *Config) {
+	charID := c.Param("charID")
+
+	if !checks.IsValidObjectId(charID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid character ID"})
+		return
+	}
+	if !allowCharacter(c, cfg, charID) {
 		return
 	}
-	slog.Info("Downloaded image data", "url", request.ImageURL)
 
-	// We need the image name and the save location separately so we can construct
-	// the URL to return to the user.
-	imageNameParts, err := prepImageNameParts(request)
+	images, err := cfg.Layout.CharImages(cfg.ImagesDir, charID)
 	if err != nil {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
-	saveLoc := filepath.Join(append([]string{cfg.ImagesDir}, imageNameParts...)...)
-	err = convert.SaveWebP(imageData, saveLoc, cfg.Quality)
+
+	infos := make([]ImageInfo, 0, len(images))
+	for _, img := range images {
+		info, err := imageInfo(cfg, img)
+		if err != nil {
+			// The image may have been deleted since it was listed
+			slog.Warn("Failed to read image", "path", img.Path, "error", err)
+			continue
+		}
+		infos = append(infos, info)
+	}
+
+	c.JSON(http.StatusOK, infos)
+}
+
+// handleImageMeta returns the stored metadata for a single image. The image
+// param must be in the form imageId.json.
+func handleImageMeta(c *gin.Context, cfg *Config) {
+	img, ok := lookupImage(c, cfg, ".json")
+	if !ok {
+		return
+	}
+
+	meta, err := cfg.Dirs().LoadMeta(img)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	// The web URL doesn't include the images directory. That way, we can place
-	// the images at root, e.g. https://example.com/guildId/userId/charId/imageId.webp
-	imageURL := strings.Join(imageNameParts, "/")
-	webRoot := strings.Trim(cfg.BaseURL, "/")
-	imageURL = strings.Join([]string{webRoot, imageURL}, "/")
+	c.JSON(http.StatusOK, meta)
+}
 
-	c.JSON(http.StatusCreated, imageURL)
+// lookupImage finds the image named by the charID and image params, where the
+// image param must be imageId followed by ext. If the image can't be found,
+// the request is aborted with an error and ok is false.
+func lookupImage(c *gin.Context, cfg *Config, ext string) (img storage.Image, ok bool) {
+	charID := c.Param("charID")
+	imageID, ok := strings.CutSuffix(c.Param("image"), ext)
+	if !ok {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return storage.Image{}, false
+	}
+	if !checks.IsValidObjectId(charID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid character ID"})
+		return storage.Image{}, false
+	}
+	if !checks.IsValidObjectId(imageID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid image ID"})
+		return storage.Image{}, false
+	}
+
+	img, found, err := cfg.Layout.FindImage(cfg.ImagesDir, charID, imageID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return storage.Image{}, false
+	}
+	if !found {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Image not found"})
+		return storage.Image{}, false
+	}
+	if !allowImage(c, cfg, img) {
+		return storage.Image{}, false
+	}
+	return img, true
+}
+
+// imageInfo reads an image's size and dimensions from disk.
+func imageInfo(cfg *Config, img storage.Image) (ImageInfo, error) {
+	stat, err := os.Stat(img.Path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	config, _, err := convert.ReadConfig(img.Path)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	return ImageInfo{
+		ID:      img.ID,
+		URL:     imageURL(cfg, img.Parts(cfg.Layout)),
+		Size:    stat.Size(),
+		Width:   config.Width,
+		Height:  config.Height,
+		Created: img.Created(),
+	}, nil
 }
 
 // cleanEmptyDirs recursively deletes empty directories within baseDir.
@@ -148,6 +543,19 @@ func cleanEmptyDirs(baseDir string) error {
 	return nil
 }
 
+// cleanStorageDirs deletes empty directories left behind in the images and
+// metadata directories.
+func cleanStorageDirs(cfg *Config) {
+	for _, dir := range []string{cfg.ImagesDir, cfg.MetaDir} {
+		if dir == "" {
+			continue
+		}
+		if err := cleanEmptyDirs(dir); err != nil {
+			slog.Warn("Failed to clean empty directories", "dir", dir, "error", err)
+		}
+	}
+}
+
 // handleSingleDelete performs a single image deletion.
 func handleSingleDelete(c *gin.Context, cfg *Config) {
 	// We keep imagePath separate from loc, for the return value
@@ -166,14 +574,24 @@ func handleSingleDelete(c *gin.Context, cfg *Config) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot delete directory"})
 		return
 	}
-	if err := os.Remove(imageLoc); err != nil {
-		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if storage.InTrash(imagePath) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot delete from trash"})
 		return
 	}
-
-	if err := cleanEmptyDirs(cfg.ImagesDir); err != nil {
-		slog.Warn("Failed to clean empty directories", "error", err)
+	if img, ok := cfg.Layout.ParsePath(imagePath); ok {
+		img.Path = imageLoc
+		if !allowImage(c, cfg, img) {
+			return
+		}
+	} else if !allowAllGuilds(c) {
+		return
 	}
+	batch, err := removeImage(cfg, imageLoc, imagePath, permanent(c))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	setTrashBatch(c, batch)
 
 	c.JSON(http.StatusOK, fmt.Sprintf("Deleted %s", imagePath))
 }
@@ -186,66 +604,350 @@ func handleCharacterDelete(c *gin.Context, cfg *Config) {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid character ID"})
 		return
 	}
+	if !allowCharacter(c, cfg, charID) {
+		return
+	}
+
+	batch, err := deleteCharacter(cfg, charID, permanent(c))
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Character directory not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	setTrashBatch(c, batch)
+	c.JSON(http.StatusOK, fmt.Sprintf("Deleted all images: %s", charID))
+}
+
+// DeleteCharacter deletes all of a character's images, moving them to the
+// trash if it's enabled. If the character has no images, the error satisfies
+// errors.Is(err, os.ErrNotExist).
+func (cfg *Config) DeleteCharacter(charID string) error {
+	_, err := deleteCharacter(cfg, charID, false)
+	return err
+}
+
+// DeleteImage deletes a single image, moving it to the trash if it's enabled.
+// If the image doesn't exist, the error satisfies
+// errors.Is(err, os.ErrNotExist).
+func (cfg *Config) DeleteImage(charID, imageID string) error {
+	img, ok, err := cfg.Layout.FindImage(cfg.ImagesDir, charID, imageID)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("image %s/%s: %w", charID, imageID, os.ErrNotExist)
+	}
+	_, err = removeImage(cfg, img.Path, filepath.Join(img.Parts(cfg.Layout)...), false)
+	return err
+}
+
+// deleteCharacter deletes all of a character's images, returning the trash
+// batch they were moved to, if any.
+func deleteCharacter(cfg *Config, charID string, permanent bool) (string, error) {
+	charPaths, err := cfg.Layout.CharDirs(cfg.ImagesDir, charID)
+	if err != nil {
+		return "", err
+	}
+	if len(charPaths) == 0 {
+		return "", fmt.Errorf("character %s: %w", charID, os.ErrNotExist)
+	}
+
+	deleted := storage.Filter{CharID: charID}
+	deleted.Guild, deleted.User = characterOwner(cfg, charID)
+
+	batch, err := removeDirs(cfg, charPaths, permanent)
+	if err != nil {
+		return "", err
+	}
+	recordDeleted(cfg, deleted)
+	return batch, nil
+}
+
+// characterOwner returns the guild and user a character's images belong to,
+// or zero for either if they're unknown or the images disagree.
+func characterOwner(cfg *Config, charID string) (guild, user int) {
+	images, err := cfg.Layout.CharImages(cfg.ImagesDir, charID)
+	if err != nil {
+		return 0, 0
+	}
+	for i, img := range images {
+		g, u := imageOwner(cfg, img)
+		if i == 0 {
+			guild, user = g, u
+			continue
+		}
+		if g != guild {
+			guild = 0
+		}
+		if u != user {
+			user = 0
+		}
+	}
+	return guild, user
+}
+
+// CharImages returns every image belonging to a character.
+func (cfg *Config) CharImages(charID string) ([]storage.Image, error) {
+	return cfg.Layout.CharImages(cfg.ImagesDir, charID)
+}
+
+// removeImage deletes the file at imageLoc, along with its metadata and
+// previous revisions, and cleans up any directories left empty. imagePath is
+// imageLoc relative to the images directory. Unless permanent is set, the
+// files are moved to the trash, if it's enabled, and the trash batch is
+// returned.
+func removeImage(cfg *Config, imageLoc, imagePath string, permanent bool) (string, error) {
+	// Files that go with the image: its metadata and previous revisions
+	var related []string
+	if metaPath := cfg.Dirs().MetaPath(imageLoc); metaPath != "" && strings.HasSuffix(imageLoc, ".webp") {
+		related = append(related, metaPath)
+	}
+	img, isImage := cfg.Layout.ParsePath(imagePath)
+	deleted := storage.Filter{CharID: img.CharID, ImageID: img.ID}
+	if isImage {
+		// Record the owner before the metadata goes, so that event streams
+		// filtered by guild or user see the delete
+		img.Path = imageLoc
+		deleted.Guild, deleted.User = imageOwner(cfg, img)
+		revisions, err := storage.RevisionFiles(cfg.Dirs(), imageLoc)
+		if err != nil {
+			return "", err
+		}
+		related = append(related, revisions...)
+	}
+
+	var batch string
+	if useTrash(cfg, permanent) {
+		var err error
+		if batch, err = storage.MoveToTrash(cfg.Dirs(), append([]string{imageLoc}, related...), time.Now()); err != nil {
+			return "", err
+		}
+	} else {
+		if err := os.Remove(imageLoc); err != nil {
+			return "", err
+		}
+		for _, path := range related {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				slog.Warn("Failed to delete image file", "path", path, "error", err)
+			}
+		}
+	}
+	if isImage {
+		recordDeleted(cfg, deleted)
+	}
+
+	cleanStorageDirs(cfg)
+	return batch, nil
+}
+
+// handleGuildDelete deletes all images belonging to a guild. It requires the
+// hierarchical layout.
+func handleGuildDelete(c *gin.Context, cfg *Config) {
+	guildID := c.Param("guildID")
+
+	if !checks.IsValidDiscordID(guildID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid guild ID"})
+		return
+	}
+	guild, _ := strconv.Atoi(guildID)
+	if !allowGuild(c, guild) {
+		return
+	}
 
-	charPath, err := checks.AbsPath(cfg.ImagesDir, charID)
+	guildPath, err := cfg.Layout.GuildDir(cfg.ImagesDir, guildID)
 	if err != nil {
 		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	if !checks.DirExists(guildPath) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Guild directory not found"})
+		return
+	}
 
-	if !checks.PathExists(charPath) {
-		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Character directory not found"})
+	batch, err := removeDirs(cfg, []string{guildPath}, permanent(c))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	recordDeleted(cfg, storage.Filter{Guild: guild})
+	setTrashBatch(c, batch)
+
+	c.JSON(http.StatusOK, fmt.Sprintf("Deleted all guild images: %s", guildID))
+}
+
+// handleUserDelete deletes all images belonging to a user, across every guild.
+// It requires the hierarchical layout.
+func handleUserDelete(c *gin.Context, cfg *Config) {
+	userID := c.Param("userID")
+
+	if !checks.IsValidDiscordID(userID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+		return
+	}
+	if !allowAllGuilds(c) {
+		return
+	}
+
+	userPaths, err := cfg.Layout.UserDirs(cfg.ImagesDir, userID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(userPaths) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "User directory not found"})
 		return
 	}
 
-	slog.Info("Deleting", "path", charPath)
-	if err = os.RemoveAll(charPath); err != nil {
+	batch, err := removeDirs(cfg, userPaths, permanent(c))
+	if err != nil {
 		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	user, _ := strconv.Atoi(userID)
+	recordDeleted(cfg, storage.Filter{User: user})
+	setTrashBatch(c, batch)
+
+	c.JSON(http.StatusOK, fmt.Sprintf("Deleted all user images: %s", userID))
+}
 
-	if err := cleanEmptyDirs(cfg.ImagesDir); err != nil {
-		slog.Warn("Failed to clean empty directories", "error", err)
+// removeDirs deletes each directory in paths, then cleans up any parent
+// directories left empty. Every path must be inside cfg.ImagesDir. Unless
+// permanent is set, the directories are moved to the trash, if it's enabled,
+// and the trash batch is returned.
+func removeDirs(cfg *Config, paths []string, permanent bool) (string, error) {
+	absPaths := make([]string, 0, len(paths))
+	for _, path := range paths {
+		rel, err := filepath.Rel(cfg.ImagesDir, path)
+		if err != nil {
+			return "", err
+		}
+		if rel == "." {
+			return "", errors.New("refusing to delete the images directory")
+		}
+		absPath, err := checks.AbsPath(cfg.ImagesDir, rel)
+		if err != nil {
+			return "", err
+		}
+		absPaths = append(absPaths, absPath)
+		// The metadata mirrors the images directory, so goes with it
+		if metaPath := cfg.Dirs().MetaMirror(absPath); metaPath != "" {
+			absPaths = append(absPaths, metaPath)
+		}
 	}
 
-	c.JSON(http.StatusOK, fmt.Sprintf("Deleted all images: %s", charID))
+	var batch string
+	if useTrash(cfg, permanent) {
+		slog.Info("Moving to trash", "paths", absPaths)
+		var err error
+		if batch, err = storage.MoveToTrash(cfg.Dirs(), absPaths, time.Now()); err != nil {
+			return "", err
+		}
+	} else {
+		for _, absPath := range absPaths {
+			slog.Info("Deleting", "path", absPath)
+			if err := os.RemoveAll(absPath); err != nil {
+				return "", err
+			}
+		}
+	}
+
+	cleanStorageDirs(cfg)
+	return batch, nil
 }
 
 // prepImageNameParts generates path components for a new image upload.
-// It returns a slice containing [guild, user, charID, imageID.webp] that can be
-// used with filepath.Join for OS-specific file paths or strings.Join for URLs.
-// The function validates that CharID is a valid MongoDB ObjectID and generates
-// a unique ObjectID for the image filename.
-func prepImageNameParts(r UploadRequest) ([]string, error) {
+// It returns a slice containing [charID, imageID.webp], or
+// [guild, user, charID, imageID.webp] under the hierarchical layout, that can
+// be used with filepath.Join for OS-specific file paths or strings.Join for
+// URLs. The function validates that CharID is a valid MongoDB ObjectID and
+// generates a unique ObjectID for the image filename.
+func prepImageNameParts(r UploadRequest, layout storage.Layout) ([]string, error) {
 	if !checks.IsValidObjectId(r.CharID) {
 		return nil, fmt.Errorf("%s is not a valid character ID", r.CharID)
 	}
+	if layout.UsesOwners() && (r.Guild <= 0 || r.User <= 0) {
+		return nil, fmt.Errorf("guild and user are required by the %s layout", layout)
+	}
+	imageID := r.ImageID
+	if imageID == "" {
+		imageID = primitive.NewObjectID().Hex()
+	} else if !checks.IsValidObjectId(imageID) {
+		return nil, fmt.Errorf("%s is not a valid image ID", imageID)
+	}
 	charId := fmt.Sprint(r.CharID)
-	imageName := fmt.Sprintf("%s.webp", primitive.NewObjectID().Hex())
-	return []string{charId, imageName}, nil
+	imageName := fmt.Sprintf("%s.webp", imageID)
+	return layout.Parts(r.Guild, r.User, charId, imageName), nil
 }
 
-// Run starts the HTTP server with the given configuration.
-func Run(baseURL, imagesDir string, port, quality int) {
-	cfg := &Config{
-		ImagesDir: imagesDir,
-		BaseURL:   strings.TrimSuffix(baseURL, "/"),
-		Quality:   quality,
+// newMeta builds the metadata record for a newly saved image.
+func newMeta(r UploadRequest, parts []string, info convert.Info) storage.Meta {
+	imageID := strings.TrimSuffix(parts[len(parts)-1], ".webp")
+	mode := storage.ModeLossy
+	if info.Lossless {
+		mode = storage.ModeLossless
+	}
+	return storage.Meta{
+		ID:           imageID,
+		CharID:       r.CharID,
+		Guild:        r.Guild,
+		User:         r.User,
+		SourceURL:    r.ImageURL,
+		SourceFormat: info.SourceFormat,
+		SourceWidth:  info.SourceWidth,
+		SourceHeight: info.SourceHeight,
+		Width:        info.Width,
+		Height:       info.Height,
+		Size:         info.Size,
+		Quality:      info.Quality,
+		Mode:         mode,
+		Hash:         info.Hash,
+		Uploaded:     time.Now().UTC(),
 	}
+}
+
+// Run starts the HTTP server with the given configuration, serving HTTPS if
+// it has a certificate.
+func Run(cfg *Config, port int) error {
+	cfg.BaseURL = strings.TrimSuffix(cfg.BaseURL, "/")
+	cfg.APIURL = strings.TrimSuffix(cfg.APIURL, "/")
 
 	// Create context that listens for SIGINT/SIGTERM
 	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	defer stop()
 
+	if cfg.TrashRetention > 0 {
+		go purgeTrash(ctx, cfg)
+	}
+
 	r := setupRouter(cfg)
 	srv := &http.Server{
 		Addr:    fmt.Sprintf(":%d", port),
 		Handler: r,
 	}
+	if cfg.TLSCert != "" {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey, cfg.ClientCA)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = certs.tlsConfig()
+	}
+	// Event streams never finish on their own, so end them when shutting down
+	srv.RegisterOnShutdown(cfg.events.close)
 
 	// Initialize in goroutine so it won't block graceful shutdown
 	go func() {
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		var err error
+		if srv.TLSConfig != nil {
+			// The certificate comes from TLSConfig
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
 			slog.Error("unable to listen", "err", err)
 			return
 		}
@@ -264,4 +966,5 @@ func Run(baseURL, imagesDir string, port, quality int) {
 	if err := srv.Shutdown(ctx); err != nil {
 		slog.Error("server forced to shut down", "err", err)
 	}
+	return nil
 }
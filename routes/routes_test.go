@@ -1,18 +1,45 @@
 package routes
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math/big"
+	"mime/multipart"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"faceclaimer/auth"
 	"faceclaimer/checks"
+	"faceclaimer/convert"
+	"faceclaimer/index"
+	"faceclaimer/storage"
+	"faceclaimer/webhook"
 )
 
 func init() {
@@ -20,6 +47,46 @@ func init() {
 	gin.SetMode(gin.TestMode)
 }
 
+// testPNG returns an encoded PNG of the given dimensions.
+func testPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for x := 0; x < width; x++ {
+		for y := 0; y < height; y++ {
+			img.Set(x, y, color.RGBA{uint8(x * 255 / width), uint8(y * 255 / height), 128, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatalf("Failed to encode PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// saveTestImage writes a real WebP image of the given dimensions to
+// imagesDir/parts and returns its path.
+func saveTestImage(t *testing.T, imagesDir string, width, height int, parts ...string) string {
+	t.Helper()
+	path := filepath.Join(append([]string{imagesDir}, parts...)...)
+	if _, err := convert.SaveWebP(testPNG(t, width, height), path, 90); err != nil {
+		t.Fatalf("Failed to save test image: %v", err)
+	}
+	return path
+}
+
+// imageServer starts a server that responds to every request with a PNG of
+// the given dimensions.
+func imageServer(t *testing.T, width, height int) *httptest.Server {
+	t.Helper()
+	data := testPNG(t, width, height)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
 func TestCleanEmptyDirs(t *testing.T) {
 	// Create a temporary base directory
 	baseDir, err := os.MkdirTemp("", "test-clean-empty-*")
@@ -205,7 +272,7 @@ func TestPrepImageName(t *testing.T) {
 			CharID: "507f1f77bcf86cd799439011",
 		}
 
-		parts, err := prepImageNameParts(req)
+		parts, err := prepImageNameParts(req, storage.Flat)
 		if err != nil {
 			t.Errorf("prepImageNameParts failed: %v", err)
 		}
@@ -239,7 +306,7 @@ func TestPrepImageName(t *testing.T) {
 			CharID: "invalid-not-objectid",
 		}
 
-		_, err := prepImageNameParts(req)
+		_, err := prepImageNameParts(req, storage.Flat)
 		if err == nil {
 			t.Error("Expected error for invalid CharID")
 		}
@@ -255,7 +322,7 @@ func TestPrepImageName(t *testing.T) {
 			CharID: "507f1f77bcf86cd799439011",
 		}
 
-		parts, err := prepImageNameParts(req)
+		parts, err := prepImageNameParts(req, storage.Flat)
 		if err != nil {
 			t.Errorf("prepImageNameParts failed with zero values: %v", err)
 		}
@@ -275,7 +342,7 @@ func TestPrepImageName(t *testing.T) {
 			CharID: "507f1f77bcf86cd799439011",
 		}
 
-		parts, err := prepImageNameParts(req)
+		parts, err := prepImageNameParts(req, storage.Flat)
 		if err != nil {
 			t.Errorf("prepImageNameParts failed with large numbers: %v", err)
 		}
@@ -290,6 +357,49 @@ func TestPrepImageName(t *testing.T) {
 	})
 }
 
+func TestPrepImageNameHierarchical(t *testing.T) {
+	t.Run("valid request", func(t *testing.T) {
+		req := UploadRequest{
+			Guild:  123,
+			User:   456,
+			CharID: "507f1f77bcf86cd799439011",
+		}
+
+		parts, err := prepImageNameParts(req, storage.Hierarchical)
+		if err != nil {
+			t.Fatalf("prepImageNameParts failed: %v", err)
+		}
+
+		// Verify path structure: guild/user/charID/imageID.webp
+		if len(parts) != 4 {
+			t.Fatalf("Expected 4 path parts, got %d: %v", len(parts), parts)
+		}
+		if parts[0] != "123" || parts[1] != "456" {
+			t.Errorf("Expected guild and user prefix, got %v", parts[:2])
+		}
+		if parts[2] != "507f1f77bcf86cd799439011" {
+			t.Errorf("Expected charID, got %s", parts[2])
+		}
+		if !strings.HasSuffix(parts[3], ".webp") {
+			t.Errorf("Expected .webp extension, got %s", parts[3])
+		}
+	})
+
+	t.Run("missing guild and user", func(t *testing.T) {
+		req := UploadRequest{
+			CharID: "507f1f77bcf86cd799439011",
+		}
+
+		_, err := prepImageNameParts(req, storage.Hierarchical)
+		if err == nil {
+			t.Fatal("Expected error for missing guild and user")
+		}
+		if !strings.Contains(err.Error(), "guild and user are required") {
+			t.Errorf("Unexpected error message: %v", err)
+		}
+	})
+}
+
 func TestHandleSingleDelete(t *testing.T) {
 	t.Run("successful deletion", func(t *testing.T) {
 		// Setup: Create temp dir and test image
@@ -308,7 +418,7 @@ func TestHandleSingleDelete(t *testing.T) {
 			t.Fatalf("Failed to create test file: %v", err)
 		}
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		// Execute: DELETE request
@@ -337,7 +447,7 @@ func TestHandleSingleDelete(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -359,7 +469,7 @@ func TestHandleSingleDelete(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -388,7 +498,7 @@ func TestHandleSingleDelete(t *testing.T) {
 			t.Fatalf("Failed to create test file: %v", err)
 		}
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -420,7 +530,7 @@ func TestHandleSingleDelete(t *testing.T) {
 			t.Fatalf("Failed to create directories: %v", err)
 		}
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		// Attempt to delete the directory using single delete endpoint
@@ -459,7 +569,7 @@ func TestHandleCharacterDelete(t *testing.T) {
 		os.WriteFile(filepath.Join(charPath, "image2.webp"), []byte("test2"), 0644)
 		os.WriteFile(filepath.Join(charPath, "image3.webp"), []byte("test3"), 0644)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -481,7 +591,7 @@ func TestHandleCharacterDelete(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -503,7 +613,7 @@ func TestHandleCharacterDelete(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -525,7 +635,7 @@ func TestHandleCharacterDelete(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		// Try to use path traversal via charID param (e.g. charID="../../../etc/passwd")
@@ -554,7 +664,7 @@ func TestHandleCharacterDelete(t *testing.T) {
 		}
 		os.WriteFile(filepath.Join(charPath, "image.webp"), []byte("test"), 0644)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -572,6 +682,185 @@ func TestHandleCharacterDelete(t *testing.T) {
 	})
 }
 
+func TestHandleCharacterDeleteHierarchical(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-char-delete-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	charPath := filepath.Join(tmpDir, "123", "456", "507f1f77bcf86cd799439011")
+	otherPath := filepath.Join(tmpDir, "123", "789", "507f1f77bcf86cd799439012")
+	for _, dir := range []string{charPath, otherPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create char dir: %v", err)
+		}
+		os.WriteFile(filepath.Join(dir, "image.webp"), []byte("test"), 0644)
+	}
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+	router := setupRouter(cfg)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/character/507f1f77bcf86cd799439011", nil)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if checks.PathExists(filepath.Join(tmpDir, "123", "456")) {
+		t.Error("Character directory and its empty parent should have been deleted")
+	}
+	if !checks.PathExists(otherPath) {
+		t.Error("Other character's directory should not have been deleted")
+	}
+}
+
+func TestHandleGuildDelete(t *testing.T) {
+	setup := func(t *testing.T) string {
+		tmpDir, err := os.MkdirTemp("", "test-guild-delete-*")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		for _, dir := range []string{
+			filepath.Join(tmpDir, "123", "456", "507f1f77bcf86cd799439011"),
+			filepath.Join(tmpDir, "123", "789", "507f1f77bcf86cd799439012"),
+			filepath.Join(tmpDir, "999", "456", "507f1f77bcf86cd799439013"),
+		} {
+			if err := os.MkdirAll(dir, 0755); err != nil {
+				t.Fatalf("Failed to create char dir: %v", err)
+			}
+			os.WriteFile(filepath.Join(dir, "image.webp"), []byte("test"), 0644)
+		}
+		return tmpDir
+	}
+
+	t.Run("successful deletion", func(t *testing.T) {
+		tmpDir := setup(t)
+		defer os.RemoveAll(tmpDir)
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/guild/123", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if checks.PathExists(filepath.Join(tmpDir, "123")) {
+			t.Error("Guild directory should have been deleted")
+		}
+		if !checks.PathExists(filepath.Join(tmpDir, "999")) {
+			t.Error("Other guild's directory should not have been deleted")
+		}
+	})
+
+	t.Run("non-existent guild", func(t *testing.T) {
+		tmpDir := setup(t)
+		defer os.RemoveAll(tmpDir)
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/guild/555", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "not found") {
+			t.Errorf("Expected 'not found' error: %s", w.Body.String())
+		}
+	})
+
+	t.Run("invalid guild ID", func(t *testing.T) {
+		tmpDir := setup(t)
+		defer os.RemoveAll(tmpDir)
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/guild/..", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest && w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 400 or 404, got %d", w.Code)
+		}
+		if !checks.PathExists(tmpDir) {
+			t.Error("Images directory should not have been deleted")
+		}
+	})
+
+	t.Run("flat layout rejected", func(t *testing.T) {
+		tmpDir := setup(t)
+		defer os.RemoveAll(tmpDir)
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Flat}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/guild/123", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+		if !checks.PathExists(filepath.Join(tmpDir, "123")) {
+			t.Error("Directory should not have been deleted under the flat layout")
+		}
+	})
+}
+
+func TestHandleUserDelete(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-user-delete-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	userA := filepath.Join(tmpDir, "123", "456", "507f1f77bcf86cd799439011")
+	userB := filepath.Join(tmpDir, "999", "456", "507f1f77bcf86cd799439012")
+	other := filepath.Join(tmpDir, "123", "789", "507f1f77bcf86cd799439013")
+	for _, dir := range []string{userA, userB, other} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create char dir: %v", err)
+		}
+		os.WriteFile(filepath.Join(dir, "image.webp"), []byte("test"), 0644)
+	}
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+	router := setupRouter(cfg)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/user/456", nil)
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if checks.PathExists(userA) || checks.PathExists(userB) {
+		t.Error("User's images should have been deleted in every guild")
+	}
+	if checks.PathExists(filepath.Join(tmpDir, "999")) {
+		t.Error("Empty guild directory should have been cleaned up")
+	}
+	if !checks.PathExists(other) {
+		t.Error("Other user's images should not have been deleted")
+	}
+
+	// A second attempt finds nothing
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/user/456", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for missing user, got %d", w.Code)
+	}
+}
+
 func TestHandleImageUpload(t *testing.T) {
 	t.Run("successful upload", func(t *testing.T) {
 		tmpDir, err := os.MkdirTemp("", "test-upload-*")
@@ -580,7 +869,7 @@ func TestHandleImageUpload(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		uploadReq := UploadRequest{
@@ -627,7 +916,7 @@ func TestHandleImageUpload(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -647,7 +936,7 @@ func TestHandleImageUpload(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		uploadReq := UploadRequest{
@@ -678,7 +967,7 @@ func TestHandleImageUpload(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		uploadReq := UploadRequest{
@@ -709,7 +998,7 @@ func TestHandleImageUpload(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		uploadReq := UploadRequest{
@@ -740,7 +1029,7 @@ func TestHandleImageUpload(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		uploadReq := UploadRequest{
@@ -783,6 +1072,2487 @@ func TestHandleImageUpload(t *testing.T) {
 	})
 }
 
+func TestHandleImageUploadLocal(t *testing.T) {
+	t.Run("hierarchical layout", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		srv := imageServer(t, 16, 8)
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+		router := setupRouter(cfg)
+
+		body, _ := json.Marshal(UploadRequest{
+			Guild:    123,
+			User:     456,
+			CharID:   "507f1f77bcf86cd799439011",
+			ImageURL: srv.URL + "/avatar.png",
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var responseURL string
+		json.Unmarshal(w.Body.Bytes(), &responseURL)
+		if !strings.HasPrefix(responseURL, "https://example.com/123/456/507f1f77bcf86cd799439011/") {
+			t.Errorf("Unexpected response URL format: %s", responseURL)
+		}
+
+		urlPath := strings.TrimPrefix(responseURL, "https://example.com/")
+		fullPath := filepath.Join(append([]string{tmpDir}, strings.Split(urlPath, "/")...)...)
+		if !checks.FileExists(fullPath) {
+			t.Errorf("Image file was not created at: %s", fullPath)
+		}
+
+		meta, err := cfg.Dirs().ReadMeta(fullPath)
+		if err != nil {
+			t.Fatalf("Metadata was not written: %v", err)
+		}
+		if meta.SourceURL != srv.URL+"/avatar.png" || meta.SourceFormat != "png" {
+			t.Errorf("Unexpected source in metadata: %+v", meta)
+		}
+		if meta.Guild != 123 || meta.User != 456 || meta.CharID != "507f1f77bcf86cd799439011" {
+			t.Errorf("Unexpected owner in metadata: %+v", meta)
+		}
+		if meta.Width != 16 || meta.Height != 8 || meta.Mode != storage.ModeLossy || meta.Quality != 90 {
+			t.Errorf("Unexpected encoding in metadata: %+v", meta)
+		}
+		if stat, _ := os.Stat(fullPath); meta.Size != stat.Size() {
+			t.Errorf("Expected size %d, got %d", stat.Size(), meta.Size)
+		}
+		if len(meta.Hash) != 16 {
+			t.Errorf("Expected perceptual hash, got %q", meta.Hash)
+		}
+	})
+
+	t.Run("missing guild in hierarchical layout", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		srv := imageServer(t, 16, 8)
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+		router := setupRouter(cfg)
+
+		body, _ := json.Marshal(UploadRequest{
+			User:     456,
+			CharID:   "507f1f77bcf86cd799439011",
+			ImageURL: srv.URL + "/avatar.png",
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// multipartUpload builds a multipart/form-data upload body from fields, with
+// image as the image file if it isn't nil.
+func multipartUpload(t *testing.T, fields map[string]string, image []byte) (*bytes.Buffer, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := writer.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if image != nil {
+		part, err := writer.CreateFormFile("image", "avatar.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		part.Write(image)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &body, writer.FormDataContentType()
+}
+
+func TestHandleImageUploadMultipart(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+	router := setupRouter(cfg)
+
+	upload := func(fields map[string]string, image []byte) *httptest.ResponseRecorder {
+		body, contentType := multipartUpload(t, fields, image)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	owner := map[string]string{"guild": "123", "user": "456", "charid": "507f1f77bcf86cd799439011"}
+
+	t.Run("saves uploaded file", func(t *testing.T) {
+		w := upload(owner, testPNG(t, 16, 8))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var responseURL string
+		json.Unmarshal(w.Body.Bytes(), &responseURL)
+		if !strings.HasPrefix(responseURL, "https://example.com/123/456/507f1f77bcf86cd799439011/") {
+			t.Fatalf("Unexpected response URL format: %s", responseURL)
+		}
+
+		urlPath := strings.TrimPrefix(responseURL, "https://example.com/")
+		fullPath := filepath.Join(append([]string{tmpDir}, strings.Split(urlPath, "/")...)...)
+		meta, err := cfg.Dirs().ReadMeta(fullPath)
+		if err != nil {
+			t.Fatalf("Metadata was not written: %v", err)
+		}
+		if meta.SourceURL != "" || meta.SourceFormat != "png" {
+			t.Errorf("Unexpected source in metadata: %+v", meta)
+		}
+		if meta.Guild != 123 || meta.User != 456 || meta.Width != 16 || meta.Height != 8 {
+			t.Errorf("Unexpected metadata: %+v", meta)
+		}
+	})
+
+	t.Run("missing file", func(t *testing.T) {
+		w := upload(owner, nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid guild", func(t *testing.T) {
+		w := upload(map[string]string{"guild": "abc", "user": "456", "charid": "507f1f77bcf86cd799439011"}, testPNG(t, 4, 4))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("missing user in hierarchical layout", func(t *testing.T) {
+		w := upload(map[string]string{"guild": "123", "charid": "507f1f77bcf86cd799439011"}, testPNG(t, 4, 4))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("not an image", func(t *testing.T) {
+		w := upload(owner, []byte("definitely not an image"))
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("Expected status 500, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestHandleRawUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+	router := setupRouter(cfg)
+
+	upload := func(target, contentType string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(w, req)
+		return w
+	}
+	target := "/character/507f1f77bcf86cd799439011/images?guild=123&user=456"
+
+	t.Run("saves request body", func(t *testing.T) {
+		w := upload(target, "image/png", testPNG(t, 16, 8))
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var responseURL string
+		json.Unmarshal(w.Body.Bytes(), &responseURL)
+		if !strings.HasPrefix(responseURL, "https://example.com/123/456/507f1f77bcf86cd799439011/") {
+			t.Fatalf("Unexpected response URL format: %s", responseURL)
+		}
+
+		urlPath := strings.TrimPrefix(responseURL, "https://example.com/")
+		fullPath := filepath.Join(append([]string{tmpDir}, strings.Split(urlPath, "/")...)...)
+		meta, err := cfg.Dirs().ReadMeta(fullPath)
+		if err != nil {
+			t.Fatalf("Metadata was not written: %v", err)
+		}
+		if meta.SourceFormat != "png" || meta.Width != 16 || meta.Height != 8 {
+			t.Errorf("Unexpected metadata: %+v", meta)
+		}
+	})
+
+	t.Run("not an image content type", func(t *testing.T) {
+		w := upload(target, "application/json", testPNG(t, 4, 4))
+		if w.Code != http.StatusUnsupportedMediaType {
+			t.Errorf("Expected status 415, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("empty body", func(t *testing.T) {
+		w := upload(target, "image/png", nil)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid user", func(t *testing.T) {
+		w := upload("/character/507f1f77bcf86cd799439011/images?guild=123&user=abc", "image/png", testPNG(t, 4, 4))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("missing guild in hierarchical layout", func(t *testing.T) {
+		w := upload("/character/507f1f77bcf86cd799439011/images?user=456", "image/png", testPNG(t, 4, 4))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid character ID", func(t *testing.T) {
+		body := &countingReader{Reader: bytes.NewReader(testPNG(t, 4, 4))}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/character/invalid/images?guild=123&user=456", body)
+		req.Header.Set("Content-Type", "image/png")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+		if body.n != 0 {
+			t.Errorf("Expected the body not to be read, read %d bytes", body.n)
+		}
+	})
+
+	t.Run("declared length too large", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", target, bytes.NewReader(testPNG(t, 4, 4)))
+		req.Header.Set("Content-Type", "image/png")
+		req.ContentLength = maxImageSize + 1
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// countingReader counts the bytes read from it.
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestReadLimited(t *testing.T) {
+	data, err := readLimited(strings.NewReader("1234"), 4)
+	if err != nil || string(data) != "1234" {
+		t.Errorf("Expected 1234 within limit, got %q, %v", data, err)
+	}
+	if _, err := readLimited(strings.NewReader("12345"), 4); !errors.Is(err, errTooLarge) {
+		t.Errorf("Expected errTooLarge, got %v", err)
+	}
+}
+
+func TestHandleBatchUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 16, 8)
+	missing := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(missing.Close)
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Flat}
+	router := setupRouter(cfg)
+
+	post := func(requests any) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(requests)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload/batch", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("reports each image", func(t *testing.T) {
+		requests := []UploadRequest{
+			{CharID: "507f1f77bcf86cd799439011", ImageURL: srv.URL + "/1.png"},
+			{CharID: "507f1f77bcf86cd799439011", ImageURL: "ftp://example.com/2.png"},
+			{CharID: "invalid", ImageURL: srv.URL + "/3.png"},
+			{CharID: "507f1f77bcf86cd799439011", ImageURL: missing.URL + "/4.png"},
+		}
+		for range 6 {
+			requests = append(requests, UploadRequest{CharID: "507f1f77bcf86cd799439012", ImageURL: srv.URL + "/more.png"})
+		}
+		w := post(requests)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var results []BatchResult
+		if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != len(requests) {
+			t.Fatalf("Expected %d results, got %d", len(requests), len(results))
+		}
+		want := []int{http.StatusCreated, http.StatusBadRequest, http.StatusBadRequest, http.StatusBadGateway}
+		for i, status := range want {
+			if results[i].Status != status {
+				t.Errorf("Result %d: expected status %d, got %+v", i, status, results[i])
+			}
+		}
+		if !strings.HasPrefix(results[0].URL, "https://example.com/507f1f77bcf86cd799439011/") || results[0].Error != "" {
+			t.Errorf("Unexpected first result: %+v", results[0])
+		}
+		if results[1].URL != "" || results[1].Error == "" {
+			t.Errorf("Expected error without URL, got %+v", results[1])
+		}
+
+		urls := make(map[string]bool)
+		for _, result := range results[4:] {
+			if result.Status != http.StatusCreated {
+				t.Errorf("Expected status 201, got %+v", result)
+			}
+			urls[result.URL] = true
+		}
+		if len(urls) != 6 {
+			t.Errorf("Expected 6 distinct URLs, got %d", len(urls))
+		}
+		images, _ := cfg.Layout.CharImages(tmpDir, "507f1f77bcf86cd799439012")
+		if len(images) != 6 {
+			t.Errorf("Expected 6 images saved, got %d", len(images))
+		}
+	})
+
+	t.Run("empty batch", func(t *testing.T) {
+		if w := post([]UploadRequest{}); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("batch too large", func(t *testing.T) {
+		requests := make([]UploadRequest, maxBatchSize+1)
+		if w := post(requests); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("not an array", func(t *testing.T) {
+		if w := post(UploadRequest{}); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// waitForJob polls a job until it finishes.
+func waitForJob(t *testing.T, router *gin.Engine, id string) Job {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jobs/"+id, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var job Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.finished() {
+			return job
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Job %s didn't finish", id)
+	return Job{}
+}
+
+func TestAsyncUpload(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 16, 8)
+	missing := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(missing.Close)
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Flat, JobWorkers: 2}
+	router := setupRouter(cfg)
+
+	queue := func(request UploadRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload?async=true", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("completes in background", func(t *testing.T) {
+		w := queue(UploadRequest{CharID: "507f1f77bcf86cd799439011", ImageURL: srv.URL + "/avatar.png"})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status 202, got %d: %s", w.Code, w.Body.String())
+		}
+		var job Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job.ID == "" || job.Status != JobQueued {
+			t.Fatalf("Unexpected queued job: %+v", job)
+		}
+		if location := w.Header().Get("Location"); location != "/jobs/"+job.ID {
+			t.Errorf("Unexpected Location header: %q", location)
+		}
+
+		job = waitForJob(t, router, job.ID)
+		if job.Status != JobDone || job.Error != "" {
+			t.Fatalf("Expected done job, got %+v", job)
+		}
+		if !strings.HasPrefix(job.URL, "https://example.com/507f1f77bcf86cd799439011/") {
+			t.Errorf("Unexpected job URL: %s", job.URL)
+		}
+		images, _ := cfg.Layout.CharImages(tmpDir, "507f1f77bcf86cd799439011")
+		if len(images) != 1 {
+			t.Errorf("Expected 1 image saved, got %d", len(images))
+		}
+	})
+
+	t.Run("multipart upload", func(t *testing.T) {
+		body, contentType := multipartUpload(t, map[string]string{"charid": "507f1f77bcf86cd799439012"}, testPNG(t, 4, 4))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload?async=true", body)
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status 202, got %d: %s", w.Code, w.Body.String())
+		}
+		var job Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		if job = waitForJob(t, router, job.ID); job.Status != JobDone {
+			t.Errorf("Expected done job, got %+v", job)
+		}
+	})
+
+	t.Run("download failure", func(t *testing.T) {
+		w := queue(UploadRequest{CharID: "507f1f77bcf86cd799439011", ImageURL: missing.URL + "/avatar.png"})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status 202, got %d: %s", w.Code, w.Body.String())
+		}
+		var job Job
+		json.Unmarshal(w.Body.Bytes(), &job)
+		job = waitForJob(t, router, job.ID)
+		if job.Status != JobFailed || job.Error == "" || job.URL != "" {
+			t.Errorf("Expected failed job, got %+v", job)
+		}
+	})
+
+	t.Run("invalid request rejected immediately", func(t *testing.T) {
+		w := queue(UploadRequest{CharID: "invalid", ImageURL: srv.URL + "/avatar.png"})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("unknown job", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/jobs/507f1f77bcf86cd799439011", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		router := setupRouter(&Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90})
+		body, _ := json.Marshal(UploadRequest{CharID: "507f1f77bcf86cd799439011", ImageURL: srv.URL + "/avatar.png"})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload?async=true", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestJobQueuePrune(t *testing.T) {
+	q := &jobQueue{jobs: map[string]*Job{}}
+	now := time.Now()
+	q.jobs["old"] = &Job{Status: JobDone, Updated: now.Add(-2 * jobRetention)}
+	q.jobs["recent"] = &Job{Status: JobFailed, Updated: now}
+	q.jobs["running"] = &Job{Status: JobEncoding, Updated: now.Add(-2 * jobRetention)}
+	q.prune(now)
+
+	if _, ok := q.jobs["old"]; ok {
+		t.Error("Expected old finished job to be pruned")
+	}
+	if len(q.jobs) != 2 {
+		t.Errorf("Expected 2 jobs kept, got %d", len(q.jobs))
+	}
+}
+
+func TestJobQueueLimit(t *testing.T) {
+	cfg := &Config{ImagesDir: t.TempDir(), MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+	q := newJobQueue(cfg, 0)
+	q.maxBytes = 10
+	request := UploadRequest{CharID: "507f1f77bcf86cd799439011"}
+
+	if _, err := q.add(request, make([]byte, 8)); err != nil {
+		t.Fatalf("Expected the first upload to be queued, got %v", err)
+	}
+	if _, err := q.add(request, make([]byte, 8)); !errors.Is(err, errQueueFull) {
+		t.Errorf("Expected errQueueFull past the byte limit, got %v", err)
+	}
+	// Downloads hold no data until they run
+	if _, err := q.add(UploadRequest{CharID: request.CharID, ImageURL: "http://127.0.0.1:1/avatar.png"}, nil); err != nil {
+		t.Errorf("Expected a download to be queued, got %v", err)
+	}
+
+	// Finished jobs free their space
+	go q.work()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		q.mu.Lock()
+		queued := q.queuedBytes
+		q.mu.Unlock()
+		if queued == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected queued bytes to be released, still %d", queued)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := q.add(request, make([]byte, 8)); err != nil {
+		t.Errorf("Expected an upload to be queued after the first finished, got %v", err)
+	}
+}
+
+func TestUploadCallbacks(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 16, 8)
+
+	events := make(chan webhook.Event, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event webhook.Event
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	t.Cleanup(receiver.Close)
+
+	notifier := webhook.New(receiver.URL+"/all", "secret")
+	t.Cleanup(notifier.Close)
+	cfg := &Config{
+		ImagesDir:  tmpDir,
+		BaseURL:    "https://example.com",
+		Quality:    90,
+		Layout:     storage.Flat,
+		JobWorkers: 1,
+		Webhooks:   notifier,
+		Recorders:  []Recorder{notifier},
+	}
+	router := setupRouter(cfg)
+
+	upload := func(target string, request UploadRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", target, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	receive := func() webhook.Event {
+		t.Helper()
+		select {
+		case event := <-events:
+			return event
+		case <-time.After(5 * time.Second):
+			t.Fatal("Timed out waiting for webhook")
+			return webhook.Event{}
+		}
+	}
+
+	t.Run("created and deleted", func(t *testing.T) {
+		w := upload("/image/upload", UploadRequest{
+			CharID:      "507f1f77bcf86cd799439011",
+			ImageURL:    srv.URL + "/avatar.png",
+			CallbackURL: receiver.URL + "/callback",
+		})
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var url string
+		json.Unmarshal(w.Body.Bytes(), &url)
+
+		// One event for the global URL, one for the callback
+		for range 2 {
+			if event := receive(); event.Type != webhook.ImageCreated || event.URL != url {
+				t.Errorf("Unexpected event: %+v", event)
+			}
+		}
+
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/character/507f1f77bcf86cd799439011", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if event := receive(); event.Type != webhook.CharacterDeleted || event.CharID != "507f1f77bcf86cd799439011" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	})
+
+	t.Run("failed async upload", func(t *testing.T) {
+		missing := httptest.NewServer(http.NotFoundHandler())
+		t.Cleanup(missing.Close)
+
+		w := upload("/image/upload?async=true", UploadRequest{
+			CharID:      "507f1f77bcf86cd799439011",
+			ImageURL:    missing.URL + "/avatar.png",
+			CallbackURL: receiver.URL + "/callback",
+		})
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("Expected status 202, got %d: %s", w.Code, w.Body.String())
+		}
+		if event := receive(); event.Type != webhook.UploadFailed || event.Error == "" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+	})
+
+	t.Run("invalid callback URL", func(t *testing.T) {
+		w := upload("/image/upload", UploadRequest{
+			CharID:      "507f1f77bcf86cd799439011",
+			ImageURL:    srv.URL + "/avatar.png",
+			CallbackURL: "ftp://example.com",
+		})
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("callbacks disabled", func(t *testing.T) {
+		router := setupRouter(&Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90})
+		body, _ := json.Marshal(UploadRequest{
+			CharID:      "507f1f77bcf86cd799439011",
+			ImageURL:    srv.URL + "/avatar.png",
+			CallbackURL: receiver.URL + "/callback",
+		})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestEventHub(t *testing.T) {
+	t.Run("resumes from buffer", func(t *testing.T) {
+		h := newEventHub()
+		for range 3 {
+			h.publish(webhook.NewEvent(webhook.ImageCreated))
+		}
+
+		backlog, _, cancel := h.subscribe(1, true)
+		defer cancel()
+		if len(backlog) != 2 || backlog[0].seq != 2 || backlog[1].seq != 3 {
+			t.Errorf("Expected events 2 and 3, got %+v", backlog)
+		}
+
+		if backlog, _, cancel := h.subscribe(0, false); len(backlog) != 0 {
+			t.Errorf("Expected no backlog without resume, got %d", len(backlog))
+			cancel()
+		}
+
+		// An ID from before a restart replays everything buffered
+		backlog, _, cancel = h.subscribe(100, true)
+		defer cancel()
+		if len(backlog) != 3 {
+			t.Errorf("Expected 3 buffered events, got %d", len(backlog))
+		}
+	})
+
+	t.Run("bounded buffer", func(t *testing.T) {
+		h := newEventHub()
+		for range eventBufferSize + 10 {
+			h.publish(webhook.NewEvent(webhook.ImageCreated))
+		}
+		backlog, _, cancel := h.subscribe(0, true)
+		defer cancel()
+		if len(backlog) != eventBufferSize || backlog[0].seq != 11 {
+			t.Errorf("Expected %d events from 11, got %d from %d", eventBufferSize, len(backlog), backlog[0].seq)
+		}
+	})
+
+	t.Run("disconnects slow subscribers", func(t *testing.T) {
+		h := newEventHub()
+		_, events, cancel := h.subscribe(0, false)
+		defer cancel()
+		for range subscriberBuffer + 1 {
+			h.publish(webhook.NewEvent(webhook.ImageCreated))
+		}
+		received := 0
+		for range events {
+			received++
+		}
+		if received != subscriberBuffer {
+			t.Errorf("Expected %d events before disconnect, got %d", subscriberBuffer, received)
+		}
+	})
+
+	t.Run("close ends streams", func(t *testing.T) {
+		h := newEventHub()
+		_, events, cancel := h.subscribe(0, false)
+		defer cancel()
+		h.close()
+		if _, ok := <-events; ok {
+			t.Error("Expected stream to be closed")
+		}
+		h.publish(webhook.NewEvent(webhook.ImageCreated))
+	})
+}
+
+// readEvent reads the next server-sent event from r, skipping comments.
+func readEvent(t *testing.T, r *bufio.Reader) (id, name string, event webhook.Event) {
+	t.Helper()
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Failed to read event: %v", err)
+		}
+		line = strings.TrimRight(line, "\n")
+		switch {
+		case line == "" && name != "":
+			return id, name, event
+		case strings.HasPrefix(line, "id:"):
+			id = strings.TrimSpace(strings.TrimPrefix(line, "id:"))
+		case strings.HasPrefix(line, "event:"):
+			name = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+		case strings.HasPrefix(line, "data:"):
+			json.Unmarshal([]byte(strings.TrimPrefix(line, "data:")), &event)
+		}
+	}
+}
+
+func TestHandleEvents(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Flat}
+	srv := httptest.NewServer(setupRouter(cfg))
+	t.Cleanup(srv.Close)
+	t.Cleanup(cfg.events.close)
+
+	stream := func(query, lastID string) *bufio.Reader {
+		t.Helper()
+		req, _ := http.NewRequest("GET", srv.URL+"/events"+query, nil)
+		if lastID != "" {
+			req.Header.Set("Last-Event-ID", lastID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/event-stream") {
+			t.Errorf("Expected text/event-stream, got %q", ct)
+		}
+		return bufio.NewReader(resp.Body)
+	}
+
+	filtered := stream("?charid=507f1f77bcf86cd799439012", "")
+
+	charID := "507f1f77bcf86cd799439011"
+	saveTestImage(t, tmpDir, 4, 4, charID, "68f5ce16713c155df96639bc.webp")
+	recordSaved(cfg, storage.Meta{ID: "68f5ce16713c155df96639bc", CharID: charID}, "https://example.com/a.webp")
+	if err := cfg.DeleteCharacter(charID); err != nil {
+		t.Fatal(err)
+	}
+	recordSaved(cfg, storage.Meta{ID: "68f5ce16713c155df96639bd", CharID: "507f1f77bcf86cd799439012"}, "https://example.com/b.webp")
+
+	t.Run("resume", func(t *testing.T) {
+		r := stream("", "0")
+		for i, want := range []string{webhook.ImageCreated, webhook.CharacterDeleted, webhook.ImageCreated} {
+			id, name, event := readEvent(t, r)
+			if id != strconv.Itoa(i+1) || name != want || event.Type != want {
+				t.Errorf("Event %d: expected %s, got id %s, %s, %+v", i+1, want, id, name, event)
+			}
+		}
+
+		r = stream("", "2")
+		if id, _, event := readEvent(t, r); id != "3" || event.ImageID != "68f5ce16713c155df96639bd" {
+			t.Errorf("Expected event 3 after resume, got %s: %+v", id, event)
+		}
+	})
+
+	t.Run("filtered live events", func(t *testing.T) {
+		id, name, event := readEvent(t, filtered)
+		if id != "3" || name != webhook.ImageCreated || event.CharID != "507f1f77bcf86cd799439012" {
+			t.Errorf("Expected only the filtered character's event, got %s %s: %+v", id, name, event)
+		}
+	})
+
+	t.Run("guild-filtered deletes", func(t *testing.T) {
+		// Under the flat layout, the guild only comes from the metadata
+		guildStream := stream("?guild=123", "")
+		for _, id := range []string{"68f5ce16713c155df96639be", "68f5ce16713c155df96639bf"} {
+			path := saveTestImage(t, tmpDir, 4, 4, "507f1f77bcf86cd799439013", id+".webp")
+			if err := cfg.Dirs().WriteMeta(path, storage.Meta{ID: id, CharID: "507f1f77bcf86cd799439013", Guild: 123, User: 456}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/image/507f1f77bcf86cd799439013/68f5ce16713c155df96639be.webp", nil)
+		setupRouter(cfg).ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if err := cfg.DeleteCharacter("507f1f77bcf86cd799439013"); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, want := range []string{webhook.ImageDeleted, webhook.CharacterDeleted} {
+			_, name, event := readEvent(t, guildStream)
+			if name != want || event.Guild != 123 || event.User != 456 {
+				t.Errorf("Expected %s for guild 123 and user 456, got %s: %+v", want, name, event)
+			}
+		}
+	})
+
+	t.Run("invalid parameters", func(t *testing.T) {
+		router := setupRouter(cfg)
+		for _, target := range []string{"/events?guild=abc", "/events?lastEventId=abc"} {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", target, nil)
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", target, w.Code)
+			}
+		}
+	})
+}
+
+func TestIdempotency(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	// Each download waits for a release, so requests can be made to overlap
+	var downloads atomic.Int32
+	release := make(chan struct{})
+	data := testPNG(t, 4, 4)
+	images := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		<-release
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(data)
+	}))
+	t.Cleanup(images.Close)
+	close(release)
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Flat, IdempotencyTTL: time.Hour}
+	router := setupRouter(cfg)
+
+	upload := func(key, imageURL string) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(UploadRequest{CharID: "507f1f77bcf86cd799439011", ImageURL: images.URL + imageURL})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("replays response", func(t *testing.T) {
+		downloads.Store(0)
+		first := upload("replay", "/avatar.png")
+		second := upload("replay", "/avatar.png")
+		if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201 twice, got %d and %d", first.Code, second.Code)
+		}
+		if first.Body.String() != second.Body.String() {
+			t.Errorf("Expected the same URL, got %s and %s", first.Body, second.Body)
+		}
+		if first.Header().Get(idempotentReplayHeader) != "" || second.Header().Get(idempotentReplayHeader) != "true" {
+			t.Error("Expected only the second response to be marked as replayed")
+		}
+		if downloads.Load() != 1 {
+			t.Errorf("Expected 1 download, got %d", downloads.Load())
+		}
+	})
+
+	t.Run("different request", func(t *testing.T) {
+		upload("mismatch", "/avatar.png")
+		if w := upload("mismatch", "/other.png"); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("concurrent requests wait", func(t *testing.T) {
+		downloads.Store(0)
+		release = make(chan struct{})
+
+		results := make(chan *httptest.ResponseRecorder, 3)
+		for range 3 {
+			go func() { results <- upload("concurrent", "/avatar.png") }()
+		}
+		for downloads.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+		close(release)
+
+		var bodies []string
+		for range 3 {
+			w := <-results
+			if w.Code != http.StatusCreated {
+				t.Errorf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+			}
+			bodies = append(bodies, w.Body.String())
+		}
+		if bodies[0] != bodies[1] || bodies[1] != bodies[2] {
+			t.Errorf("Expected the same URL for every request, got %v", bodies)
+		}
+		if downloads.Load() != 1 {
+			t.Errorf("Expected 1 download, got %d", downloads.Load())
+		}
+	})
+
+	t.Run("server errors are retried", func(t *testing.T) {
+		downloads.Store(0)
+		for range 2 {
+			if w := upload("failing", "/missing.png"); w.Code != http.StatusBadGateway {
+				t.Errorf("Expected status 502, got %d: %s", w.Code, w.Body.String())
+			}
+		}
+		if downloads.Load() != 2 {
+			t.Errorf("Expected 2 downloads, got %d", downloads.Load())
+		}
+	})
+
+	t.Run("multipart retry with a new boundary", func(t *testing.T) {
+		fields := map[string]string{"charid": "507f1f77bcf86cd799439011", "guild": "123", "user": "456"}
+		uploadFile := func(image []byte) *httptest.ResponseRecorder {
+			body, contentType := multipartUpload(t, fields, image)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("POST", "/image/upload", body)
+			req.Header.Set("Content-Type", contentType)
+			req.Header.Set(idempotencyKeyHeader, "multipart")
+			router.ServeHTTP(w, req)
+			return w
+		}
+		first, second := uploadFile(data), uploadFile(data)
+		if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201 twice, got %d and %d: %s", first.Code, second.Code, second.Body.String())
+		}
+		if first.Body.String() != second.Body.String() || second.Header().Get(idempotentReplayHeader) != "true" {
+			t.Errorf("Expected the retry to be replayed, got %s and %s", first.Body, second.Body)
+		}
+		if w := uploadFile(testPNG(t, 8, 8)); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("Expected status 422 for a different file, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("keys are scoped to the endpoint", func(t *testing.T) {
+		upload("scoped", "/avatar.png")
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/character/507f1f77bcf86cd799439011/images", bytes.NewReader(data))
+		req.Header.Set("Content-Type", "image/png")
+		req.Header.Set(idempotencyKeyHeader, "scoped")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated || w.Header().Get(idempotentReplayHeader) != "" {
+			t.Errorf("Expected a new upload, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("without key", func(t *testing.T) {
+		first, second := upload("", "/avatar.png"), upload("", "/avatar.png")
+		if first.Body.String() == second.Body.String() {
+			t.Error("Expected separate uploads without a key")
+		}
+	})
+
+	t.Run("key too long", func(t *testing.T) {
+		if w := upload(strings.Repeat("k", maxIdempotencyKey+1), "/avatar.png"); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestIdempotencyStoreExpiry(t *testing.T) {
+	s := newIdempotencyStore(time.Millisecond)
+	var hash [32]byte
+	entry, owner := s.claim("key", hash)
+	if !owner {
+		t.Fatal("Expected to own a new key")
+	}
+	entry.status = http.StatusCreated
+	s.finish("key", entry)
+
+	if _, owner := s.claim("key", hash); owner {
+		t.Error("Expected the key to be remembered")
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, owner := s.claim("key", hash); !owner {
+		t.Error("Expected the key to expire")
+	}
+}
+
+func TestClientImageID(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 16, 8)
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Flat, JobWorkers: 1}
+	router := setupRouter(cfg)
+
+	upload := func(target string, request UploadRequest) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(request)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", target, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	request := UploadRequest{
+		CharID:   "507f1f77bcf86cd799439011",
+		ImageID:  "68f5ce16713c155df96639bc",
+		ImageURL: srv.URL + "/avatar.png",
+	}
+
+	t.Run("saves with the given ID", func(t *testing.T) {
+		w := upload("/image/upload", request)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var url string
+		json.Unmarshal(w.Body.Bytes(), &url)
+		if url != "https://example.com/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp" {
+			t.Errorf("Unexpected URL: %s", url)
+		}
+		meta, err := cfg.Dirs().ReadMeta(filepath.Join(tmpDir, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp"))
+		if err != nil || meta.ID != "68f5ce16713c155df96639bc" {
+			t.Errorf("Unexpected metadata: %+v, %v", meta, err)
+		}
+	})
+
+	t.Run("conflict", func(t *testing.T) {
+		if w := upload("/image/upload", request); w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := upload("/image/upload?async=true", request); w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409 for async upload, got %d: %s", w.Code, w.Body.String())
+		}
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", "/character/507f1f77bcf86cd799439011/images?imageid=68f5ce16713c155df96639bc", bytes.NewReader(testPNG(t, 4, 4)))
+		req.Header.Set("Content-Type", "image/png")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409 for raw upload, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("ID used by another character", func(t *testing.T) {
+		other := request
+		other.CharID = "507f1f77bcf86cd799439012"
+		if w := upload("/image/upload", other); w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409, got %d: %s", w.Code, w.Body.String())
+		}
+
+		ix, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ix.Close()
+		if err := ix.Put(storage.Meta{ID: "68f5ce16713c155df96639be", CharID: "507f1f77bcf86cd799439013"}); err != nil {
+			t.Fatal(err)
+		}
+		indexed := setupRouter(&Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Flat, Index: ix})
+		body, _ := json.Marshal(UploadRequest{CharID: "507f1f77bcf86cd799439011", ImageID: "68f5ce16713c155df96639be", ImageURL: srv.URL + "/avatar.png"})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		indexed.ServeHTTP(w, req)
+		if w.Code != http.StatusConflict {
+			t.Errorf("Expected status 409 for an ID in the index, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("invalid ID", func(t *testing.T) {
+		invalid := request
+		invalid.ImageID = "../../etc/passwd"
+		if w := upload("/image/upload", invalid); w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("multipart", func(t *testing.T) {
+		body, contentType := multipartUpload(t, map[string]string{
+			"charid":  "507f1f77bcf86cd799439011",
+			"imageid": "68f5ce16713c155df96639bd",
+		}, testPNG(t, 4, 4))
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", body)
+		req.Header.Set("Content-Type", contentType)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated || !strings.Contains(w.Body.String(), "68f5ce16713c155df96639bd.webp") {
+			t.Errorf("Expected upload with the given ID, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestAuth(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 4, 4)
+	saveTestImage(t, tmpDir, 4, 4, "1", "10", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	saveTestImage(t, tmpDir, 4, 4, "2", "20", "507f1f77bcf86cd799439012", "68f5ce16713c155df96639bd.webp")
+
+	keys, err := auth.Load("", `[
+		{"name": "admin", "key": "admin-key-0000000", "scopes": ["admin"]},
+		{"name": "reader", "key": "reader-key-000000", "scopes": ["read"], "guilds": [1]},
+		{"name": "bot", "key": "bot-key-000000000", "scopes": ["upload", "delete"], "guilds": [1]}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical, Keys: keys}
+	router := setupRouter(cfg)
+
+	request := func(method, target, key string, body any) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != nil {
+			data, _ := json.Marshal(body)
+			reader = bytes.NewReader(data)
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, target, reader)
+		req.Header.Set("Content-Type", "application/json")
+		if key != "" {
+			req.Header.Set("Authorization", "Bearer "+key)
+		}
+		router.ServeHTTP(w, req)
+		return w
+	}
+	upload := func(guild int) UploadRequest {
+		return UploadRequest{Guild: guild, User: 10, CharID: "507f1f77bcf86cd799439011", ImageURL: srv.URL + "/avatar.png"}
+	}
+	guild1Image := "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.json"
+	guild2Image := "/image/507f1f77bcf86cd799439012/68f5ce16713c155df96639bd.json"
+
+	t.Run("missing key", func(t *testing.T) {
+		w := request("GET", guild1Image, "", nil)
+		if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("Expected status 401 with WWW-Authenticate, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid key", func(t *testing.T) {
+		if w := request("GET", guild1Image, "wrong-key-0000000", nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("X-API-Key header", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", guild1Image, nil)
+		req.Header.Set(apiKeyHeader, "reader-key-000000")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		key    string
+		body   any
+		want   int
+	}{
+		{"read allowed guild", "GET", guild1Image, "reader-key-000000", nil, http.StatusOK},
+		{"read other guild", "GET", guild2Image, "reader-key-000000", nil, http.StatusForbidden},
+		{"list other guild's character", "GET", "/character/507f1f77bcf86cd799439012", "reader-key-000000", nil, http.StatusForbidden},
+		{"missing scope", "DELETE", "/character/507f1f77bcf86cd799439011", "reader-key-000000", nil, http.StatusForbidden},
+		{"upload to other guild", "POST", "/image/upload", "bot-key-000000000", upload(2), http.StatusForbidden},
+		{"upload to allowed guild", "POST", "/image/upload", "bot-key-000000000", upload(1), http.StatusCreated},
+		{"move to other guild", "POST", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp/move", "bot-key-000000000",
+			TransferRequest{CharID: "507f1f77bcf86cd799439013", Guild: 2, User: 20}, http.StatusForbidden},
+		{"delete other guild's image", "DELETE", "/image/2/20/507f1f77bcf86cd799439012/68f5ce16713c155df96639bd.webp", "bot-key-000000000", nil, http.StatusForbidden},
+		{"delete other guild", "DELETE", "/guild/2", "bot-key-000000000", nil, http.StatusForbidden},
+		{"delete user across guilds", "DELETE", "/user/10", "bot-key-000000000", nil, http.StatusForbidden},
+		{"events across guilds", "GET", "/events", "reader-key-000000", nil, http.StatusForbidden},
+		{"trash needs admin", "GET", "/trash", "reader-key-000000", nil, http.StatusForbidden},
+		{"admin trash", "GET", "/trash", "admin-key-0000000", nil, http.StatusOK},
+		{"admin other guild", "GET", guild2Image, "admin-key-0000000", nil, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := request(tt.method, tt.target, tt.key, tt.body); w.Code != tt.want {
+				t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("batch checks each image", func(t *testing.T) {
+		w := request("POST", "/image/upload/batch", "bot-key-000000000", []UploadRequest{upload(1), upload(2)})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var results []BatchResult
+		json.Unmarshal(w.Body.Bytes(), &results)
+		if len(results) != 2 || results[0].Status != http.StatusCreated || results[1].Status != http.StatusForbidden {
+			t.Errorf("Unexpected results: %+v", results)
+		}
+	})
+
+	t.Run("delete allowed guild", func(t *testing.T) {
+		if w := request("DELETE", "/guild/1", "bot-key-000000000", nil); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+}
+
+// readFunc is an io.Reader implemented by a function.
+type readFunc func(p []byte) (int, error)
+
+func (f readFunc) Read(p []byte) (int, error) { return f(p) }
+
+func TestSignedRequests(t *testing.T) {
+	const secret = "shared-secret-0000"
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 4, 4)
+	verifier, err := auth.NewVerifier(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Signatures: verifier}
+	router := setupRouter(cfg)
+
+	body, _ := json.Marshal(UploadRequest{CharID: "507f1f77bcf86cd799439011", ImageURL: srv.URL + "/avatar.png"})
+	signed := func(method, target string, body []byte, timestamp time.Time, secret string) *http.Request {
+		ts := strconv.FormatInt(timestamp.Unix(), 10)
+		req, _ := http.NewRequest(method, target, bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(timestampHeader, ts)
+		req.Header.Set(signatureHeader, auth.SignRequest([]byte(secret), method, target, ts, body))
+		return req
+	}
+	serve := func(req *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("unsigned mutation", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", "/image/upload", bytes.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if w := serve(req); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401, got %d", w.Code)
+		}
+	})
+
+	t.Run("unsigned read", func(t *testing.T) {
+		req, _ := http.NewRequest("GET", "/character/507f1f77bcf86cd799439011", nil)
+		if w := serve(req); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("signed upload", func(t *testing.T) {
+		w := serve(signed("POST", "/image/upload", body, time.Now(), secret))
+		if w.Code != http.StatusCreated {
+			t.Errorf("Expected status 201, got %d: %s", w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("replay", func(t *testing.T) {
+		first := signed("DELETE", "/character/507f1f77bcf86cd799439011", nil, time.Now(), secret)
+		replay := first.Clone(first.Context())
+		if w := serve(first); w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if w := serve(replay); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected replay to get status 401, got %d", w.Code)
+		}
+	})
+
+	tests := []struct {
+		name string
+		req  func() *http.Request
+	}{
+		{"wrong secret", func() *http.Request {
+			return signed("POST", "/image/upload", body, time.Now(), "wrong-secret-0000")
+		}},
+		{"stale timestamp", func() *http.Request {
+			return signed("POST", "/image/upload", body, time.Now().Add(-time.Hour), secret)
+		}},
+		{"missing timestamp", func() *http.Request {
+			req := signed("POST", "/image/upload", body, time.Now(), secret)
+			req.Header.Del(timestampHeader)
+			return req
+		}},
+		{"tampered body", func() *http.Request {
+			req := signed("POST", "/image/upload", body, time.Now(), secret)
+			req.Body = io.NopCloser(strings.NewReader(`{"charid": "507f1f77bcf86cd799439012"}`))
+			return req
+		}},
+		{"different path", func() *http.Request {
+			req := signed("DELETE", "/character/507f1f77bcf86cd799439011", nil, time.Now(), secret)
+			req.URL.Path = "/character/507f1f77bcf86cd799439012"
+			return req
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(tt.req()); w.Code != http.StatusUnauthorized {
+				t.Errorf("Expected status 401, got %d: %s", w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("rejected before reading body", func(t *testing.T) {
+		var read atomic.Bool
+		body := readFunc(func(p []byte) (int, error) {
+			read.Store(true)
+			return 0, io.EOF
+		})
+
+		req, _ := http.NewRequest("POST", "/image/upload", body)
+		req.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10))
+		req.Header.Set(signatureHeader, "sha256=00")
+		if w := serve(req); w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 for a stale timestamp, got %d", w.Code)
+		}
+
+		req, _ = http.NewRequest("POST", "/image/upload", body)
+		req.ContentLength = maxSignedBody + 1
+		req.Header.Set(timestampHeader, strconv.FormatInt(time.Now().Unix(), 10))
+		req.Header.Set(signatureHeader, "sha256=00")
+		if w := serve(req); w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Expected status 413 for an oversized body, got %d", w.Code)
+		}
+
+		if read.Load() {
+			t.Error("Expected the body not to be read")
+		}
+	})
+
+	t.Run("alongside API keys", func(t *testing.T) {
+		keys, err := auth.Load("", `[{"name": "reader", "key": "reader-key-000000", "scopes": ["read"], "guilds": [1]}]`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		router := setupRouter(&Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Keys: keys, Signatures: verifier})
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, signed("GET", "/trash", nil, time.Now(), secret))
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected signed request to get status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		w = httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/trash", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("Expected unsigned request without a key to get status 401, got %d", w.Code)
+		}
+	})
+}
+
+func TestSignedURLs(t *testing.T) {
+	tmpDir := t.TempDir()
+	saveTestImage(t, tmpDir, 4, 4, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	signer, err := auth.NewURLSigner("url-secret-00000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := auth.Load("", `[{"name": "reader", "key": "reader-key-000000", "scopes": ["read"]}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Keys: keys, URLSigner: signer, APIURL: "https://api.example.com"}
+	router := setupRouter(cfg)
+
+	sign := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp/sign", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(apiKeyHeader, "reader-key-000000")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	get := func(target string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", strings.TrimPrefix(target, cfg.APIURL), nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("default lifetime", func(t *testing.T) {
+		w := sign("")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var signed SignedURL
+		json.Unmarshal(w.Body.Bytes(), &signed)
+		if !strings.HasPrefix(signed.URL, "https://api.example.com/signed/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp?") {
+			t.Errorf("Unexpected URL: %s", signed.URL)
+		}
+		if d := time.Until(signed.Expires); d < defaultSignedURLTTL-time.Minute || d > defaultSignedURLTTL {
+			t.Errorf("Expected expiry in about %v, got %v", defaultSignedURLTTL, d)
+		}
+
+		w = get(signed.URL)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "image/webp" {
+			t.Errorf("Expected image/webp, got %s", ct)
+		}
+		if cc := w.Header().Get("Cache-Control"); !strings.HasPrefix(cc, "private, max-age=") {
+			t.Errorf("Unexpected Cache-Control: %s", cc)
+		}
+	})
+
+	t.Run("chosen lifetime", func(t *testing.T) {
+		w := sign(`{"expires_in": 60}`)
+		var signed SignedURL
+		json.Unmarshal(w.Body.Bytes(), &signed)
+		if d := time.Until(signed.Expires); d < 0 || d > time.Minute {
+			t.Errorf("Expected expiry within a minute, got %v", d)
+		}
+	})
+
+	t.Run("invalid lifetime", func(t *testing.T) {
+		for _, body := range []string{`{"expires_in": -1}`, `{"expires_in": 604801}`, `{"expires_in": "soon"}`} {
+			if w := sign(body); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected status 400, got %d", body, w.Code)
+			}
+		}
+	})
+
+	t.Run("rejected URLs", func(t *testing.T) {
+		path := "/signed/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp"
+		expired := time.Now().Add(-time.Minute).Unix()
+		valid := time.Now().Add(time.Hour).Unix()
+		tests := []struct {
+			name   string
+			target string
+			want   int
+		}{
+			{"unsigned", path, http.StatusForbidden},
+			{"expired", fmt.Sprintf("%s?exp=%d&sig=%s", path, expired, signer.Sign(path, expired)), http.StatusForbidden},
+			{"tampered expiry", fmt.Sprintf("%s?exp=%d&sig=%s", path, valid+3600, signer.Sign(path, valid)), http.StatusForbidden},
+			{"other image", fmt.Sprintf("/signed/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp?exp=%d&sig=%s", valid, signer.Sign(path, valid)), http.StatusForbidden},
+			{"missing image", fmt.Sprintf("%s?exp=%d&sig=%s", path+"x", valid, signer.Sign(path+"x", valid)), http.StatusNotFound},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				if w := get(tt.target); w.Code != tt.want {
+					t.Errorf("Expected status %d, got %d: %s", tt.want, w.Code, w.Body.String())
+				}
+			})
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		router := setupRouter(&Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90})
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp/sign", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+	})
+}
+
+// issueCert creates a certificate for name, signed by parent or else
+// self-signed, returning it with its key and PEM encoding.
+func issueCert(t *testing.T, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, []byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return cert, key,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+func TestTLS(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	ca, caKey, caPEM, _ := issueCert(t, "Test CA", nil, nil)
+	_, _, serverPEM, serverKeyPEM := issueCert(t, "localhost", ca, caKey)
+	_, _, clientPEM, clientKeyPEM := issueCert(t, "bot", ca, caKey)
+	certPath := write("cert.pem", serverPEM)
+	keyPath := write("key.pem", serverKeyPEM)
+	caPath := write("ca.pem", caPEM)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certs, err := newCertReloader(certPath, keyPath, caPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imagesDir := t.TempDir()
+	saveTestImage(t, imagesDir, 4, 4, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	signer, err := auth.NewURLSigner("url-secret-00000000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewUnstartedServer(setupRouter(&Config{
+		ImagesDir: imagesDir, BaseURL: "https://example.com", Quality: 90,
+		ClientCA: caPath, URLSigner: signer,
+	}))
+	srv.TLS = certs.tlsConfig()
+	srv.StartTLS()
+	defer srv.Close()
+	base := strings.Replace(srv.URL, "127.0.0.1", "localhost", 1)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	client := func(certs ...tls.Certificate) *http.Client {
+		config := &tls.Config{RootCAs: pool}
+		if len(certs) > 0 {
+			// Send the certificate even if the server wouldn't accept it
+			config.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+				return &certs[0], nil
+			}
+		}
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: config,
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, srv.Listener.Addr().String())
+			},
+		}}
+	}
+	getPath := func(c *http.Client, path string) (*http.Response, error) {
+		resp, err := c.Get(base + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	get := func(c *http.Client) (*http.Response, error) {
+		return getPath(c, "/character/507f1f77bcf86cd799439011")
+	}
+
+	t.Run("requires client certificate", func(t *testing.T) {
+		resp, err := get(client())
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("Expected status 401 without a client certificate, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("signed URLs need no client certificate", func(t *testing.T) {
+		path := "/signed/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp"
+		expires := time.Now().Add(time.Hour).Unix()
+		resp, err := getPath(client(), fmt.Sprintf("%s?exp=%d&sig=%s", path, expires, signer.Sign(path, expires)))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("accepts client certificate", func(t *testing.T) {
+		resp, err := get(client(clientCert))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("rejects untrusted client certificate", func(t *testing.T) {
+		other, otherKey, _, _ := issueCert(t, "Other CA", nil, nil)
+		_, _, rogueCert, rogueKey := issueCert(t, "rogue", other, otherKey)
+		rogue, _ := tls.X509KeyPair(rogueCert, rogueKey)
+		if _, err := get(client(rogue)); err == nil {
+			t.Error("Expected request with an untrusted client certificate to fail")
+		}
+	})
+
+	t.Run("reloads certificate", func(t *testing.T) {
+		renewed, _, renewedPEM, renewedKeyPEM := issueCert(t, "localhost", ca, caKey)
+		write("cert.pem", renewedPEM)
+		write("key.pem", renewedKeyPEM)
+		// Replacements may be older than the current files, as with cp -p
+		earlier := time.Now().Add(-time.Hour)
+		os.Chtimes(certPath, earlier, earlier)
+		os.Chtimes(keyPath, earlier, earlier)
+		certs.mu.Lock()
+		certs.checked = time.Time{}
+		certs.mu.Unlock()
+
+		resp, err := get(client(clientCert))
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		if got := resp.TLS.PeerCertificates[0].SerialNumber; got.Cmp(renewed.SerialNumber) != 0 {
+			t.Errorf("Expected renewed certificate %v, got %v", renewed.SerialNumber, got)
+		}
+	})
+
+	t.Run("keeps certificate if reload fails", func(t *testing.T) {
+		write("key.pem", []byte("not a key"))
+		later := time.Now().Add(2 * time.Minute)
+		os.Chtimes(keyPath, later, later)
+		certs.mu.Lock()
+		certs.checked = time.Time{}
+		certs.mu.Unlock()
+
+		if _, err := get(client(clientCert)); err != nil {
+			t.Errorf("Expected the previous certificate to be kept, got %v", err)
+		}
+	})
+
+	t.Run("missing files", func(t *testing.T) {
+		if _, err := newCertReloader(filepath.Join(dir, "missing.pem"), keyPath, ""); err == nil {
+			t.Error("Expected error for a missing certificate")
+		}
+		if _, err := newCertReloader(certPath, keyPath, keyPath); err == nil {
+			t.Error("Expected error for a client CA without certificates")
+		}
+	})
+}
+
+func TestHandleCharacterList(t *testing.T) {
+	t.Run("lists images", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		saveTestImage(t, tmpDir, 16, 8, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+		saveTestImage(t, tmpDir, 4, 4, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bd.webp")
+		saveTestImage(t, tmpDir, 4, 4, "507f1f77bcf86cd799439012", "68f5ce16713c155df96639be.webp")
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/character/507f1f77bcf86cd799439011", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+
+		var infos []ImageInfo
+		if err := json.Unmarshal(w.Body.Bytes(), &infos); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if len(infos) != 2 {
+			t.Fatalf("Expected 2 images, got %d: %s", len(infos), w.Body.String())
+		}
+
+		info := infos[0]
+		if info.ID != "68f5ce16713c155df96639bc" {
+			t.Errorf("Unexpected ID: %s", info.ID)
+		}
+		if info.URL != "https://example.com/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp" {
+			t.Errorf("Unexpected URL: %s", info.URL)
+		}
+		if info.Width != 16 || info.Height != 8 {
+			t.Errorf("Expected 16x8, got %dx%d", info.Width, info.Height)
+		}
+		if info.Size == 0 {
+			t.Error("Expected non-zero size")
+		}
+		if info.Created.Unix() != 0x68f5ce16 {
+			t.Errorf("Unexpected creation time: %v", info.Created)
+		}
+	})
+
+	t.Run("no images", func(t *testing.T) {
+		cfg := &Config{ImagesDir: t.TempDir(), MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/character/507f1f77bcf86cd799439011", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if strings.TrimSpace(w.Body.String()) != "[]" {
+			t.Errorf("Expected empty list, got %s", w.Body.String())
+		}
+	})
+
+	t.Run("invalid CharID", func(t *testing.T) {
+		cfg := &Config{ImagesDir: t.TempDir(), MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/character/not-a-valid-objectid", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+}
+
+func TestHandleImageMeta(t *testing.T) {
+	const (
+		charID  = "507f1f77bcf86cd799439011"
+		imageID = "68f5ce16713c155df96639bc"
+	)
+
+	t.Run("stored metadata", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		path := saveTestImage(t, tmpDir, 16, 8, charID, imageID+".webp")
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		if err := cfg.Dirs().WriteMeta(path, storage.Meta{ID: imageID, CharID: charID, SourceURL: "https://example.com/a.png"}); err != nil {
+			t.Fatalf("WriteMeta failed: %v", err)
+		}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/image/"+charID+"/"+imageID+".json", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var meta storage.Meta
+		json.Unmarshal(w.Body.Bytes(), &meta)
+		if meta.SourceURL != "https://example.com/a.png" {
+			t.Errorf("Unexpected metadata: %s", w.Body.String())
+		}
+	})
+
+	t.Run("image without metadata", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		saveTestImage(t, tmpDir, 16, 8, charID, imageID+".webp")
+
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/image/"+charID+"/"+imageID+".json", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var meta storage.Meta
+		json.Unmarshal(w.Body.Bytes(), &meta)
+		if meta.Width != 16 || meta.Height != 8 || meta.Size == 0 || meta.Uploaded.Unix() != 0x68f5ce16 {
+			t.Errorf("Unexpected fallback metadata: %s", w.Body.String())
+		}
+	})
+
+	t.Run("image not found", func(t *testing.T) {
+		cfg := &Config{ImagesDir: t.TempDir(), MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/image/"+charID+"/"+imageID+".json", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotFound {
+			t.Errorf("Expected status 404, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid image ID", func(t *testing.T) {
+		cfg := &Config{ImagesDir: t.TempDir(), MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/image/"+charID+"/..json", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("Expected status 400, got %d", w.Code)
+		}
+	})
+
+	t.Run("deleting image removes metadata", func(t *testing.T) {
+		tmpDir := t.TempDir()
+		path := saveTestImage(t, tmpDir, 16, 8, charID, imageID+".webp")
+		saveTestImage(t, tmpDir, 16, 8, charID, "68f5ce16713c155df96639bd.webp")
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		if err := cfg.Dirs().WriteMeta(path, storage.Meta{ID: imageID, CharID: charID}); err != nil {
+			t.Fatalf("WriteMeta failed: %v", err)
+		}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/image/"+charID+"/"+imageID+".webp", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected status 200, got %d: %s", w.Code, w.Body.String())
+		}
+		if checks.PathExists(cfg.Dirs().MetaPath(path)) {
+			t.Error("Metadata should have been deleted with the image")
+		}
+	})
+}
+
+func TestIndexUpdates(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 16, 8)
+
+	ix, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer ix.Close()
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical, Index: ix, Recorders: []Recorder{ix}}
+	router := setupRouter(cfg)
+
+	// Upload three images across two characters and two guilds
+	var urls []string
+	for _, r := range []UploadRequest{
+		{Guild: 1, User: 10, CharID: "507f1f77bcf86cd799439011"},
+		{Guild: 1, User: 10, CharID: "507f1f77bcf86cd799439011"},
+		{Guild: 2, User: 20, CharID: "507f1f77bcf86cd799439012"},
+	} {
+		r.ImageURL = srv.URL + "/avatar.png"
+		body, _ := json.Marshal(r)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", "/image/upload", bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Upload failed with %d: %s", w.Code, w.Body.String())
+		}
+		var url string
+		json.Unmarshal(w.Body.Bytes(), &url)
+		urls = append(urls, url)
+	}
+
+	stats := func(query string) index.Stats {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/stats"+query, nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Stats failed with %d: %s", w.Code, w.Body.String())
+		}
+		var s index.Stats
+		json.Unmarshal(w.Body.Bytes(), &s)
+		return s
+	}
+
+	if s := stats(""); s.Images != 3 || s.Bytes == 0 {
+		t.Errorf("Expected 3 images, got %+v", s)
+	}
+	if s := stats("?guild=1"); s.Images != 2 {
+		t.Errorf("Expected 2 images in guild 1, got %+v", s)
+	}
+	if s := stats("?charid=507f1f77bcf86cd799439012"); s.Images != 1 {
+		t.Errorf("Expected 1 image for character, got %+v", s)
+	}
+
+	// Single delete
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("DELETE", "/image/"+strings.TrimPrefix(urls[0], "https://example.com/"), nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Delete failed with %d: %s", w.Code, w.Body.String())
+	}
+	if s := stats("?guild=1"); s.Images != 1 {
+		t.Errorf("Expected 1 image in guild 1 after delete, got %+v", s)
+	}
+
+	// Guild delete
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/guild/2", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Guild delete failed with %d: %s", w.Code, w.Body.String())
+	}
+	if s := stats(""); s.Images != 1 {
+		t.Errorf("Expected 1 image after guild delete, got %+v", s)
+	}
+
+	// Character delete
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("DELETE", "/character/507f1f77bcf86cd799439011", nil)
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Character delete failed with %d: %s", w.Code, w.Body.String())
+	}
+	if s := stats(""); s.Images != 0 {
+		t.Errorf("Expected no images after character delete, got %+v", s)
+	}
+}
+
+func TestConfigDelete(t *testing.T) {
+	tmpDir := t.TempDir()
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Sharded}
+	first := saveTestImage(t, tmpDir, 4, 4, "11", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	saveTestImage(t, tmpDir, 4, 4, "11", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bd.webp")
+	if err := cfg.Dirs().WriteMeta(first, storage.Meta{ID: "68f5ce16713c155df96639bc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.DeleteImage("507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc"); err != nil {
+		t.Fatalf("DeleteImage failed: %v", err)
+	}
+	if checks.PathExists(first) || checks.PathExists(cfg.Dirs().MetaPath(first)) {
+		t.Error("Expected image and metadata to be deleted")
+	}
+	if err := cfg.DeleteImage("507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist deleting a missing image, got %v", err)
+	}
+
+	images, err := cfg.CharImages("507f1f77bcf86cd799439011")
+	if err != nil || len(images) != 1 {
+		t.Fatalf("Expected 1 remaining image, got %v, %v", images, err)
+	}
+
+	if err := cfg.DeleteCharacter("507f1f77bcf86cd799439011"); err != nil {
+		t.Fatalf("DeleteCharacter failed: %v", err)
+	}
+	if checks.PathExists(filepath.Join(tmpDir, "11")) {
+		t.Error("Expected character and shard directories to be deleted")
+	}
+	if err := cfg.DeleteCharacter("507f1f77bcf86cd799439011"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist deleting a missing character, got %v", err)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	tmpDir := t.TempDir()
+	ix, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer ix.Close()
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Index: ix, Recorders: []Recorder{ix}, TrashRetention: time.Hour}
+	router := setupRouter(cfg)
+	first := saveTestImage(t, tmpDir, 4, 4, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	second := saveTestImage(t, tmpDir, 4, 4, "507f1f77bcf86cd799439012", "68f5ce16713c155df96639bd.webp")
+	if err := cfg.Dirs().WriteMeta(first, storage.Meta{ID: "68f5ce16713c155df96639bc", CharID: "507f1f77bcf86cd799439011", SourceURL: "https://example.com/a.png"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ix.Rebuild(cfg.Dirs(), storage.Flat); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, path, nil)
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := serve("DELETE", "/character/507f1f77bcf86cd799439011")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Delete failed with %d: %s", w.Code, w.Body.String())
+	}
+	batch := w.Header().Get("X-Trash-Batch")
+	if batch == "" {
+		t.Fatal("Expected X-Trash-Batch header")
+	}
+	if checks.PathExists(first) || checks.PathExists(cfg.Dirs().MetaPath(first)) {
+		t.Error("Expected image and metadata to be moved to the trash")
+	}
+	if s, _ := ix.Stats(storage.Filter{}); s.Images != 1 {
+		t.Errorf("Expected trashed image to be removed from the index, got %+v", s)
+	}
+
+	// Trashed files can't be deleted individually
+	w = serve("DELETE", "/image/.trash/"+batch+"/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 deleting from trash, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = serve("GET", "/trash")
+	var batches []storage.Batch
+	json.Unmarshal(w.Body.Bytes(), &batches)
+	if len(batches) != 1 || batches[0].ID != batch || batches[0].Images != 1 {
+		t.Errorf("Unexpected trash listing: %s", w.Body.String())
+	}
+
+	w = serve("POST", "/trash/"+batch+"/restore")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Restore failed with %d: %s", w.Code, w.Body.String())
+	}
+	var restored RestoreResponse
+	json.Unmarshal(w.Body.Bytes(), &restored)
+	expectedURL := "https://example.com/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp"
+	if len(restored.Restored) != 1 || restored.Restored[0] != expectedURL {
+		t.Errorf("Unexpected restore response: %s", w.Body.String())
+	}
+	if !checks.PathExists(first) {
+		t.Error("Expected image to be restored")
+	}
+	if meta, err := cfg.Dirs().ReadMeta(first); err != nil || meta.SourceURL != "https://example.com/a.png" {
+		t.Errorf("Expected metadata to be restored, got %+v, %v", meta, err)
+	}
+	if s, _ := ix.Stats(storage.Filter{}); s.Images != 2 {
+		t.Errorf("Expected restored image to be indexed, got %+v", s)
+	}
+
+	w = serve("POST", "/trash/"+batch+"/restore")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 restoring a missing batch, got %d", w.Code)
+	}
+
+	// Permanent deletes bypass the trash
+	w = serve("DELETE", "/image/507f1f77bcf86cd799439012/68f5ce16713c155df96639bd.webp?permanent=true")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Permanent delete failed with %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get("X-Trash-Batch") != "" || checks.PathExists(second) {
+		t.Error("Expected image to be deleted without the trash")
+	}
+	if batches, _ := storage.Batches(tmpDir); len(batches) != 0 {
+		t.Errorf("Expected empty trash, got %+v", batches)
+	}
+}
+
+func TestHandleImageRotate(t *testing.T) {
+	tmpDir := t.TempDir()
+	ix, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer ix.Close()
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Index: ix, Recorders: []Recorder{ix}}
+	router := setupRouter(cfg)
+	path := saveTestImage(t, tmpDir, 16, 8, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	if err := cfg.Dirs().WriteMeta(path, storage.Meta{ID: "68f5ce16713c155df96639bc", CharID: "507f1f77bcf86cd799439011", SourceURL: "https://example.com/a.png", Width: 16, Height: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	rotate := func(url, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	url := "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp/rotate"
+
+	t.Run("rotate", func(t *testing.T) {
+		w := rotate(url, `{"degrees": 90, "flip": "horizontal"}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var meta storage.Meta
+		json.Unmarshal(w.Body.Bytes(), &meta)
+		if meta.Width != 8 || meta.Height != 16 || meta.Modified.IsZero() || meta.SourceURL != "https://example.com/a.png" {
+			t.Errorf("Unexpected metadata: %+v", meta)
+		}
+
+		config, _, err := convert.ReadConfig(path)
+		if err != nil || config.Width != 8 || config.Height != 16 {
+			t.Errorf("Expected stored image to be 8x16, got %+v, %v", config, err)
+		}
+		saved, err := cfg.Dirs().ReadMeta(path)
+		if err != nil || saved.Width != 8 {
+			t.Errorf("Expected sidecar to be updated, got %+v, %v", saved, err)
+		}
+		if indexed, _ := ix.Find(storage.Filter{ImageID: "68f5ce16713c155df96639bc"}); len(indexed) != 1 || indexed[0].Size != meta.Size {
+			t.Errorf("Expected index to be updated, got %+v", indexed)
+		}
+	})
+
+	tests := []struct {
+		name   string
+		url    string
+		body   string
+		status int
+	}{
+		{"invalid degrees", url, `{"degrees": 45}`, http.StatusBadRequest},
+		{"negative degrees", url, `{"degrees": -90}`, http.StatusBadRequest},
+		{"invalid flip", url, `{"flip": "diagonal"}`, http.StatusBadRequest},
+		{"no change", url, `{}`, http.StatusBadRequest},
+		{"missing image", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp/rotate", `{"degrees": 90}`, http.StatusNotFound},
+		{"wrong extension", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.png/rotate", `{"degrees": 90}`, http.StatusNotFound},
+		{"invalid character", "/image/nope/68f5ce16713c155df96639bc.webp/rotate", `{"degrees": 90}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := rotate(tt.url, tt.body); w.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleImageReplace(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 32, 16)
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical}
+	router := setupRouter(cfg)
+	path := saveTestImage(t, tmpDir, 16, 8, "1", "10", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	uploaded := time.Date(2025, 10, 20, 5, 53, 58, 0, time.UTC)
+	if err := cfg.Dirs().WriteMeta(path, storage.Meta{ID: "68f5ce16713c155df96639bc", CharID: "507f1f77bcf86cd799439011", Guild: 1, User: 10, Width: 16, Uploaded: uploaded}); err != nil {
+		t.Fatal(err)
+	}
+
+	replace := func(url string, r UploadRequest) *httptest.ResponseRecorder {
+		t.Helper()
+		body, _ := json.Marshal(r)
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("PUT", url, bytes.NewBuffer(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	url := "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp"
+
+	t.Run("replace keeping revision", func(t *testing.T) {
+		w := replace(url+"?keep=true", UploadRequest{CharID: "507f1f77bcf86cd799439011", ImageURL: srv.URL + "/new.png"})
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var got string
+		json.Unmarshal(w.Body.Bytes(), &got)
+		if got != "https://example.com/1/10/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp" {
+			t.Errorf("Unexpected URL: %s", got)
+		}
+
+		meta, err := cfg.Dirs().ReadMeta(path)
+		if err != nil {
+			t.Fatalf("ReadMeta failed: %v", err)
+		}
+		if meta.Width != 32 || meta.Guild != 1 || meta.User != 10 || !meta.Uploaded.Equal(uploaded) || meta.Modified.IsZero() || meta.SourceURL != srv.URL+"/new.png" {
+			t.Errorf("Unexpected metadata: %+v", meta)
+		}
+
+		rev := storage.RevisionPath(path, 1)
+		config, _, err := convert.ReadConfig(rev)
+		if err != nil || config.Width != 16 {
+			t.Errorf("Expected previous version as revision, got %+v, %v", config, err)
+		}
+		if prev, err := cfg.Dirs().ReadMeta(rev); err != nil || prev.Width != 16 {
+			t.Errorf("Expected previous metadata as revision, got %+v, %v", prev, err)
+		}
+	})
+
+	t.Run("undecodable image keeps history", func(t *testing.T) {
+		garbage := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("not really a png"))
+		}))
+		defer garbage.Close()
+		rev := storage.RevisionPath(path, 1)
+		before := map[string][]byte{}
+		for _, p := range []string{path, rev} {
+			data, err := os.ReadFile(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before[p] = data
+		}
+
+		if w := replace(url+"?keep=true", UploadRequest{ImageURL: garbage.URL + "/bad.png"}); w.Code != http.StatusInternalServerError {
+			t.Fatalf("Expected 500, got %d: %s", w.Code, w.Body.String())
+		}
+		for p, data := range before {
+			if after, err := os.ReadFile(p); err != nil || !bytes.Equal(after, data) {
+				t.Errorf("Expected %s to be unchanged", p)
+			}
+		}
+		if checks.PathExists(storage.RevisionPath(path, 2)) {
+			t.Error("Expected no new revision")
+		}
+	})
+
+	tests := []struct {
+		name    string
+		url     string
+		request UploadRequest
+		status  int
+	}{
+		{"mismatched character", url, UploadRequest{CharID: "507f1f77bcf86cd799439012", ImageURL: srv.URL}, http.StatusBadRequest},
+		{"mismatched guild", url, UploadRequest{Guild: 2, ImageURL: srv.URL}, http.StatusBadRequest},
+		{"invalid URL", url, UploadRequest{ImageURL: "not a url"}, http.StatusBadRequest},
+		{"missing image", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp", UploadRequest{ImageURL: srv.URL}, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := replace(tt.url, tt.request); w.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("delete removes revisions", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("DELETE", "/image/1/10/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp", nil)
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Delete failed with %d: %s", w.Code, w.Body.String())
+		}
+		if checks.PathExists(filepath.Join(tmpDir, "1")) {
+			t.Error("Expected image, revisions, and directories to be deleted")
+		}
+	})
+}
+
+func TestRevisions(t *testing.T) {
+	tmpDir := t.TempDir()
+	srv := imageServer(t, 32, 16)
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Revisions: 2}
+	router := setupRouter(cfg)
+	path := saveTestImage(t, tmpDir, 16, 8, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+
+	serve := func(method, url, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	listRevisions := func() []RevisionInfo {
+		t.Helper()
+		w := serve("GET", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc/revisions", "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("List failed with %d: %s", w.Code, w.Body.String())
+		}
+		var revisions []RevisionInfo
+		json.Unmarshal(w.Body.Bytes(), &revisions)
+		return revisions
+	}
+	current := "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp"
+
+	if revisions := listRevisions(); len(revisions) != 0 {
+		t.Errorf("Expected no revisions, got %+v", revisions)
+	}
+
+	// 16x8 -> 32x16 (replace) -> 16x32 (rotate) -> 32x16 (replace)
+	if w := serve("PUT", current, `{"image_url": "`+srv.URL+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("Replace failed with %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve("POST", current+"/rotate", `{"degrees": 90}`); w.Code != http.StatusOK {
+		t.Fatalf("Rotate failed with %d: %s", w.Code, w.Body.String())
+	}
+	if w := serve("PUT", current, `{"image_url": "`+srv.URL+`"}`); w.Code != http.StatusOK {
+		t.Fatalf("Replace failed with %d: %s", w.Code, w.Body.String())
+	}
+
+	revisions := listRevisions()
+	if len(revisions) != 2 {
+		t.Fatalf("Expected 2 revisions, got %+v", revisions)
+	}
+	if revisions[0].Revision != 1 || revisions[0].Meta.Width != 16 || revisions[0].Meta.Height != 32 {
+		t.Errorf("Expected revision 1 to be the rotated image, got %+v", revisions[0])
+	}
+	if revisions[1].URL != "https://example.com/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.r2.webp" {
+		t.Errorf("Unexpected revision URL: %s", revisions[1].URL)
+	}
+
+	// Restoring revision 1 brings back the rotated image
+	w := serve("POST", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc/revisions/1/restore", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Restore failed with %d: %s", w.Code, w.Body.String())
+	}
+	if config, _, err := convert.ReadConfig(path); err != nil || config.Width != 16 || config.Height != 32 {
+		t.Errorf("Expected rotated image to be current, got %+v, %v", config, err)
+	}
+	if revisions := listRevisions(); len(revisions) != 2 || revisions[0].Meta.Width != 32 {
+		t.Errorf("Expected replaced image as revision 1, got %+v", revisions)
+	}
+
+	for _, tt := range []struct {
+		url    string
+		status int
+	}{
+		{"/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc/revisions/5/restore", http.StatusNotFound},
+		{"/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc/revisions/0/restore", http.StatusBadRequest},
+		{"/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd/revisions/1/restore", http.StatusNotFound},
+	} {
+		if w := serve("POST", tt.url, ""); w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.url, tt.status, w.Code)
+		}
+	}
+
+	// A rotate that fails to decode leaves the revisions alone
+	if err := os.WriteFile(path, []byte("not a webp"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	before := listRevisions()
+	if w := serve("POST", current+"/rotate", `{"degrees": 90}`); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected 500 rotating an undecodable image, got %d", w.Code)
+	}
+	if after := listRevisions(); !slices.Equal(after, before) {
+		t.Errorf("Revisions changed after a failed rotate: %+v, expected %+v", after, before)
+	}
+}
+
+func TestTransfer(t *testing.T) {
+	tmpDir := t.TempDir()
+	ix, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+	if err != nil {
+		t.Fatalf("Failed to open index: %v", err)
+	}
+	defer ix.Close()
+
+	cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Layout: storage.Hierarchical, Index: ix, Recorders: []Recorder{ix}}
+	router := setupRouter(cfg)
+	first := saveTestImage(t, tmpDir, 4, 4, "1", "10", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	saveTestImage(t, tmpDir, 4, 4, "1", "10", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bd.webp")
+	if _, err := ix.Rebuild(cfg.Dirs(), storage.Hierarchical); err != nil {
+		t.Fatal(err)
+	}
+
+	serve := func(url, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", url, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		return w
+	}
+	count := func(charID string) int {
+		t.Helper()
+		s, _ := ix.Stats(storage.Filter{CharID: charID})
+		return s.Images
+	}
+
+	t.Run("copy image", func(t *testing.T) {
+		w := serve("/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp/copy", `{"charid": "507f1f77bcf86cd799439012"}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var url string
+		json.Unmarshal(w.Body.Bytes(), &url)
+		if !strings.HasPrefix(url, "https://example.com/1/10/507f1f77bcf86cd799439012/") || strings.Contains(url, "68f5ce16713c155df96639bc") {
+			t.Errorf("Unexpected URL: %s", url)
+		}
+		if !checks.PathExists(first) || count("507f1f77bcf86cd799439012") != 1 {
+			t.Error("Expected source to remain and copy to be indexed")
+		}
+	})
+
+	t.Run("move image", func(t *testing.T) {
+		w := serve("/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bc.webp/move", `{"charid": "507f1f77bcf86cd799439013", "user": 20}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var url string
+		json.Unmarshal(w.Body.Bytes(), &url)
+		if url != "https://example.com/1/20/507f1f77bcf86cd799439013/68f5ce16713c155df96639bc.webp" {
+			t.Errorf("Unexpected URL: %s", url)
+		}
+		if checks.PathExists(first) || count("507f1f77bcf86cd799439011") != 1 || count("507f1f77bcf86cd799439013") != 1 {
+			t.Error("Expected image to be moved and reindexed")
+		}
+		moved := filepath.Join(tmpDir, "1", "20", "507f1f77bcf86cd799439013", "68f5ce16713c155df96639bc.webp")
+		if meta, err := cfg.Dirs().ReadMeta(moved); err != nil || meta.CharID != "507f1f77bcf86cd799439013" || meta.User != 20 {
+			t.Errorf("Expected metadata to be updated, got %+v, %v", meta, err)
+		}
+	})
+
+	t.Run("copy character", func(t *testing.T) {
+		w := serve("/character/507f1f77bcf86cd799439011/copy", `{"charid": "507f1f77bcf86cd799439014", "guild": 2, "user": 30}`)
+		if w.Code != http.StatusCreated {
+			t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+		}
+		var results []CopyResult
+		json.Unmarshal(w.Body.Bytes(), &results)
+		if len(results) != 1 || results[0].From != "https://example.com/1/10/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp" || !strings.HasPrefix(results[0].To, "https://example.com/2/30/507f1f77bcf86cd799439014/") {
+			t.Errorf("Unexpected results: %s", w.Body.String())
+		}
+		if count("507f1f77bcf86cd799439014") != 1 {
+			t.Error("Expected copy to be indexed")
+		}
+	})
+
+	tests := []struct {
+		name   string
+		url    string
+		body   string
+		status int
+	}{
+		{"move to same character", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp/move", `{"charid": "507f1f77bcf86cd799439011"}`, http.StatusBadRequest},
+		{"invalid target", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639bd.webp/copy", `{"charid": "nope"}`, http.StatusBadRequest},
+		{"missing image", "/image/507f1f77bcf86cd799439011/68f5ce16713c155df96639be.webp/move", `{"charid": "507f1f77bcf86cd799439012"}`, http.StatusNotFound},
+		{"missing character", "/character/507f1f77bcf86cd799439019/copy", `{"charid": "507f1f77bcf86cd799439012"}`, http.StatusBadRequest},
+		{"copy character to itself", "/character/507f1f77bcf86cd799439011/copy", `{"charid": "507f1f77bcf86cd799439011"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := serve(tt.url, tt.body); w.Code != tt.status {
+				t.Errorf("Expected %d, got %d: %s", tt.status, w.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+func TestHandleStats(t *testing.T) {
+	t.Run("index disabled", func(t *testing.T) {
+		cfg := &Config{ImagesDir: t.TempDir(), MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
+		router := setupRouter(cfg)
+
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("GET", "/stats", nil)
+		router.ServeHTTP(w, req)
+
+		if w.Code != http.StatusNotImplemented {
+			t.Errorf("Expected status 501, got %d", w.Code)
+		}
+	})
+
+	t.Run("invalid filter", func(t *testing.T) {
+		ix, err := index.Open(filepath.Join(t.TempDir(), "index.db"))
+		if err != nil {
+			t.Fatalf("Failed to open index: %v", err)
+		}
+		defer ix.Close()
+
+		cfg := &Config{ImagesDir: t.TempDir(), MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90, Index: ix}
+		router := setupRouter(cfg)
+
+		for _, query := range []string{"?guild=abc", "?user=-1", "?charid=nope"} {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest("GET", "/stats"+query, nil)
+			router.ServeHTTP(w, req)
+
+			if w.Code != http.StatusBadRequest {
+				t.Errorf("Expected status 400 for %s, got %d", query, w.Code)
+			}
+		}
+	})
+}
+
 func TestSetupRouter(t *testing.T) {
 	t.Run("routes registered", func(t *testing.T) {
 		tmpDir, err := os.MkdirTemp("", "test-router-*")
@@ -791,7 +3561,7 @@ func TestSetupRouter(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		// Test POST /image/upload exists
@@ -830,7 +3600,7 @@ func TestSetupRouter(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		w := httptest.NewRecorder()
@@ -849,7 +3619,7 @@ func TestSetupRouter(t *testing.T) {
 		}
 		defer os.RemoveAll(tmpDir)
 
-		cfg := &Config{ImagesDir: tmpDir, BaseURL: "https://example.com", Quality: 90}
+		cfg := &Config{ImagesDir: tmpDir, MetaDir: t.TempDir(), BaseURL: "https://example.com", Quality: 90}
 		router := setupRouter(cfg)
 
 		// Try GET on POST-only route
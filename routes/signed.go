@@ -0,0 +1,93 @@
+package routes
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// defaultSignedURLTTL is how long a signed URL lasts if no lifetime is
+	// requested.
+	defaultSignedURLTTL = time.Hour
+	// maxSignedURLTTL is the longest lifetime a signed URL may have.
+	maxSignedURLTTL = 7 * 24 * time.Hour
+)
+
+// SignRequest is the optional body of a request for a signed URL.
+type SignRequest struct {
+	// ExpiresIn is the URL's lifetime in seconds. If zero, it lasts
+	// defaultSignedURLTTL.
+	ExpiresIn int `json:"expires_in"`
+}
+
+// SignedURL is a URL granting temporary access to an image.
+type SignedURL struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// handleImageSign returns a signed URL for an image, which can be fetched
+// without an API key until it expires.
+func handleImageSign(c *gin.Context, cfg *Config) {
+	if cfg.URLSigner == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Signed URLs are disabled"})
+		return
+	}
+	var request SignRequest
+	if err := c.ShouldBindJSON(&request); err != nil && !errors.Is(err, io.EOF) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ttl := time.Duration(request.ExpiresIn) * time.Second
+	if ttl == 0 {
+		ttl = defaultSignedURLTTL
+	}
+	if ttl < 0 || ttl > maxSignedURLTTL {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "expires_in must be between 1 and " + strconv.Itoa(int(maxSignedURLTTL.Seconds())) + " seconds"})
+		return
+	}
+
+	img, ok := lookupImage(c, cfg, ".webp")
+	if !ok {
+		return
+	}
+
+	path := "/signed/" + img.CharID + "/" + img.ID + ".webp"
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+	query := url.Values{
+		"exp": {strconv.FormatInt(expires.Unix(), 10)},
+		"sig": {cfg.URLSigner.Sign(path, expires.Unix())},
+	}
+	c.JSON(http.StatusOK, SignedURL{URL: cfg.APIURL + path + "?" + query.Encode(), Expires: expires})
+}
+
+// handleSignedImage serves an image to anyone holding an unexpired signed URL
+// for it.
+func handleSignedImage(c *gin.Context, cfg *Config) {
+	if cfg.URLSigner == nil {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Not found"})
+		return
+	}
+	// Check the signature first, so that unsigned requests can't probe for
+	// images
+	err := cfg.URLSigner.Verify(c.Request.URL.Path, c.Query("exp"), c.Query("sig"), time.Now())
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+
+	img, ok := lookupImage(c, cfg, ".webp")
+	if !ok {
+		return
+	}
+	// Caches mustn't keep the image past the URL's expiry
+	expires, _ := strconv.ParseInt(c.Query("exp"), 10, 64)
+	c.Header("Cache-Control", "private, max-age="+strconv.FormatInt(expires-time.Now().Unix(), 10))
+	c.File(img.Path)
+}
@@ -0,0 +1,129 @@
+package routes
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes, at most.
+const certCheckInterval = 10 * time.Second
+
+// certReloader serves a TLS certificate and client CA pool from disk,
+// reloading them when the files change so that renewed certificates are
+// picked up without a restart.
+type certReloader struct {
+	certPath, keyPath, caPath string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	pool     *x509.CertPool
+	modTimes []time.Time
+	checked  time.Time
+}
+
+// newCertReloader loads the certificate and key, and the client CA if caPath
+// isn't empty.
+func newCertReloader(certPath, keyPath, caPath string) (*certReloader, error) {
+	r := &certReloader{certPath: certPath, keyPath: keyPath, caPath: caPath}
+	modTimes, err := r.fileModTimes()
+	if err != nil {
+		return nil, err
+	}
+	if err := r.load(modTimes); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// tlsConfig returns a TLS configuration using the reloader's current
+// certificate. If there's a client CA, any certificate a client presents must
+// be signed by it. Presenting one is optional here, since signed URLs are
+// fetched without credentials; requireClientCert enforces it elsewhere.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := r.current()
+			config := &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				NextProtos:   []string{"h2", "http/1.1"},
+			}
+			if pool != nil {
+				config.ClientAuth = tls.VerifyClientCertIfGiven
+				config.ClientCAs = pool
+			}
+			return config, nil
+		},
+	}
+}
+
+// current returns the certificate and client CA pool, first reloading them
+// if the files' modification times have changed. If they can't be reloaded,
+// the previous ones are kept.
+func (r *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checked) >= certCheckInterval {
+		r.checked = time.Now()
+		modTimes, err := r.fileModTimes()
+		// Any change counts, as replacement files may be older, e.g. if
+		// copied with their times
+		if err == nil && !slices.EqualFunc(modTimes, r.modTimes, time.Time.Equal) {
+			err = r.load(modTimes)
+			if err == nil {
+				slog.Info("Reloaded TLS certificate", "cert", r.certPath)
+			}
+		}
+		if err != nil {
+			slog.Error("Failed to reload TLS certificate, keeping the current one", "err", err)
+		}
+	}
+	return r.cert, r.pool
+}
+
+// load reads the files, recording modTimes as the times they were last
+// changed. The caller must hold r.mu, if r is shared.
+func (r *certReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certPath, r.keyPath)
+	if err != nil {
+		return fmt.Errorf("failed to load TLS certificate: %w", err)
+	}
+	var pool *x509.CertPool
+	if r.caPath != "" {
+		pem, err := os.ReadFile(r.caPath)
+		if err != nil {
+			return fmt.Errorf("failed to read client CA: %w", err)
+		}
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return errors.New("client CA contains no certificates")
+		}
+	}
+	r.cert, r.pool, r.modTimes = &cert, pool, modTimes
+	return nil
+}
+
+// fileModTimes returns the modification time of each file.
+func (r *certReloader) fileModTimes() ([]time.Time, error) {
+	var times []time.Time
+	for _, path := range []string{r.certPath, r.keyPath, r.caPath} {
+		if path == "" {
+			continue
+		}
+		stat, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		times = append(times, stat.ModTime())
+	}
+	return times, nil
+}
@@ -0,0 +1,222 @@
+package routes
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"faceclaimer/checks"
+	"faceclaimer/storage"
+)
+
+// TransferRequest names the character to move or copy images to. Under the
+// hierarchical layout, guild and user default to those of the source images.
+type TransferRequest struct {
+	CharID string `json:"charid"`
+	Guild  int    `json:"guild"`
+	User   int    `json:"user"`
+}
+
+// CopyResult maps a source image's URL to its copy's.
+type CopyResult struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// bindTransfer reads and validates a transfer request. If it's invalid, the
+// request is aborted with an error and ok is false.
+func bindTransfer(c *gin.Context) (request TransferRequest, ok bool) {
+	if err := c.BindJSON(&request); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return request, false
+	}
+	if !checks.IsValidObjectId(request.CharID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid target character ID"})
+		return request, false
+	}
+	if request.Guild < 0 || request.User < 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid target guild or user ID"})
+		return request, false
+	}
+	if request.Guild != 0 && !allowGuild(c, request.Guild) {
+		return request, false
+	}
+	return request, true
+}
+
+// handleImageMove moves an image to another character, keeping its ID. The
+// image param must be in the form imageId.webp.
+func handleImageMove(c *gin.Context, cfg *Config) {
+	request, ok := bindTransfer(c)
+	if !ok {
+		return
+	}
+	img, ok := lookupImage(c, cfg, ".webp")
+	if !ok {
+		return
+	}
+	if request.CharID == img.CharID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Image already belongs to the character"})
+		return
+	}
+	slog.Info("Image move request", "charId", img.CharID, "imageId", img.ID, "target", request.CharID)
+
+	url, err := transferImage(cfg, img, request, false)
+	if err != nil {
+		abortTransfer(c, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, url)
+}
+
+// handleImageCopy copies an image to another character, or the same one,
+// under a new ID. The image param must be in the form imageId.webp.
+func handleImageCopy(c *gin.Context, cfg *Config) {
+	request, ok := bindTransfer(c)
+	if !ok {
+		return
+	}
+	img, ok := lookupImage(c, cfg, ".webp")
+	if !ok {
+		return
+	}
+	slog.Info("Image copy request", "charId", img.CharID, "imageId", img.ID, "target", request.CharID)
+
+	url, err := transferImage(cfg, img, request, true)
+	if err != nil {
+		abortTransfer(c, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, url)
+}
+
+// handleCharacterCopy copies all of a character's images to another
+// character, under new IDs.
+func handleCharacterCopy(c *gin.Context, cfg *Config) {
+	charID := c.Param("charID")
+	if !checks.IsValidObjectId(charID) {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid character ID"})
+		return
+	}
+	request, ok := bindTransfer(c)
+	if !ok {
+		return
+	}
+	if request.CharID == charID {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Cannot copy a character to itself"})
+		return
+	}
+	if !allowCharacter(c, cfg, charID) {
+		return
+	}
+
+	images, err := cfg.Layout.CharImages(cfg.ImagesDir, charID)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if len(images) == 0 {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Character directory not found"})
+		return
+	}
+	slog.Info("Character copy request", "charId", charID, "target", request.CharID, "images", len(images))
+
+	results := make([]CopyResult, 0, len(images))
+	for _, img := range images {
+		url, err := transferImage(cfg, img, request, true)
+		if err != nil {
+			abortTransfer(c, err)
+			return
+		}
+		results = append(results, CopyResult{From: imageURL(cfg, img.Parts(cfg.Layout)), To: url})
+	}
+
+	c.JSON(http.StatusCreated, results)
+}
+
+// errOwnersRequired reports a transfer whose target guild and user couldn't
+// be determined.
+var errOwnersRequired = errors.New("guild and user are required by the hierarchical layout")
+
+// abortTransfer aborts a move or copy request with an error suited to err.
+func abortTransfer(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, os.ErrExist):
+		c.AbortWithStatusJSON(http.StatusConflict, gin.H{"error": "Target image already exists"})
+	case errors.Is(err, errOwnersRequired):
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	}
+}
+
+// transferImage moves or copies an image to the character in the request,
+// then updates its metadata and records, returning its new URL. Duplicates
+// get a new ID; moved images keep theirs, along with their revisions.
+func transferImage(cfg *Config, img storage.Image, r TransferRequest, duplicate bool) (string, error) {
+	editMu.Lock()
+	defer editMu.Unlock()
+
+	meta, err := cfg.Dirs().LoadMeta(img)
+	if err != nil {
+		return "", err
+	}
+
+	moved := storage.Filter{Guild: meta.Guild, User: meta.User, CharID: img.CharID, ImageID: img.ID}
+	dst := storage.Image{Guild: meta.Guild, User: meta.User, CharID: r.CharID, ID: img.ID}
+	if r.Guild != 0 {
+		dst.Guild = r.Guild
+	}
+	if r.User != 0 {
+		dst.User = r.User
+	}
+	if cfg.Layout.UsesOwners() && (dst.Guild == 0 || dst.User == 0) {
+		return "", errOwnersRequired
+	}
+	if duplicate {
+		dst.ID = primitive.NewObjectID().Hex()
+	}
+	parts := dst.Parts(cfg.Layout)
+	dest, err := checks.AbsPath(cfg.ImagesDir, filepath.Join(parts...))
+	if err != nil {
+		return "", err
+	}
+
+	if duplicate {
+		err = storage.CopyImage(img, dest)
+	} else {
+		err = storage.MoveImage(cfg.Dirs(), img, dest)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to transfer %s: %w", img.Path, err)
+	}
+
+	meta.ID = dst.ID
+	meta.CharID = dst.CharID
+	meta.Guild = dst.Guild
+	meta.User = dst.User
+	if duplicate {
+		meta.Uploaded = time.Now().UTC()
+		meta.Modified = time.Time{}
+	}
+	if err := cfg.Dirs().WriteMeta(dest, meta); err != nil {
+		slog.Warn("Failed to write image metadata", "path", dest, "error", err)
+	}
+
+	url := imageURL(cfg, parts)
+	if !duplicate {
+		recordDeleted(cfg, moved)
+		cleanStorageDirs(cfg)
+	}
+	recordSaved(cfg, meta, url)
+	return url, nil
+}
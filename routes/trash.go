@@ -0,0 +1,114 @@
+package routes
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"faceclaimer/storage"
+)
+
+// purgeInterval is how often expired trash batches are purged.
+const purgeInterval = time.Hour
+
+// trashBatchHeader is the response header naming the trash batch a delete
+// moved images to.
+const trashBatchHeader = "X-Trash-Batch"
+
+// RestoreResponse reports the outcome of restoring a trash batch.
+type RestoreResponse struct {
+	// Restored lists the URLs of the restored images.
+	Restored []string `json:"restored"`
+	// Conflicts lists files left in the trash because a file already exists
+	// at their original path.
+	Conflicts []string `json:"conflicts"`
+}
+
+// permanent returns true if a delete request asked to bypass the trash.
+func permanent(c *gin.Context) bool {
+	return c.Query("permanent") == "true"
+}
+
+// useTrash returns true if a delete should move images to the trash.
+func useTrash(cfg *Config, permanent bool) bool {
+	return cfg.TrashRetention > 0 && !permanent
+}
+
+// setTrashBatch reports the trash batch a delete moved images to, if any.
+func setTrashBatch(c *gin.Context, batch string) {
+	if batch != "" {
+		c.Header(trashBatchHeader, batch)
+	}
+}
+
+// handleTrashList lists the batches in the trash.
+func handleTrashList(c *gin.Context, cfg *Config) {
+	if !allowAllGuilds(c) {
+		return
+	}
+	batches, err := storage.Batches(cfg.ImagesDir)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, batches)
+}
+
+// handleTrashRestore moves the images in a trash batch back to their original
+// locations.
+func handleTrashRestore(c *gin.Context, cfg *Config) {
+	if !allowAllGuilds(c) {
+		return
+	}
+	result, err := cfg.Layout.Restore(cfg.Dirs(), c.Param("batch"))
+	if errors.Is(err, os.ErrNotExist) {
+		c.AbortWithStatusJSON(http.StatusNotFound, gin.H{"error": "Trash batch not found"})
+		return
+	}
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	resp := RestoreResponse{Restored: []string{}, Conflicts: []string{}}
+	for _, img := range result.Restored {
+		url := imageURL(cfg, img.Parts(cfg.Layout))
+		resp.Restored = append(resp.Restored, url)
+		meta, err := cfg.Dirs().LoadMeta(img)
+		if err != nil {
+			slog.Warn("Failed to read restored image metadata", "path", img.Path, "error", err)
+			continue
+		}
+		recordSaved(cfg, meta, url)
+	}
+	resp.Conflicts = append(resp.Conflicts, result.Conflicts...)
+	slog.Info("Restored trash batch", "batch", c.Param("batch"), "restored", len(resp.Restored), "conflicts", len(resp.Conflicts))
+
+	c.JSON(http.StatusOK, resp)
+}
+
+// purgeTrash permanently deletes expired trash batches now and then every
+// purgeInterval, until ctx is cancelled.
+func purgeTrash(ctx context.Context, cfg *Config) {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for {
+		purged, err := storage.PurgeTrash(cfg.Dirs(), time.Now().Add(-cfg.TrashRetention))
+		if err != nil {
+			slog.Error("Failed to purge trash", "error", err)
+		} else if purged > 0 {
+			slog.Info("Purged trash", "batches", purged)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
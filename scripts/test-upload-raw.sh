@@ -0,0 +1,7 @@
+#!/bin/sh
+
+# Usage: test-upload-raw.sh image.png
+curl -X PUT \
+  -H "Content-Type: image/${1##*.}" \
+  --data-binary "@$1" \
+  "http://127.0.0.1:8080/character/68f5a69c1cd9d39b5e9d7ba1/images?guild=12345&user=67890"
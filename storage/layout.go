@@ -0,0 +1,123 @@
+// storage describes how images are arranged inside the images directory.
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Layout determines the directory structure images are saved in.
+type Layout string
+
+const (
+	// Flat stores images as charId/imageId.webp. This is the default.
+	Flat Layout = "flat"
+	// Hierarchical stores images as guildId/userId/charId/imageId.webp.
+	Hierarchical Layout = "hierarchical"
+	// Sharded stores images as shard/charId/imageId.webp, where shard is the
+	// last two hex digits of charId. This keeps the number of entries in the
+	// images directory itself bounded at 256.
+	Sharded Layout = "sharded"
+)
+
+// Layouts lists every supported layout, in the order shown in help text.
+var Layouts = []Layout{Flat, Hierarchical, Sharded}
+
+// ParseLayout returns the Layout named by s.
+func ParseLayout(s string) (Layout, error) {
+	for _, l := range Layouts {
+		if string(l) == s {
+			return l, nil
+		}
+	}
+	return "", fmt.Errorf("unknown layout %q (expected one of %v)", s, Layouts)
+}
+
+// UsesOwners returns true if the layout includes the guild and user IDs.
+func (l Layout) UsesOwners() bool {
+	return l == Hierarchical
+}
+
+// Parts returns the path components for an image. The result can be used with
+// filepath.Join for OS-specific file paths or strings.Join for URLs. An empty
+// Layout is treated as Flat.
+func (l Layout) Parts(guild, user int, charID, imageName string) []string {
+	switch l {
+	case Hierarchical:
+		return []string{strconv.Itoa(guild), strconv.Itoa(user), charID, imageName}
+	case Sharded:
+		return []string{shard(charID), charID, imageName}
+	default:
+		return []string{charID, imageName}
+	}
+}
+
+// CharDirs returns every existing directory holding charID's images. Under the
+// hierarchical layout, a character may exist beneath more than one guild/user
+// pair, though in practice there will be at most one. Callers are responsible
+// for validating charID.
+func (l Layout) CharDirs(imagesDir, charID string) ([]string, error) {
+	var pattern string
+	switch l {
+	case Hierarchical:
+		pattern = filepath.Join(imagesDir, "*", "*", charID)
+	case Sharded:
+		pattern = filepath.Join(imagesDir, shard(charID), charID)
+	default:
+		pattern = filepath.Join(imagesDir, charID)
+	}
+	return filepath.Glob(pattern)
+}
+
+// UserDirs returns every existing directory holding a user's images, across
+// all guilds. It returns an error if the layout doesn't track users.
+func (l Layout) UserDirs(imagesDir, user string) ([]string, error) {
+	if !l.UsesOwners() {
+		return nil, fmt.Errorf("the %s layout does not store images by user", l.orDefault())
+	}
+	return filepath.Glob(filepath.Join(imagesDir, "*", user))
+}
+
+// GuildDir returns the directory holding a guild's images. It returns an
+// error if the layout doesn't track guilds.
+func (l Layout) GuildDir(imagesDir, guild string) (string, error) {
+	if !l.UsesOwners() {
+		return "", fmt.Errorf("the %s layout does not store images by guild", l.orDefault())
+	}
+	return filepath.Join(imagesDir, guild), nil
+}
+
+// orDefault returns the effective layout, substituting Flat for an empty one.
+func (l Layout) orDefault() Layout {
+	if l == "" {
+		return Flat
+	}
+	return l
+}
+
+// shard returns the sharded layout's directory for charID. ObjectIDs begin
+// with a timestamp, so the trailing counter bytes give a far more even spread.
+func shard(charID string) string {
+	if len(charID) < 2 {
+		return charID
+	}
+	return strings.ToLower(charID[len(charID)-2:])
+}
+
+// Filter selects images by owner and ID. Zero fields match everything.
+type Filter struct {
+	Guild   int
+	User    int
+	CharID  string
+	ImageID string
+}
+
+// Matches returns true if meta passes the filter.
+func (f Filter) Matches(meta Meta) bool {
+	return (f.Guild == 0 || meta.Guild == f.Guild) &&
+		(f.User == 0 || meta.User == f.User) &&
+		(f.CharID == "" || meta.CharID == f.CharID) &&
+		(f.ImageID == "" || meta.ID == f.ImageID)
+}
@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseLayout(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		expected  Layout
+		expectErr bool
+	}{
+		{"flat", "flat", Flat, false},
+		{"hierarchical", "hierarchical", Hierarchical, false},
+		{"empty", "", "", true},
+		{"unknown", "nested", "", true},
+		{"wrong case", "Flat", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result, err := ParseLayout(tt.input)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("ParseLayout(%q) expected error, got %q", tt.input, result)
+				}
+				return
+			}
+			if err != nil {
+				t.Errorf("ParseLayout(%q) unexpected error: %v", tt.input, err)
+			}
+			if result != tt.expected {
+				t.Errorf("ParseLayout(%q) = %q, expected %q", tt.input, result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParts(t *testing.T) {
+	tests := []struct {
+		name     string
+		layout   Layout
+		expected []string
+	}{
+		{"flat", Flat, []string{"507f1f77bcf86cd799439011", "img.webp"}},
+		{"empty defaults to flat", "", []string{"507f1f77bcf86cd799439011", "img.webp"}},
+		{"hierarchical", Hierarchical, []string{"123", "456", "507f1f77bcf86cd799439011", "img.webp"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := tt.layout.Parts(123, 456, "507f1f77bcf86cd799439011", "img.webp")
+			if !reflect.DeepEqual(result, tt.expected) {
+				t.Errorf("Parts() = %v, expected %v", result, tt.expected)
+			}
+		})
+	}
+}
+
+func TestCharDirs(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-layout-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	flatDir := filepath.Join(tmpDir, "507f1f77bcf86cd799439011")
+	nestedDir := filepath.Join(tmpDir, "123", "456", "507f1f77bcf86cd799439011")
+	for _, dir := range []string{flatDir, nestedDir} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Failed to create dir: %v", err)
+		}
+	}
+
+	dirs, err := Flat.CharDirs(tmpDir, "507f1f77bcf86cd799439011")
+	if err != nil {
+		t.Fatalf("CharDirs failed: %v", err)
+	}
+	if !reflect.DeepEqual(dirs, []string{flatDir}) {
+		t.Errorf("Flat.CharDirs() = %v, expected %v", dirs, []string{flatDir})
+	}
+
+	dirs, err = Hierarchical.CharDirs(tmpDir, "507f1f77bcf86cd799439011")
+	if err != nil {
+		t.Fatalf("CharDirs failed: %v", err)
+	}
+	if !reflect.DeepEqual(dirs, []string{nestedDir}) {
+		t.Errorf("Hierarchical.CharDirs() = %v, expected %v", dirs, []string{nestedDir})
+	}
+}
+
+func TestOwnerDirsRequireHierarchical(t *testing.T) {
+	if _, err := Flat.GuildDir("/images", "123"); err == nil {
+		t.Error("Flat.GuildDir() should return an error")
+	}
+	if _, err := Flat.UserDirs("/images", "456"); err == nil {
+		t.Error("Flat.UserDirs() should return an error")
+	}
+
+	dir, err := Hierarchical.GuildDir("/images", "123")
+	if err != nil {
+		t.Fatalf("Hierarchical.GuildDir() unexpected error: %v", err)
+	}
+	if dir != filepath.Join("/images", "123") {
+		t.Errorf("Hierarchical.GuildDir() = %q", dir)
+	}
+}
@@ -0,0 +1,241 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"faceclaimer/convert"
+)
+
+// Meta is the metadata recorded for each uploaded image, in a sidecar file
+// named imageId.json in the metadata directory. See Dirs.
+type Meta struct {
+	ID           string    `json:"id"`
+	CharID       string    `json:"charid"`
+	Guild        int       `json:"guild,omitempty"`
+	User         int       `json:"user,omitempty"`
+	SourceURL    string    `json:"source_url,omitempty"`
+	SourceFormat string    `json:"source_format,omitempty"`
+	SourceWidth  int       `json:"source_width,omitempty"`
+	SourceHeight int       `json:"source_height,omitempty"`
+	Width        int       `json:"width"`
+	Height       int       `json:"height"`
+	Size         int64     `json:"size"`
+	Quality      int       `json:"quality,omitempty"`
+	Mode         string    `json:"mode,omitempty"`
+	Hash         string    `json:"phash,omitempty"`
+	Uploaded     time.Time `json:"uploaded"`
+	// Modified is when the image was last edited, if ever.
+	Modified time.Time `json:"modified,omitzero"`
+}
+
+// Encoding modes recorded in Meta.Mode.
+const (
+	ModeLossy    = "lossy"
+	ModeLossless = "lossless"
+)
+
+// Dirs locates stored images and their metadata. Each image's sidecar
+// metadata is kept under Meta, at the image's path relative to Images, so that
+// serving the images directory never serves the metadata. If Meta is empty, no
+// metadata is kept.
+type Dirs struct {
+	Images string
+	Meta   string
+}
+
+// MetaMirror returns the path under d.Meta corresponding to path, a file or
+// directory under d.Images. It returns "" if no metadata is kept, or path
+// isn't inside d.Images.
+func (d Dirs) MetaMirror(path string) string {
+	if d.Meta == "" {
+		return ""
+	}
+	rel, err := filepath.Rel(d.Images, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return filepath.Join(d.Meta, rel)
+}
+
+// MetaPath returns the location of the sidecar metadata file for the image
+// at imagePath, or "" if it has none, as for MetaMirror.
+func (d Dirs) MetaPath(imagePath string) string {
+	mirror := d.MetaMirror(imagePath)
+	if mirror == "" {
+		return ""
+	}
+	return strings.TrimSuffix(mirror, ".webp") + ".json"
+}
+
+// ReadMeta reads the sidecar metadata for the image at imagePath.
+func (d Dirs) ReadMeta(imagePath string) (Meta, error) {
+	path := d.MetaPath(imagePath)
+	if path == "" {
+		return Meta{}, &fs.PathError{Op: "read metadata", Path: imagePath, Err: fs.ErrNotExist}
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Meta{}, err
+	}
+	var meta Meta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return Meta{}, fmt.Errorf("invalid metadata for %s: %w", imagePath, err)
+	}
+	return meta, nil
+}
+
+// LoadMeta returns the metadata for img. Images uploaded before metadata was
+// recorded, or while it wasn't kept, have no sidecar file; for these,
+// LoadMeta returns what can be read from the image itself.
+func (d Dirs) LoadMeta(img Image) (Meta, error) {
+	meta, err := d.ReadMeta(img.Path)
+	if !os.IsNotExist(err) {
+		return meta, err
+	}
+
+	stat, err := os.Stat(img.Path)
+	if err != nil {
+		return Meta{}, err
+	}
+	config, _, err := convert.ReadConfig(img.Path)
+	if err != nil {
+		return Meta{}, err
+	}
+	return Meta{
+		ID:       img.ID,
+		CharID:   img.CharID,
+		Guild:    img.Guild,
+		User:     img.User,
+		Width:    config.Width,
+		Height:   config.Height,
+		Size:     stat.Size(),
+		Uploaded: img.Created(),
+	}, nil
+}
+
+// WriteMeta writes the sidecar metadata for the image at imagePath, replacing
+// any existing metadata atomically. It does nothing if no metadata is kept.
+func (d Dirs) WriteMeta(imagePath string, meta Meta) error {
+	if d.Meta == "" {
+		return nil
+	}
+	dest := d.MetaPath(imagePath)
+	if dest == "" {
+		return fmt.Errorf("%s is not inside %s", imagePath, d.Images)
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(dest), "."+filepath.Base(dest)+".partial")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// RemoveMeta deletes the sidecar metadata for the image at imagePath, if any,
+// then removes any of its parent directories left empty, stopping at d.Meta.
+func (d Dirs) RemoveMeta(imagePath string) error {
+	path := d.MetaPath(imagePath)
+	if path == "" {
+		return nil
+	}
+	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	removeEmptyParents(filepath.Dir(path), d.Meta)
+	return err
+}
+
+// removeEmptyParents removes dir and each of its parents that are empty,
+// stopping at root.
+func removeEmptyParents(dir, root string) {
+	for ; dir != root && strings.HasPrefix(dir, root); dir = filepath.Dir(dir) {
+		// Fails if the directory isn't empty, which ends the cleanup
+		if os.Remove(dir) != nil {
+			break
+		}
+	}
+}
+
+// legacyMetaDir is the hidden directory, beside each image, that older
+// versions kept its sidecar metadata in. Before that, sidecars were kept
+// directly beside their images.
+const legacyMetaDir = ".meta"
+
+// MoveLegacyMeta moves sidecar metadata that older versions kept inside the
+// images directory into d.Meta, returning the number of files moved. Sidecars
+// of trashed images and previous revisions are moved too. JSON files that
+// aren't an image's sidecar are left alone. If d.Meta already has metadata
+// for an image, the legacy copy is deleted.
+func MoveLegacyMeta(d Dirs) (int, error) {
+	if d.Meta == "" {
+		return 0, errors.New("no metadata directory given")
+	}
+	moved := 0
+	err := filepath.WalkDir(d.Images, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		base, ok := strings.CutSuffix(path, ".json")
+		if !ok {
+			return nil
+		}
+		dir, name := filepath.Dir(base), filepath.Base(base)
+		var imagePath string
+		if filepath.Base(dir) == legacyMetaDir {
+			imagePath = filepath.Join(filepath.Dir(dir), name+".webp")
+		} else if exists(base + ".webp") {
+			imagePath = base + ".webp"
+		} else {
+			return nil
+		}
+
+		dest := d.MetaPath(imagePath)
+		if exists(dest) {
+			return os.Remove(path)
+		}
+		if err := moveFile(path, dest); err != nil {
+			return err
+		}
+		moved++
+		return nil
+	})
+	if err != nil {
+		return moved, err
+	}
+	removeLegacyMetaDirs(d.Images)
+	return moved, nil
+}
+
+// removeLegacyMetaDirs removes every empty legacy metadata directory under
+// dir, and any directories that leaves empty.
+func removeLegacyMetaDirs(dir string) {
+	var legacy []string
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() && d.Name() == legacyMetaDir {
+			legacy = append(legacy, path)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	for _, path := range legacy {
+		removeEmptyParents(path, dir)
+	}
+}
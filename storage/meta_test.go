@@ -0,0 +1,162 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testDirs returns new, empty images and metadata directories.
+func testDirs(t *testing.T) Dirs {
+	t.Helper()
+	return Dirs{Images: t.TempDir(), Meta: t.TempDir()}
+}
+
+func TestMetaPath(t *testing.T) {
+	d := Dirs{Images: filepath.Join("srv", "images"), Meta: filepath.Join("srv", "meta")}
+	tests := []struct {
+		name      string
+		imagePath string
+		want      string
+	}{
+		{"image", filepath.Join("srv", "images", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp"), filepath.Join("srv", "meta", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.json")},
+		{"revision", filepath.Join("srv", "images", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.r1.webp"), filepath.Join("srv", "meta", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.r1.json")},
+		{"outside images", filepath.Join("srv", "other", "68f5ce16713c155df96639bc.webp"), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := d.MetaPath(tt.imagePath); got != tt.want {
+				t.Errorf("MetaPath() = %q, expected %q", got, tt.want)
+			}
+		})
+	}
+
+	if got := (Dirs{Images: d.Images}).MetaPath(tests[0].imagePath); got != "" {
+		t.Errorf("MetaPath() without a metadata directory = %q, expected none", got)
+	}
+}
+
+func TestMetaRoundTrip(t *testing.T) {
+	d := testDirs(t)
+	imagePath := filepath.Join(d.Images, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+
+	meta := Meta{
+		ID:           "68f5ce16713c155df96639bc",
+		CharID:       "507f1f77bcf86cd799439011",
+		Guild:        123,
+		User:         456,
+		SourceURL:    "https://example.com/image.png",
+		SourceFormat: "png",
+		Width:        16,
+		Height:       8,
+		Size:         512,
+		Quality:      90,
+		Mode:         ModeLossy,
+		Hash:         "0123456789abcdef",
+		Uploaded:     time.Date(2025, 10, 20, 5, 53, 58, 0, time.UTC),
+	}
+	if err := d.WriteMeta(imagePath, meta); err != nil {
+		t.Fatalf("WriteMeta failed: %v", err)
+	}
+
+	got, err := d.ReadMeta(imagePath)
+	if err != nil {
+		t.Fatalf("ReadMeta failed: %v", err)
+	}
+	if got != meta {
+		t.Errorf("ReadMeta() = %+v, expected %+v", got, meta)
+	}
+
+	// Nothing is written to the images directory, and no temporary files are
+	// left behind
+	if entries, _ := os.ReadDir(d.Images); len(entries) != 0 {
+		t.Errorf("Expected nothing in the images directory, found %d entries", len(entries))
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(d.MetaPath(imagePath))); len(entries) != 1 {
+		t.Errorf("Expected only the metadata file, found %d entries", len(entries))
+	}
+
+	if err := d.RemoveMeta(imagePath); err != nil {
+		t.Fatalf("RemoveMeta failed: %v", err)
+	}
+	if _, err := d.ReadMeta(imagePath); !os.IsNotExist(err) {
+		t.Errorf("Expected metadata to be removed, got %v", err)
+	}
+	if entries, _ := os.ReadDir(d.Meta); len(entries) != 0 {
+		t.Errorf("Expected empty metadata directories to be removed, found %d entries", len(entries))
+	}
+
+	// Removing missing metadata is not an error
+	if err := d.RemoveMeta(imagePath); err != nil {
+		t.Errorf("RemoveMeta on missing metadata failed: %v", err)
+	}
+
+	// Without a metadata directory, nothing is kept
+	none := Dirs{Images: d.Images}
+	if err := none.WriteMeta(imagePath, meta); err != nil {
+		t.Errorf("WriteMeta without a metadata directory failed: %v", err)
+	}
+	if _, err := none.ReadMeta(imagePath); !os.IsNotExist(err) {
+		t.Errorf("Expected no metadata without a metadata directory, got %v", err)
+	}
+}
+
+func TestMoveLegacyMeta(t *testing.T) {
+	d := testDirs(t)
+	dir := filepath.Join(d.Images, "507f1f77bcf86cd799439011")
+	image := filepath.Join(dir, "68f5ce16713c155df96639bc.webp")
+	revision := RevisionPath(image, 1)
+	hidden := filepath.Join(dir, "68f5ce16713c155df96639be.webp")
+	trashed := filepath.Join(d.Images, TrashDir, "20251020T055358.000000000Z", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bd.webp")
+	legacy := map[string]string{
+		// Beside the image
+		image:    filepath.Join(dir, "68f5ce16713c155df96639bc.json"),
+		revision: filepath.Join(dir, "68f5ce16713c155df96639bc.r1.json"),
+		trashed:  filepath.Join(filepath.Dir(trashed), "68f5ce16713c155df96639bd.json"),
+		// In a hidden directory beside the image
+		hidden: filepath.Join(dir, legacyMetaDir, "68f5ce16713c155df96639be.json"),
+	}
+	for imagePath, metaPath := range legacy {
+		for path, data := range map[string]string{imagePath: "webp", metaPath: `{"width": 1}`} {
+			if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// JSON files that aren't an image's metadata are left alone
+	other := filepath.Join(dir, "notes.json")
+	if err := os.WriteFile(other, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	moved, err := MoveLegacyMeta(d)
+	if err != nil {
+		t.Fatalf("MoveLegacyMeta failed: %v", err)
+	}
+	if moved != len(legacy) {
+		t.Errorf("Moved %d files, expected %d", moved, len(legacy))
+	}
+	for imagePath, metaPath := range legacy {
+		if meta, err := d.ReadMeta(imagePath); err != nil || meta.Width != 1 {
+			t.Errorf("Expected metadata for %s to be moved, got %+v, %v", imagePath, meta, err)
+		}
+		if _, err := os.Stat(metaPath); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", metaPath)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, legacyMetaDir)); !os.IsNotExist(err) {
+		t.Error("Expected the empty hidden metadata directory to be removed")
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("Expected unrelated file to remain: %v", err)
+	}
+
+	// Moving again finds nothing
+	if moved, err := MoveLegacyMeta(d); err != nil || moved != 0 {
+		t.Errorf("MoveLegacyMeta() = %d, %v, expected 0, nil", moved, err)
+	}
+}
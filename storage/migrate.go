@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Location is a directory of images and the layout they're stored in.
+type Location struct {
+	Dir    string
+	Layout Layout
+	// MetaDir is the directory holding the images' metadata, if any. It
+	// isn't part of the location's string form.
+	MetaDir string
+}
+
+// Dirs returns where the location's images and metadata are stored.
+func (loc Location) Dirs() Dirs {
+	return Dirs{Images: loc.Dir, Meta: loc.MetaDir}
+}
+
+// ParseLocation parses a location in the form DIR[:LAYOUT]. The layout
+// defaults to Flat, and the directory is made absolute.
+func ParseLocation(s string) (Location, error) {
+	dir, name, found := strings.Cut(s, ":")
+	loc := Location{Dir: dir, Layout: Flat}
+	if found {
+		layout, err := ParseLayout(name)
+		if err != nil {
+			return Location{}, err
+		}
+		loc.Layout = layout
+	}
+	if loc.Dir == "" {
+		return Location{}, errors.New("location is missing a directory")
+	}
+	absDir, err := filepath.Abs(loc.Dir)
+	if err != nil {
+		return Location{}, fmt.Errorf("failed to resolve absolute path for %s: %w", loc.Dir, err)
+	}
+	loc.Dir = absDir
+	return loc, nil
+}
+
+// String returns the location in the form accepted by ParseLocation.
+func (loc Location) String() string {
+	return fmt.Sprintf("%s:%s", loc.Dir, loc.Layout)
+}
+
+// Owner is the guild and user a character belongs to.
+type Owner struct {
+	Guild int
+	User  int
+}
+
+// Move records an image's position before and after a migration.
+type Move struct {
+	From Image
+	To   Image
+}
+
+// MigrateResult summarizes a migration.
+type MigrateResult struct {
+	Total   int
+	Copied  int
+	Skipped int
+	Failed  int
+	// Moves holds every image present at the destination after migrating,
+	// whether copied now or by an earlier, interrupted run.
+	Moves []Move
+}
+
+// Done returns the number of images processed so far.
+func (r MigrateResult) Done() int {
+	return r.Copied + r.Skipped + r.Failed
+}
+
+// MigrateOptions controls Migrate.
+type MigrateOptions struct {
+	// Owners supplies the guild and user of each character, keyed by
+	// character ID. It is needed when migrating to the hierarchical layout
+	// from a layout that doesn't record them.
+	Owners map[string]Owner
+	// Progress, if set, is called after each image is processed.
+	Progress func(MigrateResult)
+}
+
+// Migrate copies every image in from to its place in to, verifying each copy
+// against its source. Images already present at the destination with
+// identical contents are skipped, so an interrupted migration can simply be
+// run again. Source images are never modified. Individual failures are logged
+// and counted rather than aborting the migration.
+func Migrate(from, to Location, opts MigrateOptions) (MigrateResult, error) {
+	if from.Dir == to.Dir && from.Layout == to.Layout {
+		return MigrateResult{}, errors.New("source and destination are the same")
+	}
+	images, err := from.Layout.Images(from.Dir)
+	if err != nil {
+		return MigrateResult{}, err
+	}
+
+	result := MigrateResult{Total: len(images)}
+	for _, src := range images {
+		dst, err := migrateOne(src, from, to, opts.Owners)
+		switch {
+		case err == nil:
+			result.Copied++
+		case errors.Is(err, errUnchanged):
+			result.Skipped++
+		default:
+			slog.Warn("Failed to migrate image", "path", src.Path, "error", err)
+			result.Failed++
+		}
+		if dst != nil {
+			result.Moves = append(result.Moves, Move{From: src, To: *dst})
+		}
+		if opts.Progress != nil {
+			opts.Progress(result)
+		}
+	}
+	return result, nil
+}
+
+// errUnchanged signals that an image was already present at its destination.
+var errUnchanged = errors.New("destination is up to date")
+
+// migrateOne copies src, with its previous revisions, into to. On success,
+// or when the destination is already up to date, it returns the destination
+// image.
+func migrateOne(src Image, from, to Location, owners map[string]Owner) (*Image, error) {
+	dst := src
+	if to.Layout.UsesOwners() && !from.Layout.UsesOwners() {
+		owner, ok := owners[src.CharID]
+		if !ok {
+			return nil, fmt.Errorf("no owner known for character %s", src.CharID)
+		}
+		dst.Guild, dst.User = owner.Guild, owner.User
+	}
+	dst.Path = filepath.Join(append([]string{to.Dir}, dst.Parts(to.Layout)...)...)
+
+	revisions, err := Revisions(src.Path)
+	if err != nil {
+		return nil, err
+	}
+	paths := map[string]string{src.Path: dst.Path}
+	for _, rev := range revisions {
+		paths[rev.Path] = RevisionPath(dst.Path, rev.N)
+	}
+
+	unchanged := true
+	for srcPath, dstPath := range paths {
+		copied, err := migrateFile(srcPath, dstPath)
+		if err != nil {
+			return nil, err
+		}
+		unchanged = unchanged && !copied
+		if err := migrateMeta(from.Dirs(), to.Dirs(), srcPath, dstPath, dst); err != nil {
+			return nil, err
+		}
+	}
+	if unchanged {
+		return &dst, errUnchanged
+	}
+	return &dst, nil
+}
+
+// migrateFile copies src to dst unless dst already has the same contents,
+// reporting whether it copied.
+func migrateFile(src, dst string) (bool, error) {
+	srcSum, err := fileSum(src)
+	if err != nil {
+		return false, err
+	}
+	if dstSum, err := fileSum(dst); err == nil && bytes.Equal(srcSum, dstSum) {
+		return false, nil
+	}
+	if err := copyVerified(src, dst, srcSum); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// migrateMeta copies the sidecar metadata of the image at src, if any, to
+// dst, updating the owner to match the destination image.
+func migrateMeta(from, to Dirs, src, dst string, owner Image) error {
+	meta, err := from.ReadMeta(src)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if owner.Guild != 0 {
+		meta.Guild, meta.User = owner.Guild, owner.User
+	}
+	return to.WriteMeta(dst, meta)
+}
+
+// copyVerified copies src to dst through a temporary file, which is only
+// renamed into place once its contents match sum.
+func copyVerified(src, dst string, sum []byte) error {
+	dir := filepath.Dir(dst)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("unable to create directory %s: %w", dir, err)
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := filepath.Join(dir, "."+filepath.Base(dst)+".partial")
+	out, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("unable to create %s: %w", tmp, err)
+	}
+	defer os.Remove(tmp)
+
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to copy %s: %w", src, err)
+	}
+
+	copySum, err := fileSum(tmp)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sum, copySum) {
+		return fmt.Errorf("verification failed for %s", dst)
+	}
+	return os.Rename(tmp, dst)
+}
+
+// fileSum returns the SHA-256 digest of the file at path.
+func fileSum(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
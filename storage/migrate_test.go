@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseLocation(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		layout    Layout
+		expectErr bool
+	}{
+		{"directory only", "images", Flat, false},
+		{"with layout", "images:sharded", Sharded, false},
+		{"hierarchical", "/mnt/images:hierarchical", Hierarchical, false},
+		{"unknown layout", "images:nested", "", true},
+		{"missing directory", ":flat", "", true},
+		{"empty", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			loc, err := ParseLocation(tt.input)
+			if tt.expectErr {
+				if err == nil {
+					t.Errorf("ParseLocation(%q) expected error, got %v", tt.input, loc)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ParseLocation(%q) unexpected error: %v", tt.input, err)
+			}
+			if loc.Layout != tt.layout {
+				t.Errorf("Expected layout %s, got %s", tt.layout, loc.Layout)
+			}
+			if !filepath.IsAbs(loc.Dir) {
+				t.Errorf("Expected absolute directory, got %s", loc.Dir)
+			}
+		})
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	const (
+		charA = "507f1f77bcf86cd799439011"
+		charB = "507f1f77bcf86cd7994390ab"
+		image = "68f5ce16713c155df96639bc"
+	)
+
+	setup := func(t *testing.T) (string, string) {
+		srcDir, err := os.MkdirTemp("", "test-migrate-src-*")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		dstDir, err := os.MkdirTemp("", "test-migrate-dst-*")
+		if err != nil {
+			t.Fatalf("Failed to create temp dir: %v", err)
+		}
+		writeImage(t, srcDir, charA, image+".webp")
+		writeImage(t, srcDir, charB, image+".webp")
+		return srcDir, dstDir
+	}
+
+	t.Run("flat to sharded", func(t *testing.T) {
+		srcDir, dstDir := setup(t)
+		defer os.RemoveAll(srcDir)
+		defer os.RemoveAll(dstDir)
+
+		from := Location{Dir: srcDir, Layout: Flat}
+		to := Location{Dir: dstDir, Layout: Sharded}
+		result, err := Migrate(from, to, MigrateOptions{})
+		if err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+		if result.Total != 2 || result.Copied != 2 || result.Failed != 0 {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+
+		want := filepath.Join(dstDir, "ab", charB, image+".webp")
+		contents, err := os.ReadFile(want)
+		if err != nil {
+			t.Fatalf("Migrated image missing: %v", err)
+		}
+		original, _ := os.ReadFile(filepath.Join(srcDir, charB, image+".webp"))
+		if string(contents) != string(original) {
+			t.Error("Migrated image contents differ from source")
+		}
+		if len(result.Moves) != 2 || result.Moves[1].To.Path != want {
+			t.Errorf("Unexpected moves: %+v", result.Moves)
+		}
+	})
+
+	t.Run("resume skips migrated images", func(t *testing.T) {
+		srcDir, dstDir := setup(t)
+		defer os.RemoveAll(srcDir)
+		defer os.RemoveAll(dstDir)
+
+		from := Location{Dir: srcDir, Layout: Flat}
+		to := Location{Dir: dstDir, Layout: Flat}
+		if _, err := Migrate(from, to, MigrateOptions{}); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+
+		// Corrupt one copy, as if it had been interrupted
+		corrupted := filepath.Join(dstDir, charA, image+".webp")
+		if err := os.WriteFile(corrupted, []byte("partial"), 0644); err != nil {
+			t.Fatalf("Failed to corrupt image: %v", err)
+		}
+
+		var calls int
+		result, err := Migrate(from, to, MigrateOptions{Progress: func(MigrateResult) { calls++ }})
+		if err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+		if result.Copied != 1 || result.Skipped != 1 {
+			t.Errorf("Expected 1 copied and 1 skipped, got %+v", result)
+		}
+		if calls != 2 {
+			t.Errorf("Expected 2 progress calls, got %d", calls)
+		}
+		if contents, _ := os.ReadFile(corrupted); string(contents) == "partial" {
+			t.Error("Corrupted image should have been replaced")
+		}
+	})
+
+	t.Run("flat to hierarchical requires owners", func(t *testing.T) {
+		srcDir, dstDir := setup(t)
+		defer os.RemoveAll(srcDir)
+		defer os.RemoveAll(dstDir)
+
+		from := Location{Dir: srcDir, Layout: Flat}
+		to := Location{Dir: dstDir, Layout: Hierarchical}
+		owners := map[string]Owner{charA: {Guild: 123, User: 456}}
+		result, err := Migrate(from, to, MigrateOptions{Owners: owners})
+		if err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+		if result.Copied != 1 || result.Failed != 1 {
+			t.Errorf("Expected 1 copied and 1 failed, got %+v", result)
+		}
+		if _, err := os.Stat(filepath.Join(dstDir, "123", "456", charA, image+".webp")); err != nil {
+			t.Errorf("Owned image was not migrated: %v", err)
+		}
+	})
+
+	t.Run("metadata follows image", func(t *testing.T) {
+		srcDir, dstDir := setup(t)
+		defer os.RemoveAll(srcDir)
+		defer os.RemoveAll(dstDir)
+
+		from := Location{Dir: srcDir, Layout: Flat, MetaDir: t.TempDir()}
+		to := Location{Dir: dstDir, Layout: Hierarchical, MetaDir: t.TempDir()}
+		srcImage := filepath.Join(srcDir, charA, image+".webp")
+		if err := from.Dirs().WriteMeta(srcImage, Meta{ID: image, CharID: charA, SourceURL: "https://example.com/a.png"}); err != nil {
+			t.Fatalf("WriteMeta failed: %v", err)
+		}
+
+		owners := map[string]Owner{charA: {Guild: 123, User: 456}, charB: {Guild: 123, User: 789}}
+		if _, err := Migrate(from, to, MigrateOptions{Owners: owners}); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+
+		meta, err := to.Dirs().ReadMeta(filepath.Join(dstDir, "123", "456", charA, image+".webp"))
+		if err != nil {
+			t.Fatalf("Metadata was not migrated: %v", err)
+		}
+		if meta.SourceURL != "https://example.com/a.png" || meta.Guild != 123 || meta.User != 456 {
+			t.Errorf("Unexpected migrated metadata: %+v", meta)
+		}
+	})
+
+	t.Run("revisions follow image", func(t *testing.T) {
+		srcDir, dstDir := setup(t)
+		defer os.RemoveAll(srcDir)
+		defer os.RemoveAll(dstDir)
+
+		from := Location{Dir: srcDir, Layout: Flat, MetaDir: t.TempDir()}
+		to := Location{Dir: dstDir, Layout: Hierarchical, MetaDir: t.TempDir()}
+		srcImage := filepath.Join(srcDir, charA, image+".webp")
+		if err := from.Dirs().WriteMeta(srcImage, Meta{ID: image, CharID: charA}); err != nil {
+			t.Fatalf("WriteMeta failed: %v", err)
+		}
+		for range 2 {
+			if err := KeepRevision(from.Dirs(), srcImage, 2); err != nil {
+				t.Fatalf("KeepRevision failed: %v", err)
+			}
+		}
+
+		owners := map[string]Owner{charA: {Guild: 123, User: 456}, charB: {Guild: 123, User: 789}}
+		if _, err := Migrate(from, to, MigrateOptions{Owners: owners}); err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+
+		dstImage := filepath.Join(dstDir, "123", "456", charA, image+".webp")
+		revisions, err := Revisions(dstImage)
+		if err != nil || len(revisions) != 2 {
+			t.Fatalf("Expected 2 migrated revisions, got %v (%v)", revisions, err)
+		}
+		for _, rev := range revisions {
+			meta, err := to.Dirs().ReadMeta(rev.Path)
+			if err != nil {
+				t.Fatalf("Revision metadata was not migrated: %v", err)
+			}
+			if meta.Guild != 123 || meta.User != 456 {
+				t.Errorf("Expected revision owner to be updated, got %+v", meta)
+			}
+		}
+
+		// Copying only a missing revision still counts as a copy
+		os.Remove(RevisionPath(dstImage, 2))
+		result, err := Migrate(from, to, MigrateOptions{Owners: owners})
+		if err != nil {
+			t.Fatalf("Migrate failed: %v", err)
+		}
+		if result.Copied != 1 || result.Skipped != 1 {
+			t.Errorf("Expected 1 copied and 1 skipped, got %+v", result)
+		}
+		if _, err := os.Stat(RevisionPath(dstImage, 2)); err != nil {
+			t.Errorf("Missing revision was not copied: %v", err)
+		}
+	})
+
+	t.Run("same location rejected", func(t *testing.T) {
+		srcDir, dstDir := setup(t)
+		defer os.RemoveAll(srcDir)
+		defer os.RemoveAll(dstDir)
+
+		loc := Location{Dir: srcDir, Layout: Flat}
+		if _, err := Migrate(loc, loc, MigrateOptions{}); err == nil {
+			t.Error("Expected error migrating a location onto itself")
+		}
+	})
+}
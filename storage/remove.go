@@ -0,0 +1,36 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// RemoveImage deletes img, its sidecar metadata, and its previous revisions,
+// then removes any of its parent directories left empty, stopping at
+// d.Images.
+func RemoveImage(d Dirs, img Image) error {
+	rel, err := filepath.Rel(d.Images, img.Path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return fmt.Errorf("%s is not inside %s", img.Path, d.Images)
+	}
+	revisions, err := RevisionFiles(d, img.Path)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(img.Path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, path := range revisions {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	// Last, so that the metadata's directories are cleaned up once empty
+	if err := d.RemoveMeta(img.Path); err != nil {
+		return err
+	}
+	removeEmptyParents(filepath.Dir(img.Path), d.Images)
+	return nil
+}
@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRemoveImage(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	first := writeImage(t, imagesDir, "1", "10", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	second := writeImage(t, imagesDir, "1", "20", "507f1f77bcf86cd799439012", "68f5ce16713c155df96639bd.webp")
+	if err := d.WriteMeta(first, Meta{ID: "68f5ce16713c155df96639bc"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := KeepRevision(d, first, 2); err != nil {
+		t.Fatal(err)
+	}
+	revision := RevisionPath(first, 1)
+
+	img, ok := Hierarchical.ParsePath(filepath.Join("1", "10", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp"))
+	if !ok {
+		t.Fatal("ParsePath failed")
+	}
+	img.Path = first
+	if err := RemoveImage(d, img); err != nil {
+		t.Fatalf("RemoveImage failed: %v", err)
+	}
+
+	for _, path := range []string{first, d.MetaPath(first), revision, d.MetaPath(revision), filepath.Join(imagesDir, "1", "10")} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("Expected %s to be removed", path)
+		}
+	}
+	if _, err := os.Stat(second); err != nil {
+		t.Errorf("Expected other image to remain: %v", err)
+	}
+
+	outside := Image{Path: filepath.Join(t.TempDir(), "68f5ce16713c155df96639bc.webp")}
+	if err := RemoveImage(d, outside); err == nil {
+		t.Error("Expected error removing an image outside the images directory")
+	}
+}
@@ -0,0 +1,231 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// RevisionPath returns the location of the nth previous revision of the image
+// at imagePath, e.g. imageId.r1.webp. Its sidecar metadata is at
+// Dirs.MetaPath(RevisionPath(imagePath, n)).
+func RevisionPath(imagePath string, n int) string {
+	return fmt.Sprintf("%s.r%d.webp", strings.TrimSuffix(imagePath, ".webp"), n)
+}
+
+// RevisionFiles returns every file belonging to a previous revision of the
+// image at imagePath, including sidecars.
+func RevisionFiles(d Dirs, imagePath string) ([]string, error) {
+	patterns := []string{strings.TrimSuffix(imagePath, ".webp") + ".r*.webp"}
+	if metaPath := d.MetaPath(imagePath); metaPath != "" {
+		patterns = append(patterns, strings.TrimSuffix(metaPath, ".json")+".r*.json")
+	}
+	var files []string
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// Revision is a previous version of an image. Revision 1 is the most recent.
+type Revision struct {
+	N    int
+	Path string
+}
+
+// Revisions returns the previous revisions of the image at imagePath, most
+// recent first.
+func Revisions(imagePath string) ([]Revision, error) {
+	base := strings.TrimSuffix(imagePath, ".webp")
+	matches, err := filepath.Glob(base + ".r*.webp")
+	if err != nil {
+		return nil, err
+	}
+	var revisions []Revision
+	for _, match := range matches {
+		n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(match, base+".r"), ".webp"))
+		if err != nil || n < 1 {
+			continue
+		}
+		revisions = append(revisions, Revision{N: n, Path: match})
+	}
+	sort.Slice(revisions, func(i, j int) bool { return revisions[i].N < revisions[j].N })
+	return revisions, nil
+}
+
+// KeepRevision saves the image at imagePath, and its sidecar metadata if any,
+// as its most recent revision, keeping at most limit revisions. Older
+// revisions are renumbered, and those beyond the limit are deleted. The image
+// is copied before any revision is touched, so if that fails nothing changes.
+func KeepRevision(d Dirs, imagePath string, limit int) error {
+	if limit < 1 {
+		return nil
+	}
+	rev := RevisionPath(imagePath, 1)
+	stage := stagePath(rev)
+	defer os.Remove(stage)
+	if err := linkOrCopy(imagePath, stage); err != nil {
+		return err
+	}
+	var metaStage string
+	if metaPath := d.MetaPath(rev); metaPath != "" {
+		metaStage = stagePath(metaPath)
+		defer os.Remove(metaStage)
+	}
+	hasMeta, err := stageMeta(d.MetaPath(imagePath), metaStage)
+	if err != nil {
+		return err
+	}
+
+	revisions, err := Revisions(imagePath)
+	if err != nil {
+		return err
+	}
+	// Work from the oldest, so that each rename's destination is free
+	for i := len(revisions) - 1; i >= 0; i-- {
+		rev := revisions[i]
+		if rev.N >= limit {
+			if err := removeRevision(d, rev.Path); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := moveRevision(d, rev.Path, RevisionPath(imagePath, rev.N+1)); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Rename(stage, rev); err != nil {
+		return err
+	}
+	if hasMeta {
+		return os.Rename(metaStage, d.MetaPath(rev))
+	}
+	return d.RemoveMeta(rev)
+}
+
+// RestoreRevision makes revision n of the image at imagePath current again.
+// The current image is kept as a revision first, as by KeepRevision with the
+// given limit, which should be at least 1 so that it isn't lost. If the
+// revision doesn't exist, the error satisfies errors.Is(err, os.ErrNotExist).
+func RestoreRevision(d Dirs, imagePath string, n, limit int) error {
+	rev := RevisionPath(imagePath, n)
+	if _, err := os.Stat(rev); err != nil {
+		return fmt.Errorf("revision %d: %w", n, os.ErrNotExist)
+	}
+
+	// Stage the revision, since keeping the current image renumbers it
+	stage := filepath.Join(filepath.Dir(imagePath), "."+filepath.Base(imagePath)+".restore")
+	defer os.Remove(stage)
+	metaStage := d.MetaPath(stage)
+	defer os.Remove(metaStage)
+	if err := linkOrCopy(rev, stage); err != nil {
+		return err
+	}
+	hasMeta, err := stageMeta(d.MetaPath(rev), metaStage)
+	if err != nil {
+		return err
+	}
+
+	if err := KeepRevision(d, imagePath, limit); err != nil {
+		return err
+	}
+	if err := os.Rename(stage, imagePath); err != nil {
+		return err
+	}
+	if hasMeta {
+		return os.Rename(metaStage, d.MetaPath(imagePath))
+	}
+	return d.RemoveMeta(imagePath)
+}
+
+// stageMeta copies the sidecar at metaPath to stage, reporting whether there
+// was one to copy. No metadata is staged if it isn't kept, when metaPath is
+// empty.
+func stageMeta(metaPath, stage string) (bool, error) {
+	if metaPath == "" {
+		return false, nil
+	}
+	err := linkOrCopy(metaPath, stage)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// stagePath returns a hidden path beside path for staging its contents.
+func stagePath(path string) string {
+	return filepath.Join(filepath.Dir(path), "."+filepath.Base(path)+".stage")
+}
+
+// moveRevision renames a revision and its sidecar.
+func moveRevision(d Dirs, src, dst string) error {
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	if d.Meta == "" {
+		return nil
+	}
+	err := os.Rename(d.MetaPath(src), d.MetaPath(dst))
+	if os.IsNotExist(err) {
+		return d.RemoveMeta(dst)
+	}
+	return err
+}
+
+// removeRevision deletes a revision and its sidecar.
+func removeRevision(d Dirs, path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return d.RemoveMeta(path)
+}
+
+// linkOrCopy atomically replaces dst with src's contents, hard linking if
+// possible. Since images are only ever replaced by renaming a new file into
+// place, a link keeps its contents.
+func linkOrCopy(src, dst string) error {
+	tmp := filepath.Join(filepath.Dir(dst), "."+filepath.Base(dst)+".partial")
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	if err := os.Link(src, tmp); err != nil {
+		if os.IsNotExist(err) {
+			return err
+		}
+		if err := copyFile(src, tmp); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, dst)
+}
+
+// copyFile copies src to a new file at dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
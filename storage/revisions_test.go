@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestRevisionPath(t *testing.T) {
+	got := RevisionPath(filepath.Join("images", "68f5ce16713c155df96639bc.webp"), 2)
+	want := filepath.Join("images", "68f5ce16713c155df96639bc.r2.webp")
+	if got != want {
+		t.Errorf("RevisionPath() = %q, expected %q", got, want)
+	}
+}
+
+func TestKeepRevision(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	image := writeImage(t, imagesDir, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	if err := d.WriteMeta(image, Meta{ID: "68f5ce16713c155df96639bc", Width: 1}); err != nil {
+		t.Fatal(err)
+	}
+	original, _ := os.ReadFile(image)
+
+	if err := KeepRevision(d, image, 1); err != nil {
+		t.Fatalf("KeepRevision failed: %v", err)
+	}
+
+	// Replace the image the way edits do, by renaming a new file into place
+	tmp := image + ".new"
+	os.WriteFile(tmp, []byte("replaced"), 0644)
+	os.Rename(tmp, image)
+	d.WriteMeta(image, Meta{ID: "68f5ce16713c155df96639bc", Width: 2})
+
+	rev := RevisionPath(image, 1)
+	if data, _ := os.ReadFile(rev); string(data) != string(original) {
+		t.Errorf("Revision holds %q, expected %q", data, original)
+	}
+	if meta, err := d.ReadMeta(rev); err != nil || meta.Width != 1 {
+		t.Errorf("Expected revision metadata to be kept, got %+v, %v", meta, err)
+	}
+
+	files, err := RevisionFiles(d, image)
+	if err != nil {
+		t.Fatalf("RevisionFiles failed: %v", err)
+	}
+	expected := []string{rev, d.MetaPath(rev)}
+	if !slices.Equal(files, expected) {
+		t.Errorf("RevisionFiles() = %v, expected %v", files, expected)
+	}
+
+	// Revisions aren't images in their own right
+	if images, _ := Flat.Images(imagesDir); len(images) != 1 {
+		t.Errorf("Expected 1 image, got %v", images)
+	}
+}
+
+// replaceImage replaces the file at path with data, the way edits do.
+func replaceImage(t *testing.T, path, data string) {
+	t.Helper()
+	tmp := path + ".new"
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// revisionContents returns the contents of each revision, most recent first.
+func revisionContents(t *testing.T, imagePath string) []string {
+	t.Helper()
+	revisions, err := Revisions(imagePath)
+	if err != nil {
+		t.Fatalf("Revisions failed: %v", err)
+	}
+	var contents []string
+	for i, rev := range revisions {
+		if rev.N != i+1 {
+			t.Errorf("Revision %d numbered %d", i+1, rev.N)
+		}
+		data, _ := os.ReadFile(rev.Path)
+		contents = append(contents, string(data))
+	}
+	return contents
+}
+
+func TestKeepRevisionLimit(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	image := filepath.Join(imagesDir, "68f5ce16713c155df96639bc.webp")
+	replaceImage(t, image, "v1")
+
+	for _, next := range []string{"v2", "v3", "v4"} {
+		if err := KeepRevision(d, image, 2); err != nil {
+			t.Fatalf("KeepRevision failed: %v", err)
+		}
+		replaceImage(t, image, next)
+	}
+	if got := revisionContents(t, image); !slices.Equal(got, []string{"v3", "v2"}) {
+		t.Errorf("Revisions = %v, expected [v3 v2]", got)
+	}
+
+	// Lowering the limit prunes the excess
+	if err := KeepRevision(d, image, 1); err != nil {
+		t.Fatalf("KeepRevision failed: %v", err)
+	}
+	if got := revisionContents(t, image); !slices.Equal(got, []string{"v4"}) {
+		t.Errorf("Revisions = %v, expected [v4]", got)
+	}
+
+	// A zero limit keeps nothing new
+	if err := KeepRevision(d, image, 0); err != nil {
+		t.Fatalf("KeepRevision failed: %v", err)
+	}
+	if got := revisionContents(t, image); len(got) != 1 {
+		t.Errorf("Expected revisions to be untouched, got %v", got)
+	}
+
+	// If the image can't be copied, nothing is renumbered or pruned
+	if err := os.Remove(image); err != nil {
+		t.Fatal(err)
+	}
+	if err := KeepRevision(d, image, 1); err == nil {
+		t.Error("Expected error keeping a missing image")
+	}
+	if got := revisionContents(t, image); !slices.Equal(got, []string{"v4"}) {
+		t.Errorf("Revisions = %v, expected [v4]", got)
+	}
+}
+
+func TestRestoreRevision(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	image := filepath.Join(imagesDir, "68f5ce16713c155df96639bc.webp")
+	replaceImage(t, image, "v1")
+	d.WriteMeta(image, Meta{ID: "68f5ce16713c155df96639bc", Width: 1})
+	for _, next := range []string{"v2", "v3"} {
+		if err := KeepRevision(d, image, 3); err != nil {
+			t.Fatal(err)
+		}
+		replaceImage(t, image, next)
+		d.RemoveMeta(image)
+	}
+
+	if err := RestoreRevision(d, image, 2, 3); err != nil {
+		t.Fatalf("RestoreRevision failed: %v", err)
+	}
+	if data, _ := os.ReadFile(image); string(data) != "v1" {
+		t.Errorf("Current image is %q, expected v1", data)
+	}
+	if meta, err := d.ReadMeta(image); err != nil || meta.Width != 1 {
+		t.Errorf("Expected revision metadata to be restored, got %+v, %v", meta, err)
+	}
+	if got := revisionContents(t, image); !slices.Equal(got, []string{"v3", "v2", "v1"}) {
+		t.Errorf("Revisions = %v, expected [v3 v2 v1]", got)
+	}
+	if entries, _ := os.ReadDir(imagesDir); len(entries) != 4 {
+		t.Errorf("Expected only images to remain, found %d entries", len(entries))
+	}
+	sidecars, _ := os.ReadDir(d.Meta)
+	for _, entry := range sidecars {
+		if strings.HasPrefix(entry.Name(), ".") {
+			t.Errorf("Expected staged files to be removed, found %s", entry.Name())
+		}
+	}
+
+	if err := RestoreRevision(d, image, 9, 3); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist restoring a missing revision, got %v", err)
+	}
+}
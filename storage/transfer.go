@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// MoveImage moves img, with its sidecar metadata and previous revisions, to
+// dest, creating dest's parent directories, and updates its modification
+// time. The image keeps its filename, so dest's filename should match. If
+// dest already exists, the error satisfies errors.Is(err, os.ErrExist).
+func MoveImage(d Dirs, img Image, dest string) error {
+	if exists(dest) {
+		return fmt.Errorf("%s: %w", dest, os.ErrExist)
+	}
+	revisions, err := Revisions(img.Path)
+	if err != nil {
+		return err
+	}
+	if err := moveFile(img.Path, dest); err != nil {
+		return err
+	}
+	// The image is new to its character, so it shouldn't look old to
+	// anything cleaning up unreferenced images
+	now := time.Now()
+	if err := os.Chtimes(dest, now, now); err != nil {
+		return err
+	}
+
+	moves := map[string]string{}
+	if d.Meta != "" {
+		moves[d.MetaPath(img.Path)] = d.MetaPath(dest)
+	}
+	for _, rev := range revisions {
+		revDest := RevisionPath(dest, rev.N)
+		moves[rev.Path] = revDest
+		if d.Meta != "" {
+			moves[d.MetaPath(rev.Path)] = d.MetaPath(revDest)
+		}
+	}
+	for src, dst := range moves {
+		if !exists(src) {
+			continue
+		}
+		if err := moveFile(src, dst); err != nil {
+			return err
+		}
+	}
+	if metaPath := d.MetaPath(img.Path); metaPath != "" {
+		removeEmptyParents(filepath.Dir(metaPath), d.Meta)
+	}
+	return nil
+}
+
+// CopyImage copies img to dest, creating dest's parent directories. Its
+// metadata and revisions aren't copied. If dest already exists, the error
+// satisfies errors.Is(err, os.ErrExist).
+func CopyImage(img Image, dest string) error {
+	if exists(dest) {
+		return fmt.Errorf("%s: %w", dest, os.ErrExist)
+	}
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	return linkOrCopy(img.Path, dest)
+}
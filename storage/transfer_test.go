@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveImage(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	src := writeImage(t, imagesDir, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	d.WriteMeta(src, Meta{ID: "68f5ce16713c155df96639bc"})
+	if err := KeepRevision(d, src, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	img := Image{CharID: "507f1f77bcf86cd799439011", ID: "68f5ce16713c155df96639bc", Path: src}
+	dest := filepath.Join(imagesDir, "507f1f77bcf86cd799439012", "68f5ce16713c155df96639bc.webp")
+	if err := MoveImage(d, img, dest); err != nil {
+		t.Fatalf("MoveImage failed: %v", err)
+	}
+
+	for _, path := range []string{dest, d.MetaPath(dest), RevisionPath(dest, 1), d.MetaPath(RevisionPath(dest, 1))} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("Expected %s to exist: %v", path, err)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Dir(src)); len(entries) != 0 {
+		t.Errorf("Expected source directory to be empty, found %d entries", len(entries))
+	}
+	if _, err := os.Stat(filepath.Dir(d.MetaPath(src))); !os.IsNotExist(err) {
+		t.Error("Expected source metadata directory to be removed")
+	}
+
+	img.Path = dest
+	writeImage(t, imagesDir, "507f1f77bcf86cd799439013", "68f5ce16713c155df96639bc.webp")
+	if err := MoveImage(d, img, filepath.Join(imagesDir, "507f1f77bcf86cd799439013", "68f5ce16713c155df96639bc.webp")); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected ErrExist moving onto an existing image, got %v", err)
+	}
+}
+
+func TestCopyImage(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	src := writeImage(t, imagesDir, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	img := Image{CharID: "507f1f77bcf86cd799439011", ID: "68f5ce16713c155df96639bc", Path: src}
+
+	dest := filepath.Join(imagesDir, "507f1f77bcf86cd799439012", "68f5ce16713c155df96639bd.webp")
+	if err := CopyImage(img, dest); err != nil {
+		t.Fatalf("CopyImage failed: %v", err)
+	}
+	original, _ := os.ReadFile(src)
+	if copied, _ := os.ReadFile(dest); string(copied) != string(original) {
+		t.Errorf("Copy holds %q, expected %q", copied, original)
+	}
+	if err := CopyImage(img, dest); !errors.Is(err, os.ErrExist) {
+		t.Errorf("Expected ErrExist copying onto an existing image, got %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// TrashDir is the directory within the images directory that deleted images
+// are moved to. Each delete creates a batch directory inside it, named for the
+// time of the delete, holding the deleted files at their original paths. The
+// images' metadata is moved to a batch of the same name in the metadata
+// directory's TrashDir.
+const TrashDir = ".trash"
+
+// batchFormat is the time format of batch directory names. It sorts
+// chronologically and is safe to use in URLs.
+const batchFormat = "20060102T150405.000000000Z"
+
+// Batch describes the files removed by a single delete.
+type Batch struct {
+	ID      string    `json:"id"`
+	Deleted time.Time `json:"deleted"`
+	Images  int       `json:"images"`
+	Bytes   int64     `json:"bytes"`
+}
+
+// RestoreResult reports the outcome of restoring a batch.
+type RestoreResult struct {
+	// Restored lists the images restored.
+	Restored []Image
+	// Conflicts lists the paths, relative to the images directory, that
+	// weren't restored because a file already exists there. They remain in the
+	// batch.
+	Conflicts []string
+}
+
+// InTrash returns true if rel, a path relative to the images directory, is
+// inside the trash.
+func InTrash(rel string) bool {
+	first, _, _ := strings.Cut(filepath.ToSlash(filepath.Clean(rel)), "/")
+	return first == TrashDir
+}
+
+// MoveToTrash moves each path, which must be inside d.Images or d.Meta, into
+// a new trash batch, returning the batch ID. Paths that don't exist are
+// skipped.
+func MoveToTrash(d Dirs, paths []string, now time.Time) (string, error) {
+	id := now.UTC().Format(batchFormat)
+	for _, path := range paths {
+		root, rel, ok := d.trashRoot(path)
+		if !ok {
+			return "", fmt.Errorf("%s cannot be moved to the trash", path)
+		}
+		err := moveFile(path, filepath.Join(root, TrashDir, id, rel))
+		if errors.Is(err, fs.ErrNotExist) && !exists(path) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	return id, nil
+}
+
+// trashRoot returns which of d's directories path is inside, and its path
+// relative to it. ok is false if it's in neither, or already in the trash.
+func (d Dirs) trashRoot(path string) (root, rel string, ok bool) {
+	for _, root := range []string{d.Images, d.Meta} {
+		if root == "" {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		return root, rel, !InTrash(rel)
+	}
+	return "", "", false
+}
+
+// Batches returns every trash batch, oldest first.
+func Batches(imagesDir string) ([]Batch, error) {
+	entries, err := os.ReadDir(filepath.Join(imagesDir, TrashDir))
+	if os.IsNotExist(err) {
+		return []Batch{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	batches := []Batch{}
+	for _, entry := range entries {
+		deleted, err := time.Parse(batchFormat, entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		batch := Batch{ID: entry.Name(), Deleted: deleted}
+		err = filepath.WalkDir(filepath.Join(imagesDir, TrashDir, entry.Name()), func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() || !strings.HasSuffix(path, ".webp") {
+				return err
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			batch.Images++
+			batch.Bytes += info.Size()
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		batches = append(batches, batch)
+	}
+	sort.Slice(batches, func(i, j int) bool { return batches[i].ID < batches[j].ID })
+	return batches, nil
+}
+
+// Restore moves the files in a trash batch back to their original paths. If
+// the batch doesn't exist, the error satisfies errors.Is(err, os.ErrNotExist).
+// Restored images are reported as parsed by the layout; files that don't fit
+// it, such as revisions, are restored silently, as is metadata.
+func (l Layout) Restore(d Dirs, id string) (RestoreResult, error) {
+	if _, err := time.Parse(batchFormat, id); err != nil {
+		return RestoreResult{}, fmt.Errorf("batch %s: %w", id, os.ErrNotExist)
+	}
+	imagesDir := d.Images
+	batchDir := filepath.Join(imagesDir, TrashDir, id)
+	if _, err := os.Stat(batchDir); err != nil {
+		return RestoreResult{}, fmt.Errorf("batch %s: %w", id, os.ErrNotExist)
+	}
+
+	var result RestoreResult
+	err := filepath.WalkDir(batchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(batchDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(imagesDir, rel)
+		if exists(dest) {
+			result.Conflicts = append(result.Conflicts, rel)
+			return nil
+		}
+		if err := moveFile(path, dest); err != nil {
+			return err
+		}
+		if img, ok := l.ParsePath(rel); ok {
+			img.Path = dest
+			result.Restored = append(result.Restored, img)
+		}
+		return nil
+	})
+	if err != nil {
+		return result, err
+	}
+	removeEmptyDirs(batchDir)
+
+	if d.Meta != "" {
+		if err := restoreMeta(filepath.Join(d.Meta, TrashDir, id), d.Meta); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+// restoreMeta moves the metadata in a trash batch back to its original paths
+// under metaDir. Metadata whose original path has since been reused stays in
+// the batch, as its image will have.
+func restoreMeta(batchDir, metaDir string) error {
+	err := filepath.WalkDir(batchDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(batchDir, path)
+		if err != nil {
+			return err
+		}
+		dest := filepath.Join(metaDir, rel)
+		if exists(dest) {
+			return nil
+		}
+		return moveFile(path, dest)
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	removeEmptyDirs(batchDir)
+	return err
+}
+
+// PurgeTrash permanently deletes every trash batch created before cutoff,
+// with its metadata, returning the number deleted.
+func PurgeTrash(d Dirs, cutoff time.Time) (int, error) {
+	batches, err := Batches(d.Images)
+	if err != nil {
+		return 0, err
+	}
+	var purged int
+	for _, batch := range batches {
+		if !batch.Deleted.Before(cutoff) {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(d.Images, TrashDir, batch.ID)); err != nil {
+			return purged, err
+		}
+		if d.Meta != "" {
+			if err := os.RemoveAll(filepath.Join(d.Meta, TrashDir, batch.ID)); err != nil {
+				return purged, err
+			}
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// moveFile renames src to dest, creating dest's parent directories.
+func moveFile(src, dest string) error {
+	var err error
+	// Empty directories are cleaned up after every delete, so a newly created
+	// parent may vanish before the rename; if so, try again
+	for attempt := 0; attempt < 2; attempt++ {
+		if err = os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+			return err
+		}
+		err = os.Rename(src, dest)
+		if !errors.Is(err, fs.ErrNotExist) || !exists(src) {
+			return err
+		}
+	}
+	return err
+}
+
+// exists returns true if a file or directory exists at path.
+func exists(path string) bool {
+	_, err := os.Lstat(path)
+	return err == nil
+}
+
+// removeEmptyDirs removes dir and every directory within it, if they hold no
+// files.
+func removeEmptyDirs(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeEmptyDirs(filepath.Join(dir, entry.Name()))
+		}
+	}
+	os.Remove(dir)
+}
@@ -0,0 +1,144 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestInTrash(t *testing.T) {
+	tests := []struct {
+		rel      string
+		expected bool
+	}{
+		{".trash", true},
+		{filepath.Join(".trash", "20251020T055358.000000000Z", "a.webp"), true},
+		{filepath.Join("507f1f77bcf86cd799439011", "a.webp"), false},
+		{".trashy", false},
+	}
+	for _, tt := range tests {
+		if got := InTrash(tt.rel); got != tt.expected {
+			t.Errorf("InTrash(%q) = %v, expected %v", tt.rel, got, tt.expected)
+		}
+	}
+}
+
+func TestTrashRoundTrip(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	charDir := filepath.Join(imagesDir, "507f1f77bcf86cd799439011")
+	image := writeImage(t, imagesDir, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	if err := d.WriteMeta(image, Meta{ID: "68f5ce16713c155df96639bc"}); err != nil {
+		t.Fatal(err)
+	}
+
+	deleted := time.Date(2025, 10, 20, 5, 53, 58, 0, time.UTC)
+	id, err := MoveToTrash(d, []string{charDir, d.MetaMirror(charDir), filepath.Join(imagesDir, "missing")}, deleted)
+	if err != nil {
+		t.Fatalf("MoveToTrash failed: %v", err)
+	}
+	if _, err := os.Stat(charDir); !os.IsNotExist(err) {
+		t.Error("Expected character directory to be moved")
+	}
+	if _, err := os.Stat(filepath.Join(d.Meta, TrashDir, id, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.json")); err != nil {
+		t.Errorf("Expected metadata to be moved to the trash: %v", err)
+	}
+
+	batches, err := Batches(imagesDir)
+	if err != nil {
+		t.Fatalf("Batches failed: %v", err)
+	}
+	if len(batches) != 1 || batches[0].ID != id || !batches[0].Deleted.Equal(deleted) || batches[0].Images != 1 || batches[0].Bytes == 0 {
+		t.Fatalf("Unexpected batches: %+v", batches)
+	}
+
+	// The trash is invisible to the layout
+	if images, _ := Flat.Images(imagesDir); len(images) != 0 {
+		t.Errorf("Expected no images outside the trash, got %v", images)
+	}
+
+	result, err := Flat.Restore(d, id)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(result.Restored) != 1 || result.Restored[0].ID != "68f5ce16713c155df96639bc" || result.Restored[0].Path != image {
+		t.Errorf("Unexpected restored images: %+v", result.Restored)
+	}
+	if len(result.Conflicts) != 0 {
+		t.Errorf("Unexpected conflicts: %v", result.Conflicts)
+	}
+	if _, err := d.ReadMeta(image); err != nil {
+		t.Errorf("Expected metadata to be restored: %v", err)
+	}
+	if batches, _ := Batches(imagesDir); len(batches) != 0 {
+		t.Errorf("Expected restored batch to be removed, got %+v", batches)
+	}
+	if _, err := os.Stat(filepath.Join(d.Meta, TrashDir, id)); !os.IsNotExist(err) {
+		t.Error("Expected restored metadata batch to be removed")
+	}
+
+	if _, err := Flat.Restore(d, id); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist restoring a missing batch, got %v", err)
+	}
+	if _, err := Flat.Restore(d, "../.."); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected ErrNotExist for an invalid batch ID, got %v", err)
+	}
+}
+
+func TestRestoreConflict(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	image := writeImage(t, imagesDir, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+
+	id, err := MoveToTrash(d, []string{image}, time.Now())
+	if err != nil {
+		t.Fatalf("MoveToTrash failed: %v", err)
+	}
+	writeImage(t, imagesDir, "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+
+	result, err := Flat.Restore(d, id)
+	if err != nil {
+		t.Fatalf("Restore failed: %v", err)
+	}
+	if len(result.Restored) != 0 || len(result.Conflicts) != 1 {
+		t.Errorf("Expected one conflict, got %+v", result)
+	}
+	if batches, _ := Batches(imagesDir); len(batches) != 1 {
+		t.Errorf("Expected conflicting file to remain in the trash, got %+v", batches)
+	}
+}
+
+func TestPurgeTrash(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	now := time.Now()
+	for i, age := range []time.Duration{48 * time.Hour, time.Hour} {
+		image := writeImage(t, imagesDir, "507f1f77bcf86cd799439011", []string{"68f5ce16713c155df96639bc.webp", "68f5ce16713c155df96639bd.webp"}[i])
+		if _, err := MoveToTrash(d, []string{image}, now.Add(-age)); err != nil {
+			t.Fatalf("MoveToTrash failed: %v", err)
+		}
+	}
+
+	purged, err := PurgeTrash(d, now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatalf("PurgeTrash failed: %v", err)
+	}
+	if purged != 1 {
+		t.Errorf("Expected 1 batch purged, got %d", purged)
+	}
+	if batches, _ := Batches(imagesDir); len(batches) != 1 || batches[0].Deleted.Before(now.Add(-24*time.Hour)) {
+		t.Errorf("Expected only the recent batch to remain, got %+v", batches)
+	}
+}
+
+func TestMoveToTrashRefusesTrash(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	for _, path := range []string{imagesDir, filepath.Join(imagesDir, TrashDir), filepath.Dir(imagesDir), d.Meta, filepath.Join(d.Meta, TrashDir)} {
+		if _, err := MoveToTrash(d, []string{path}, time.Now()); err == nil {
+			t.Errorf("Expected error moving %s to the trash", path)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"faceclaimer/checks"
+)
+
+// Image identifies a single stored image.
+type Image struct {
+	Guild  int
+	User   int
+	CharID string
+	ID     string
+	// Path is the image's location on disk.
+	Path string
+}
+
+// Created returns the time the image was uploaded, taken from its ObjectID.
+func (img Image) Created() time.Time {
+	oid, err := primitive.ObjectIDFromHex(img.ID)
+	if err != nil {
+		return time.Time{}
+	}
+	return oid.Timestamp()
+}
+
+// Changed returns when the image was last saved at its path: the latest of
+// its ID's timestamp, its file's modification time, and the upload and
+// modification times in its metadata. Moved images count as changed when
+// they're moved, although they keep their ID. The metadata is found in d.
+func (img Image) Changed(d Dirs) time.Time {
+	changed := img.Created()
+	if img.Path == "" {
+		return changed
+	}
+	times := []time.Time{}
+	if stat, err := os.Stat(img.Path); err == nil {
+		times = append(times, stat.ModTime())
+	}
+	if meta, err := d.ReadMeta(img.Path); err == nil {
+		times = append(times, meta.Uploaded, meta.Modified)
+	}
+	for _, t := range times {
+		if t.After(changed) {
+			changed = t
+		}
+	}
+	return changed
+}
+
+// Name returns the image's filename.
+func (img Image) Name() string {
+	return img.ID + ".webp"
+}
+
+// Parts returns the image's path components under the given layout.
+func (img Image) Parts(l Layout) []string {
+	return l.Parts(img.Guild, img.User, img.CharID, img.Name())
+}
+
+// Images returns every image stored in imagesDir under the layout, sorted by
+// path. Files that don't fit the layout, such as those with non-ObjectID
+// names, are ignored.
+func (l Layout) Images(imagesDir string) ([]Image, error) {
+	var pattern string
+	switch l {
+	case Hierarchical:
+		pattern = filepath.Join(imagesDir, "*", "*", "*", "*.webp")
+	case Sharded:
+		pattern = filepath.Join(imagesDir, "*", "*", "*.webp")
+	default:
+		pattern = filepath.Join(imagesDir, "*", "*.webp")
+	}
+
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	return l.parseMatches(imagesDir, matches)
+}
+
+// CharImages returns every image belonging to charID, sorted by path. Callers
+// are responsible for validating charID.
+func (l Layout) CharImages(imagesDir, charID string) ([]Image, error) {
+	dirs, err := l.CharDirs(imagesDir, charID)
+	if err != nil {
+		return nil, err
+	}
+	var matches []string
+	for _, dir := range dirs {
+		dirMatches, err := filepath.Glob(filepath.Join(dir, "*.webp"))
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, dirMatches...)
+	}
+	return l.parseMatches(imagesDir, matches)
+}
+
+// FindImage returns the image with the given character and image IDs,
+// reporting whether it exists. Callers are responsible for validating both IDs.
+func (l Layout) FindImage(imagesDir, charID, imageID string) (Image, bool, error) {
+	images, err := l.CharImages(imagesDir, charID)
+	if err != nil {
+		return Image{}, false, err
+	}
+	for _, img := range images {
+		if img.ID == imageID {
+			return img, true, nil
+		}
+	}
+	return Image{}, false, nil
+}
+
+// parseMatches converts file paths into Images, dropping any that don't fit
+// the layout.
+func (l Layout) parseMatches(imagesDir string, matches []string) ([]Image, error) {
+	sort.Strings(matches)
+
+	var images []Image
+	for _, match := range matches {
+		rel, err := filepath.Rel(imagesDir, match)
+		if err != nil {
+			return nil, err
+		}
+		if img, ok := l.parse(strings.Split(rel, string(filepath.Separator))); ok {
+			img.Path = match
+			images = append(images, img)
+		}
+	}
+	return images, nil
+}
+
+// ParsePath returns the image at rel, a path relative to the images
+// directory, reporting whether it describes a valid image under the layout.
+func (l Layout) ParsePath(rel string) (Image, bool) {
+	return l.parse(strings.Split(filepath.Clean(rel), string(filepath.Separator)))
+}
+
+// parse converts path components relative to the images directory into an
+// Image, reporting whether they describe a valid image under the layout.
+func (l Layout) parse(parts []string) (Image, bool) {
+	if len(parts) < 2 {
+		return Image{}, false
+	}
+	n := len(parts)
+	img := Image{
+		CharID: parts[n-2],
+		ID:     strings.TrimSuffix(parts[n-1], ".webp"),
+	}
+	if !checks.IsValidObjectId(img.CharID) || !checks.IsValidObjectId(img.ID) {
+		return Image{}, false
+	}
+
+	switch l {
+	case Hierarchical:
+		if n != 4 || !checks.IsValidDiscordID(parts[0]) || !checks.IsValidDiscordID(parts[1]) {
+			return Image{}, false
+		}
+		img.Guild, _ = strconv.Atoi(parts[0])
+		img.User, _ = strconv.Atoi(parts[1])
+	case Sharded:
+		if n != 3 || parts[0] != shard(img.CharID) {
+			return Image{}, false
+		}
+	default:
+		if n != 2 {
+			return Image{}, false
+		}
+	}
+	return img, true
+}
@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeImage creates a placeholder image file at imagesDir/parts.
+func writeImage(t *testing.T, imagesDir string, parts ...string) string {
+	t.Helper()
+	path := filepath.Join(append([]string{imagesDir}, parts...)...)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatalf("Failed to create directories: %v", err)
+	}
+	if err := os.WriteFile(path, []byte("image:"+path), 0644); err != nil {
+		t.Fatalf("Failed to create image: %v", err)
+	}
+	return path
+}
+
+func TestImages(t *testing.T) {
+	const (
+		charID  = "507f1f77bcf86cd799439011"
+		imageID = "68f5ce16713c155df96639bc"
+	)
+
+	tests := []struct {
+		name   string
+		layout Layout
+		valid  []string
+		// invalid paths are ignored by the layout
+		invalid [][]string
+	}{
+		{
+			name:   "flat",
+			layout: Flat,
+			valid:  []string{charID, imageID + ".webp"},
+			invalid: [][]string{
+				{"not-a-char", imageID + ".webp"},
+				{charID, "test-image-001.webp"},
+				{charID, imageID + ".json"},
+			},
+		},
+		{
+			name:   "hierarchical",
+			layout: Hierarchical,
+			valid:  []string{"123", "456", charID, imageID + ".webp"},
+			invalid: [][]string{
+				{"abc", "456", charID, imageID + ".webp"},
+				{charID, imageID + ".webp"},
+			},
+		},
+		{
+			name:   "sharded",
+			layout: Sharded,
+			valid:  []string{"11", charID, imageID + ".webp"},
+			invalid: [][]string{
+				{"22", charID, imageID + ".webp"},
+				{charID, imageID + ".webp"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpDir, err := os.MkdirTemp("", "test-images-*")
+			if err != nil {
+				t.Fatalf("Failed to create temp dir: %v", err)
+			}
+			defer os.RemoveAll(tmpDir)
+
+			validPath := writeImage(t, tmpDir, tt.valid...)
+			for _, parts := range tt.invalid {
+				writeImage(t, tmpDir, parts...)
+			}
+
+			images, err := tt.layout.Images(tmpDir)
+			if err != nil {
+				t.Fatalf("Images failed: %v", err)
+			}
+			if len(images) != 1 {
+				t.Fatalf("Expected 1 image, got %d: %v", len(images), images)
+			}
+
+			img := images[0]
+			if img.Path != validPath {
+				t.Errorf("Expected path %s, got %s", validPath, img.Path)
+			}
+			if img.CharID != charID || img.ID != imageID {
+				t.Errorf("Unexpected IDs: %+v", img)
+			}
+			if tt.layout == Hierarchical && (img.Guild != 123 || img.User != 456) {
+				t.Errorf("Expected guild 123 and user 456, got %+v", img)
+			}
+		})
+	}
+}
+
+func TestCharImages(t *testing.T) {
+	tmpDir, err := os.MkdirTemp("", "test-images-*")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	writeImage(t, tmpDir, "123", "456", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bc.webp")
+	writeImage(t, tmpDir, "123", "456", "507f1f77bcf86cd799439011", "68f5ce16713c155df96639bd.webp")
+	writeImage(t, tmpDir, "123", "456", "507f1f77bcf86cd799439012", "68f5ce16713c155df96639be.webp")
+
+	images, err := Hierarchical.CharImages(tmpDir, "507f1f77bcf86cd799439011")
+	if err != nil {
+		t.Fatalf("CharImages failed: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("Expected 2 images, got %d: %v", len(images), images)
+	}
+	if images[0].ID != "68f5ce16713c155df96639bc" || images[1].ID != "68f5ce16713c155df96639bd" {
+		t.Errorf("Unexpected images: %v", images)
+	}
+
+	// 0x68f5ce16 seconds since the epoch
+	if created := images[0].Created(); created.Unix() != 0x68f5ce16 {
+		t.Errorf("Unexpected creation time: %v", created)
+	}
+
+	images, err = Hierarchical.CharImages(tmpDir, "507f1f77bcf86cd799439013")
+	if err != nil {
+		t.Fatalf("CharImages failed: %v", err)
+	}
+	if len(images) != 0 {
+		t.Errorf("Expected no images for unknown character, got %v", images)
+	}
+}
+
+func TestChanged(t *testing.T) {
+	d := testDirs(t)
+	imagesDir := d.Images
+	id := "68f5ce16713c155df96639bc" // 2025-10-20
+	path := writeImage(t, imagesDir, "507f1f77bcf86cd799439011", id+".webp")
+	img := Image{CharID: "507f1f77bcf86cd799439011", ID: id, Path: path}
+	created := img.Created()
+
+	old := created.Add(-time.Hour)
+	os.Chtimes(path, old, old)
+	if got := img.Changed(d); !got.Equal(created) {
+		t.Errorf("Expected the ID's timestamp %v, got %v", created, got)
+	}
+
+	modified := created.Add(time.Hour).UTC()
+	if err := d.WriteMeta(path, Meta{ID: id, Uploaded: created.Add(time.Minute), Modified: modified}); err != nil {
+		t.Fatal(err)
+	}
+	if got := img.Changed(d); !got.Equal(modified) {
+		t.Errorf("Expected the metadata's modification time %v, got %v", modified, got)
+	}
+
+	moved := filepath.Join(imagesDir, "507f1f77bcf86cd799439012", id+".webp")
+	if err := MoveImage(d, img, moved); err != nil {
+		t.Fatal(err)
+	}
+	img.Path = moved
+	if got := img.Changed(d); time.Since(got) > time.Minute {
+		t.Errorf("Expected a moved image to count as changed now, got %v", got)
+	}
+}
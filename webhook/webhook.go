@@ -0,0 +1,223 @@
+// webhook delivers signed JSON events about stored images to HTTP endpoints,
+// retrying failed deliveries with exponential backoff.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson/primitive"
+
+	"faceclaimer/storage"
+)
+
+// Event types.
+const (
+	ImageCreated     = "image.created"
+	ImageUpdated     = "image.updated"
+	ImageDeleted     = "image.deleted"
+	CharacterDeleted = "character.deleted"
+	GuildDeleted     = "guild.deleted"
+	UserDeleted      = "user.deleted"
+	// UploadFailed is sent only to the callback of an asynchronous upload
+	// that failed.
+	UploadFailed = "upload.failed"
+)
+
+// Headers sent with each delivery.
+const (
+	EventHeader     = "X-Faceclaimer-Event"
+	DeliveryHeader  = "X-Faceclaimer-Delivery"
+	TimestampHeader = "X-Faceclaimer-Timestamp"
+	SignatureHeader = "X-Faceclaimer-Signature"
+)
+
+// maxAttempts is the number of times a delivery is tried before giving up.
+const maxAttempts = 5
+
+// Event describes a change to the stored images. Only the fields relevant to
+// its type are set.
+type Event struct {
+	ID      string    `json:"id"`
+	Type    string    `json:"type"`
+	Time    time.Time `json:"time"`
+	Guild   int       `json:"guild,omitempty"`
+	User    int       `json:"user,omitempty"`
+	CharID  string    `json:"charid,omitempty"`
+	ImageID string    `json:"imageid,omitempty"`
+	URL     string    `json:"url,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// NewEvent returns an event of the given type with a new ID.
+func NewEvent(eventType string) Event {
+	return Event{
+		ID:   primitive.NewObjectID().Hex(),
+		Type: eventType,
+		Time: time.Now().UTC(),
+	}
+}
+
+// ImageEvent returns an event about a saved image. It's image.created for
+// new images, and image.updated for images that have been modified.
+func ImageEvent(meta storage.Meta, url string) Event {
+	eventType := ImageCreated
+	if !meta.Modified.IsZero() {
+		eventType = ImageUpdated
+	}
+	event := NewEvent(eventType)
+	event.Guild = meta.Guild
+	event.User = meta.User
+	event.CharID = meta.CharID
+	event.ImageID = meta.ID
+	event.URL = url
+	return event
+}
+
+// DeleteEvent returns an event about the images matching f being deleted.
+func DeleteEvent(f storage.Filter) Event {
+	var event Event
+	switch {
+	case f.ImageID != "":
+		event = NewEvent(ImageDeleted)
+	case f.CharID != "":
+		event = NewEvent(CharacterDeleted)
+	case f.User != 0:
+		event = NewEvent(UserDeleted)
+	default:
+		event = NewEvent(GuildDeleted)
+	}
+	event.Guild = f.Guild
+	event.User = f.User
+	event.CharID = f.CharID
+	event.ImageID = f.ImageID
+	return event
+}
+
+// Sign returns the signature of a delivery: the hex HMAC-SHA256 of the
+// timestamp and body, joined by a period.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notifier delivers events in the background. If it has a URL, every image
+// change is delivered there; events can also be sent to other URLs, such as
+// an upload's callback.
+type Notifier struct {
+	url    string
+	secret []byte
+	client *http.Client
+	// backoff is the delay before the first retry, doubling after each.
+	backoff time.Duration
+
+	wg   sync.WaitGroup
+	done chan struct{}
+	once sync.Once
+}
+
+// New returns a notifier that signs events with secret, and delivers every
+// image change to url, if it isn't empty.
+func New(url, secret string) *Notifier {
+	return &Notifier{
+		url:     url,
+		secret:  []byte(secret),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		backoff: time.Second,
+		done:    make(chan struct{}),
+	}
+}
+
+// Close abandons pending retries and waits for deliveries in progress.
+func (n *Notifier) Close() {
+	n.once.Do(func() { close(n.done) })
+	n.wg.Wait()
+}
+
+// RecordSaved delivers an image.created or image.updated event to the
+// notifier's URL.
+func (n *Notifier) RecordSaved(meta storage.Meta, url string) error {
+	if n.url != "" {
+		n.Send(n.url, ImageEvent(meta, url))
+	}
+	return nil
+}
+
+// RecordDeleted delivers a deletion event to the notifier's URL.
+func (n *Notifier) RecordDeleted(f storage.Filter) error {
+	if n.url != "" {
+		n.Send(n.url, DeleteEvent(f))
+	}
+	return nil
+}
+
+// Send delivers event to url in the background. Deliveries that fail are
+// retried with exponential backoff, and logged if they never succeed.
+func (n *Notifier) Send(url string, event Event) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Failed to encode webhook event", "event", event.Type, "error", err)
+		return
+	}
+
+	n.wg.Add(1)
+	go func() {
+		defer n.wg.Done()
+		delay := n.backoff
+		for attempt := 1; ; attempt++ {
+			retry, err := n.deliver(url, event, body)
+			if err == nil {
+				return
+			}
+			if !retry || attempt == maxAttempts {
+				slog.Warn("Webhook delivery failed", "url", url, "event", event.Type, "delivery", event.ID, "attempts", attempt, "error", err)
+				return
+			}
+			select {
+			case <-time.After(delay):
+				delay *= 2
+			case <-n.done:
+				slog.Warn("Webhook delivery abandoned", "url", url, "event", event.Type, "delivery", event.ID, "error", err)
+				return
+			}
+		}
+	}()
+}
+
+// deliver posts an event once. If it fails, retry reports whether it's worth
+// trying again: client errors other than rate limits are final.
+func (n *Notifier) deliver(url string, event Event, body []byte) (retry bool, err error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(EventHeader, event.Type)
+	req.Header.Set(DeliveryHeader, event.ID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(n.secret, timestamp, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("unexpected status %s", resp.Status)
+	return resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests, err
+}
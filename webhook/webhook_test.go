@@ -0,0 +1,178 @@
+package webhook
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"faceclaimer/storage"
+)
+
+// receiver records the deliveries it receives, responding with the given
+// statuses in turn, then 200.
+type receiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	deliveries []*http.Request
+	bodies     [][]byte
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, _ := io.ReadAll(req.Body)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliveries = append(r.deliveries, req)
+	r.bodies = append(r.bodies, body)
+	if len(r.statuses) > 0 {
+		w.WriteHeader(r.statuses[0])
+		r.statuses = r.statuses[1:]
+	}
+}
+
+func (r *receiver) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.deliveries)
+}
+
+// waitFor waits until the receiver has received n deliveries.
+func (r *receiver) waitFor(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for r.count() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %d deliveries, got %d", n, r.count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// testNotifier returns a notifier with a short backoff, delivering to a new
+// receiver.
+func testNotifier(t *testing.T, statuses ...int) (*Notifier, *receiver) {
+	t.Helper()
+	recv := &receiver{statuses: statuses}
+	srv := httptest.NewServer(recv)
+	t.Cleanup(srv.Close)
+	n := New(srv.URL, "secret")
+	n.backoff = time.Millisecond
+	return n, recv
+}
+
+func TestSend(t *testing.T) {
+	t.Run("signed delivery", func(t *testing.T) {
+		n, recv := testNotifier(t)
+		meta := storage.Meta{ID: "68f5ce16713c155df96639bc", CharID: "507f1f77bcf86cd799439011", Guild: 1, User: 10}
+		n.RecordSaved(meta, "https://example.com/image.webp")
+		n.Close()
+
+		if recv.count() != 1 {
+			t.Fatalf("Expected 1 delivery, got %d", recv.count())
+		}
+		req, body := recv.deliveries[0], recv.bodies[0]
+		if req.Header.Get(EventHeader) != ImageCreated {
+			t.Errorf("Expected %s event header, got %q", ImageCreated, req.Header.Get(EventHeader))
+		}
+		want := Sign([]byte("secret"), req.Header.Get(TimestampHeader), body)
+		if req.Header.Get(SignatureHeader) != want {
+			t.Errorf("Expected signature %s, got %s", want, req.Header.Get(SignatureHeader))
+		}
+
+		var event Event
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Fatal(err)
+		}
+		if event.Type != ImageCreated || event.ImageID != meta.ID || event.CharID != meta.CharID || event.URL != "https://example.com/image.webp" {
+			t.Errorf("Unexpected event: %+v", event)
+		}
+		if event.ID != req.Header.Get(DeliveryHeader) {
+			t.Errorf("Expected delivery header %s, got %s", event.ID, req.Header.Get(DeliveryHeader))
+		}
+	})
+
+	t.Run("retries server errors", func(t *testing.T) {
+		n, recv := testNotifier(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+		n.Send(n.url, NewEvent(CharacterDeleted))
+		recv.waitFor(t, 3)
+		n.Close()
+		if recv.count() != 3 {
+			t.Errorf("Expected 3 attempts, got %d", recv.count())
+		}
+	})
+
+	t.Run("gives up after max attempts", func(t *testing.T) {
+		n, recv := testNotifier(t, 500, 500, 500, 500, 500, 500)
+		n.Send(n.url, NewEvent(CharacterDeleted))
+		recv.waitFor(t, maxAttempts)
+		time.Sleep(20 * time.Millisecond)
+		n.Close()
+		if recv.count() != maxAttempts {
+			t.Errorf("Expected %d attempts, got %d", maxAttempts, recv.count())
+		}
+	})
+
+	t.Run("client errors are final", func(t *testing.T) {
+		n, recv := testNotifier(t, http.StatusBadRequest)
+		n.Send(n.url, NewEvent(CharacterDeleted))
+		n.Close()
+		if recv.count() != 1 {
+			t.Errorf("Expected 1 attempt, got %d", recv.count())
+		}
+	})
+
+	t.Run("close abandons retries", func(t *testing.T) {
+		n, recv := testNotifier(t, 500, 500)
+		n.backoff = time.Hour
+		n.Send(n.url, NewEvent(CharacterDeleted))
+		recv.waitFor(t, 1)
+		n.Close()
+		if recv.count() != 1 {
+			t.Errorf("Expected 1 attempt, got %d", recv.count())
+		}
+	})
+
+	t.Run("no URL", func(t *testing.T) {
+		n := New("", "secret")
+		n.RecordSaved(storage.Meta{}, "")
+		n.RecordDeleted(storage.Filter{CharID: "507f1f77bcf86cd799439011"})
+		n.Close()
+	})
+}
+
+func TestEvents(t *testing.T) {
+	modified := ImageEvent(storage.Meta{ID: "a", Modified: time.Now()}, "")
+	if modified.Type != ImageUpdated {
+		t.Errorf("Expected %s for a modified image, got %s", ImageUpdated, modified.Type)
+	}
+
+	tests := []struct {
+		filter storage.Filter
+		want   string
+	}{
+		{storage.Filter{CharID: "c", ImageID: "i"}, ImageDeleted},
+		{storage.Filter{CharID: "c"}, CharacterDeleted},
+		{storage.Filter{User: 10}, UserDeleted},
+		{storage.Filter{Guild: 1}, GuildDeleted},
+	}
+	for _, tt := range tests {
+		event := DeleteEvent(tt.filter)
+		if event.Type != tt.want {
+			t.Errorf("DeleteEvent(%+v): expected %s, got %s", tt.filter, tt.want, event.Type)
+		}
+		if event.ID == "" || event.Time.IsZero() {
+			t.Errorf("DeleteEvent(%+v): missing ID or time", tt.filter)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	// Computed with: printf '1700000000.{}' | openssl dgst -sha256 -hmac secret
+	want := "sha256=b8569b78799ff9e3cbff0fc2d63a33a2b57f3282abd07c37ae5e8e7d79a5f163"
+	if got := Sign([]byte("secret"), "1700000000", []byte("{}")); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}